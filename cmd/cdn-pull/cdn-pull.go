@@ -4,24 +4,31 @@ import (
 	"bufio"
 	"compress/gzip"
 	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"net/url"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"syscall"
 	"time"
 
-	"cloud.google.com/go/storage"
 	"github.com/golang/glog"
 	"github.com/peterbourgon/ff/v3"
-	"google.golang.org/api/iterator"
-	"google.golang.org/api/option"
 
+	"github.com/livepeer/cdn-log-puller/internal/anomaly"
 	"github.com/livepeer/cdn-log-puller/internal/app"
 	"github.com/livepeer/cdn-log-puller/internal/common"
 	"github.com/livepeer/cdn-log-puller/internal/config"
 	"github.com/livepeer/cdn-log-puller/internal/etl"
+	"github.com/livepeer/cdn-log-puller/internal/geo"
+	"github.com/livepeer/cdn-log-puller/internal/metrics"
+	"github.com/livepeer/cdn-log-puller/internal/quarantine"
+	"github.com/livepeer/cdn-log-puller/internal/rollup"
+	"github.com/livepeer/cdn-log-puller/internal/session"
+	"github.com/livepeer/cdn-log-puller/internal/source"
 	"github.com/livepeer/cdn-log-puller/model"
 )
 
@@ -38,16 +45,44 @@ func main() {
 	downloadCmd := flag.NewFlagSet("download", flag.ExitOnError)
 	downloadVerbosity := downloadCmd.String("v", "", "Log verbosity.  {4|5|6}")
 
-	downloadBucket := downloadCmd.String("bucket", "", "The name of the bucket where logs are located")
+	downloadBucket := downloadCmd.String("bucket", "", "The name of the bucket where logs are located (or gs://, s3://, file://, http(s):// URL)")
 	downloadFolder := downloadCmd.String("folder", "", "The destination folder")
 	downloadCredentials := downloadCmd.String("creds", "", "File name of file with credentials")
 
 	analyzeCmd := flag.NewFlagSet("analyze", flag.ExitOnError)
 	analyzeFolder := analyzeCmd.String("folder", "", "Logs source folder")
+	analyzeBucket := analyzeCmd.String("bucket", "", "Read logs from the bucket (or gs://, s3://, file://, http(s):// URL) instead of folder")
+	analyzeCredentials := analyzeCmd.String("creds", "", "File name of file with credentials")
 	analyzeOutput := analyzeCmd.String("output", "", "Output file path")
 	analyzeOutputFormat := analyzeCmd.String("format", "", "Output file format. It can be sql or csv")
+	analyzeGranularities := analyzeCmd.String("granularities", "", "Comma-separated bucket sizes to aggregate into, e.g. 5m,1h,1d,1mo (by day without granularity column if empty)")
+	analyzeRenditions := analyzeCmd.Bool("renditions", false, "Split rows by rendition, adding rendition column")
+	analyzeRequestClasses := analyzeCmd.Bool("request-classes", false, "Split rows by requested file kind (manifest, segment, init, vod), adding request_class column")
+	analyzeWatchTime := analyzeCmd.Bool("watch-time", false, "Add watch_time_ms column, sum of durations of media segments served with 2xx")
+	analyzeWatchTimePerIP := analyzeCmd.Bool("watch-time-per-ip", false, "Count each segment in watch time once per client IP")
+	analyzeEdges := analyzeCmd.Bool("edges", false, "Split rows by edge server, adding edge column")
+	analyzeLatency := analyzeCmd.Bool("latency", false, "Add latency_p50_ms, latency_p90_ms and latency_p99_ms columns, quantiles of time taken to serve requests")
+	analyzeCache := analyzeCmd.Bool("cache", false, "Add cache_hits, cache_misses, origin_bytes and cache_hit_ratio columns")
+	analyzeGeoDB := analyzeCmd.String("geoip-db", "", "Comma-separated MaxMind-format (mmdb) databases, e.g. GeoLite2-City.mmdb,GeoLite2-ASN.mmdb, to split rows by location of client IPs")
+	analyzeGeoFields := analyzeCmd.String("geo-fields", geo.FieldCountry, "Comma-separated location fields to split rows by, adding a column for each. {country|city|asn}")
+	analyzeUserAgents := analyzeCmd.Bool("user-agents", false, "Split rows by class of the user agent, adding device, os, player and bot columns")
+	analyzeExcludeBots := analyzeCmd.Bool("exclude-bots", false, "Don't count requests of bots in unique users, views and watch time")
+	analyzeReferers := analyzeCmd.String("referers", "", "CSV file to write referer hosts with most views of each stream to ('-' for console)")
+	analyzeTopReferers := analyzeCmd.Int("top-referers", app.DefaultTopReferers, "Number of referer hosts listed for each stream in the referers report")
+	analyzeSketches := analyzeCmd.Bool("sketches", false, "Add users_sketch column with sketch of client IPs, to be combined by 'merge'")
+	analyzeSessions := analyzeCmd.String("sessions", "", "JSON lines file to write playback sessions to ('-' for console)")
+	analyzeSessionTimeout := analyzeCmd.Duration("session-timeout", session.DefaultTimeout, "Inactivity after which playback session is ended")
+	analyzeQuarantine := analyzeCmd.String("quarantine", "", "Gzipped JSON lines file to record rejected log lines in ('-' for console)")
+	analyzeMetricsFile := analyzeCmd.String("metrics-file", "", "File to write Prometheus metrics to after the run (textfile collector format)")
 	analyzeVerbosity := analyzeCmd.String("v", "", "Log verbosity.  {4|5|6}")
 
+	mergeCmd := flag.NewFlagSet("merge", flag.ExitOnError)
+	mergeVerbosity := mergeCmd.String("v", "", "Log verbosity.  {4|5|6}")
+	mergeOutput := mergeCmd.String("output", "-", "Output CSV file ('-' for console)")
+	mergePeriod := mergeCmd.String("period", "day", "Period to roll up to. {hour|day|month|all}")
+	mergeGranularity := mergeCmd.String("granularity", "1h", "Granularity of the rows to read, rows tagged with other granularities are skipped")
+	mergeByRegion := mergeCmd.Bool("by-region", false, "Keep regions separate instead of combining them")
+
 	insertCmd := flag.NewFlagSet("insert", flag.ExitOnError)
 	insertHost := insertCmd.String("host", "localhost", "PostgreSQL host. (default value: localhost)")
 	insertPort := insertCmd.Int("port", 5432, "PostgreSQL port. (default value: 5432)")
@@ -59,30 +94,93 @@ func main() {
 
 	etlCmd := flag.NewFlagSet("etl", flag.ExitOnError)
 	etlVerbosity := etlCmd.String("v", "", "Log verbosity.  {4|5|6}")
-	etlBucket := etlCmd.String("bucket", "", "The name of the bucket where logs are located")
+	etlBucket := etlCmd.String("bucket", "", "The name of the bucket where logs are located (or gs://, s3://, file://, http(s):// URL)")
 	etlCredentials := etlCmd.String("creds", "", "File name of file with credentials")
 	etlConfig := etlCmd.String("config", "config.yaml", "Name of the config file")
 	etlStaging := etlCmd.Bool("staging", true, "Parse staging data instead of production")
 	etlApiKey := etlCmd.String("api-key", "", "Livepeer API key")
 	etlApiUrl := etlCmd.String("api-url", "", "Livepeer API URL")
+	etlApiRetries := etlCmd.Int("api-retries", etl.DefaultAPIClientOptions.MaxRetries, "Number of retries of failed Livepeer API calls")
+	etlApiBackoff := etlCmd.Duration("api-backoff", etl.DefaultAPIClientOptions.MinBackoff, "Delay before the first retry of Livepeer API call, doubled on each next one (negative for no delay)")
+	etlApiMaxBackoff := etlCmd.Duration("api-max-backoff", etl.DefaultAPIClientOptions.MaxBackoff, "Maximum delay between retries of Livepeer API call")
+	etlApiBreakerThreshold := etlCmd.Int("api-breaker-threshold", etl.DefaultAPIClientOptions.BreakerThreshold, "Number of consecutive failed Livepeer API calls after which API is not called for a while (0 to disable)")
+	etlApiBreakerCooldown := etlCmd.Duration("api-breaker-cooldown", etl.DefaultAPIClientOptions.BreakerCooldown, "How long Livepeer API is not called after too many failures")
+	etlApiIdempotencyKeys := etlCmd.Bool("api-idempotency-keys", false, "Livepeer API honours Idempotency-Key header, so data posts can be retried after timeouts and 5xx")
+	etlSink := etlCmd.String("sink", "api", "Where to send aggregated data. {api|postgres|file|stdout}")
+	etlSinkFile := etlCmd.String("sink-file", "", "Name of the file to append JSON lines to (for 'file' sink)")
+	etlSinkDsn := etlCmd.String("sink-dsn", "", "PostgreSQL connection string (for 'postgres' sink)")
+	etlCheckpoints := etlCmd.String("checkpoints", "", "JSON file name or PostgreSQL URL (postgres://...) to store processing progress in")
+	etlOnReplay := etlCmd.String("on-replay", etl.ReplaySkip, "What to do with data of the hour already sent to the sink. {skip|resend}")
+	etlDaemon := etlCmd.Bool("daemon", false, "Keep running, processing new logs every interval")
+	etlInterval := etlCmd.Duration("interval", 5*time.Minute, "Time between passes over the regions in daemon mode")
+	etlLateness := etlCmd.Duration("lateness", 0, "How long to wait after the end of the hour before processing it")
+	etlGranularities := etlCmd.String("granularities", "1h", "Comma-separated bucket sizes to aggregate into, e.g. 5m,1h,1d,1mo")
+	etlRenditions := etlCmd.Bool("renditions", false, "Add breakdown by rendition to the data of each stream")
+	etlRequestClasses := etlCmd.Bool("request-classes", false, "Add breakdown by requested file kind (manifest, segment, init, vod) to the data of each stream")
+	etlCache := etlCmd.Bool("cache", false, "Add cache hit ratio and origin bytes of each stream, region and edge server to the data")
+	etlLatency := etlCmd.Bool("latency", false, "Add p50/p90/p99 of time taken to serve requests of each stream, region and edge server to the data")
+	etlStatusCodes := etlCmd.String("status-codes", etl.StatusCodesCollapse, "Break the data of each stream down by response status. {collapse|class|code}")
+	etlGeoDB := etlCmd.String("geoip-db", "", "Comma-separated MaxMind-format (mmdb) databases, e.g. GeoLite2-City.mmdb,GeoLite2-ASN.mmdb, to add breakdown by location of client IPs")
+	etlGeoFields := etlCmd.String("geo-fields", geo.FieldCountry, "Comma-separated location fields to break the data of each stream down by. {country|city|asn}")
+	etlUserAgents := etlCmd.Bool("user-agents", false, "Add breakdown by device class, OS, player and bot flag to the data of each stream")
+	etlExcludeBots := etlCmd.Bool("exclude-bots", false, "Don't count requests of bots in unique users, views and watch time")
+	etlTopReferers := etlCmd.Int("top-referers", 0, "Add that many referer hosts with most requests to the data of each stream (0 to leave them out)")
+	etlWatchTimePerIP := etlCmd.Bool("watch-time-per-ip", false, "Count each segment in watch time once per client IP")
+	etlSketches := etlCmd.Bool("sketches", false, "Add sketches of client IPs to the data, to be combined by 'merge'")
+	etlSessions := etlCmd.String("sessions", "", "JSON lines file to write playback sessions to ('-' for console)")
+	etlSessionTimeout := etlCmd.Duration("session-timeout", session.DefaultTimeout, "Inactivity after which playback session is ended")
+	etlAnomalies := etlCmd.String("anomalies", "", "JSON lines file to write traffic anomalies of the streams to ('-' for console)")
+	etlAnomalyWebhook := etlCmd.String("anomaly-webhook", "", "URL to POST found anomalies to, as JSON array")
+	etlAnomalyState := etlCmd.String("anomaly-state", "", "File to keep baselines of the streams in between runs")
+	etlAnomalyWindow := etlCmd.Int("anomaly-window", anomaly.DefaultOptions.Window, "Number of the last hours with traffic the baseline of each stream is built from")
+	etlAnomalyThreshold := etlCmd.Float64("anomaly-threshold", anomaly.DefaultOptions.Threshold, "Number of standard deviations above the baseline that is a spike")
+	etlQuarantine := etlCmd.String("quarantine", "", "Gzipped JSON lines file to record rejected log lines in ('-' for console)")
+	etlMetricsAddr := etlCmd.String("metrics-addr", "", "Address to serve Prometheus /metrics on in daemon mode, e.g. :9090")
+	etlMetricsFile := etlCmd.String("metrics-file", "", "File to write Prometheus metrics to after one-shot run (textfile collector format)")
+	etlDryRun := etlCmd.Bool("dry-run", false, "Compute aggregates without sending them to the sink")
+	etlDryRunOutput := etlCmd.String("dry-run-output", "", "File to write dry run results to (console by default)")
+	etlRegion := etlCmd.String("region", "", "Region to backfill (for 'etl backfill')")
+	etlFrom := etlCmd.String("from", "", "Start of the backfill range, RFC3339 or 2006-01-02T15 (for 'etl backfill')")
+	etlTo := etlCmd.String("to", "", "End of the backfill range, exclusive (for 'etl backfill')")
+	etlReplace := etlCmd.Bool("replace", false, "Replace data stored in the sink instead of adding to it (for 'etl backfill')")
 
 	catCmd := flag.NewFlagSet("cat", flag.ExitOnError)
 	catVerbosity := catCmd.String("v", "", "Log verbosity.  {4|5|6}")
-	catBucket := catCmd.String("bucket", "", "The name of the bucket where logs are located")
+	catBucket := catCmd.String("bucket", "", "The name of the bucket where logs are located (or gs://, s3://, file://, http(s):// URL)")
 	catCredentials := catCmd.String("creds", "", "File name of file with credentials")
 	catConfig := catCmd.String("config", "config.yaml", "Name of the config file")
 	catRegion := catCmd.String("region", "", "Region")
 	catDownloadDir := catCmd.String("down", "", "Download to dir instead of printing to console")
 
+	topCmd := flag.NewFlagSet("top", flag.ExitOnError)
+	topVerbosity := topCmd.String("v", "", "Log verbosity.  {4|5|6}")
+	topBucket := topCmd.String("bucket", "", "The name of the bucket where logs are located (or gs://, s3://, file://, http(s):// URL, or local folder)")
+	topCredentials := topCmd.String("creds", "", "File name of file with credentials")
+	topConfig := topCmd.String("config", "config.yaml", "Name of the config file")
+	topStaging := topCmd.Bool("staging", true, "Report staging regions instead of production (if region is not set)")
+	topRegion := topCmd.String("region", "", "Region to report (all regions if empty)")
+	topFrom := topCmd.String("from", "", "First hour to report, RFC3339 or 2006-01-02T15")
+	topTo := topCmd.String("to", "", "End of the reported range, exclusive (one hour if empty)")
+	topBy := topCmd.String("by", etl.TopByStream, "What to find heavy hitters of. {stream|ip|edge}")
+	topN := topCmd.Int("n", 10, "Number of heavy hitters listed by bytes, requests and uniques")
+	topCapacity := topCmd.Int("capacity", etl.DefaultTopCapacity, "Number of keys tracked in each hour, keys with more than 1/capacity of the traffic are always found")
+	topOutput := topCmd.String("output", "-", "JSON lines file to write reports to ('-' for console)")
+	topQuarantine := topCmd.String("quarantine", "", "Gzipped JSON lines file to record rejected log lines in ('-' for console)")
+
 	if len(os.Args) < 2 {
 		fmt.Printf("Version %s\n", model.Version)
-		fmt.Print("expected 'etl', 'download', 'analyze' or 'insert' subcommands")
+		fmt.Print("expected 'etl', 'top', 'download', 'analyze', 'merge' or 'insert' subcommands")
 		os.Exit(1)
 	}
 
 	switch os.Args[1] {
 	case "etl":
-		ff.Parse(etlCmd, os.Args[2:],
+		etlArgs := os.Args[2:]
+		backfill := len(etlArgs) > 0 && etlArgs[0] == "backfill"
+		if backfill {
+			etlArgs = etlArgs[1:]
+		}
+		ff.Parse(etlCmd, etlArgs,
 			ff.WithEnvVarPrefix("CP"),
 			ff.WithConfigFileFlag("config"),
 			ff.WithConfigFileParser(ff.PlainParser),
@@ -92,16 +190,43 @@ func main() {
 		if *etlBucket == "" {
 			glog.Fatalf("Please provide bucket name")
 		}
-		if *etlApiKey == "" {
-			glog.Fatalf("Please provide Livepeer API key")
+		var backfillFrom, backfillTo time.Time
+		if backfill {
+			if *etlRegion == "" {
+				glog.Fatalf("Please provide region name")
+			}
+			var err error
+			if backfillFrom, err = parseTime(*etlFrom); err != nil {
+				glog.Fatalf("Invalid backfill start time %q: %v", *etlFrom, err)
+			}
+			if backfillTo, err = parseTime(*etlTo); err != nil {
+				glog.Fatalf("Invalid backfill end time %q: %v", *etlTo, err)
+			}
+		}
+		if *etlOnReplay != etl.ReplaySkip && *etlOnReplay != etl.ReplayResend {
+			glog.Fatalf("Invalid on-replay value %q", *etlOnReplay)
 		}
-		if *etlApiUrl == "" {
-			glog.Fatalf("Please provide Livepeer API URL")
+		if (*etlSink == "api" && !*etlDryRun) || *etlApiUrl != "" {
+			if *etlApiKey == "" {
+				glog.Fatalf("Please provide Livepeer API key")
+			}
+			if *etlApiUrl == "" {
+				glog.Fatalf("Please provide Livepeer API URL")
+			}
 		}
-		apiUrl, err := url.ParseRequestURI(*etlApiUrl)
+		var apiUrl *url.URL
+		if *etlApiUrl != "" {
+			var err error
+			apiUrl, err = url.ParseRequestURI(*etlApiUrl)
+			if err != nil {
+				glog.Errorf("Invalid Livepeer API URL: %v", err)
+				os.Exit(9)
+			}
+		}
+
+		granularities, err := rollup.ParseList(*etlGranularities)
 		if err != nil {
-			glog.Errorf("Invalid Livepeer API URL: %v", err)
-			os.Exit(9)
+			glog.Fatal(err)
 		}
 
 		cfg, err := config.ReadConfig(*etlConfig)
@@ -114,18 +239,197 @@ func main() {
 		glog.Infof("  bucket: %q", *etlBucket)
 		glog.Infof("  credentials: %q", *etlCredentials)
 		glog.Infof("  config: %q", *etlConfig)
+		glog.Infof("  sink: %q", *etlSink)
 		gctx := context.TODO()
-		etli, err := etl.NewEtl(gctx, cfg, *etlBucket, *etlCredentials, *etlStaging, *etlApiKey, apiUrl)
+		src, err := source.New(gctx, *etlBucket, *etlCredentials)
+		if err != nil {
+			glog.Fatal(err)
+		}
+		defer src.Close()
+		var api *etl.APIClient
+		if apiUrl != nil {
+			api = etl.NewAPIClient(*etlApiKey, apiUrl, etl.APIClientOptions{
+				MaxRetries:       *etlApiRetries,
+				MinBackoff:       *etlApiBackoff,
+				MaxBackoff:       *etlApiMaxBackoff,
+				BreakerThreshold: *etlApiBreakerThreshold,
+				BreakerCooldown:  *etlApiBreakerCooldown,
+				IdempotencyKeys:  *etlApiIdempotencyKeys,
+			})
+		}
+		var sink etl.Sink
+		var dryRunOut io.Writer
+		switch {
+		case *etlDryRun && *etlDryRunOutput != "":
+			fh, err := os.Create(*etlDryRunOutput)
+			if err != nil {
+				glog.Fatal(err)
+			}
+			defer fh.Close()
+			dryRunOut = fh
+		case *etlDryRun:
+			dryRunOut = os.Stdout
+		}
+		switch {
+		case *etlDryRun:
+			glog.Infof("Dry run, results are written to %q", *etlDryRunOutput)
+		case *etlSink == "api":
+			sink = etl.NewAPISink(api)
+		case *etlSink == "postgres":
+			if *etlSinkDsn == "" {
+				glog.Fatalf("Please provide PostgreSQL connection string")
+			}
+			sink, err = etl.NewPostgresSink(*etlSinkDsn)
+		case *etlSink == "file":
+			if *etlSinkFile == "" {
+				glog.Fatalf("Please provide sink file name")
+			}
+			sink, err = etl.NewFileSink(*etlSinkFile)
+		case *etlSink == "stdout":
+			sink = etl.NewStdoutSink()
+		default:
+			glog.Fatalf("Invalid sink %q, valid sinks are api, postgres, file and stdout", *etlSink)
+		}
 		if err != nil {
 			glog.Fatal(err)
 		}
-		if err = etli.Do(); err != nil {
-			if err == etl.ErrForbidden {
+		if sink != nil {
+			defer sink.Close()
+		}
+		var checkpoints etl.CheckpointStore
+		if *etlCheckpoints != "" {
+			checkpoints, err = etl.NewCheckpointStore(*etlCheckpoints)
+			if err != nil {
+				glog.Fatal(err)
+			}
+			defer checkpoints.Close()
+		}
+		q := openQuarantine(*etlQuarantine, *etlDryRun)
+		sessions := openSessions(*etlSessions, *etlSessionTimeout, *etlDryRun)
+		anomalies := openAnomalies(*etlAnomalies, *etlAnomalyWebhook, *etlAnomalyState,
+			anomaly.Options{Window: *etlAnomalyWindow, Threshold: *etlAnomalyThreshold}, *etlDryRun)
+		opts := etl.Options{
+			Staging:        *etlStaging,
+			API:            api,
+			Checkpoints:    checkpoints,
+			OnReplay:       *etlOnReplay,
+			Lateness:       *etlLateness,
+			Quarantine:     q,
+			Sketches:       *etlSketches,
+			Renditions:     *etlRenditions,
+			RequestClasses: *etlRequestClasses,
+			WatchTimePerIP: *etlWatchTimePerIP,
+			StatusCodes:    *etlStatusCodes,
+			Cache:          *etlCache,
+			Latency:        *etlLatency,
+			UserAgents:     *etlUserAgents,
+			ExcludeBots:    *etlExcludeBots,
+			TopReferers:    *etlTopReferers,
+			Granularities:  granularities,
+			Sessions:       sessions,
+			Anomalies:      anomalies,
+			DryRun:         dryRunOut,
+		}
+		if resolver, fields := openGeo(*etlGeoDB, *etlGeoFields); resolver != nil {
+			defer resolver.Close()
+			opts.Geo, opts.GeoFields = resolver, fields
+		}
+		etli, err := etl.NewEtl(gctx, cfg, src, sink, opts)
+		if err != nil {
+			glog.Fatal(err)
+		}
+		sigs := make(chan os.Signal, 1)
+		signal.Notify(sigs, syscall.SIGTERM, syscall.SIGINT)
+		go func() {
+			sig := <-sigs
+			glog.Infof("Got signal %s, stopping after the current hour", sig)
+			etli.Stop()
+		}()
+		switch {
+		case backfill:
+			glog.Infof("Backfilling region=%s from=%s to=%s replace=%v", *etlRegion, backfillFrom, backfillTo, *etlReplace)
+			err = etli.Backfill(*etlRegion, backfillFrom, backfillTo, *etlReplace)
+		case *etlDaemon:
+			glog.Infof("Running as daemon interval=%s lateness=%s", *etlInterval, *etlLateness)
+			if *etlMetricsAddr != "" {
+				go func() {
+					glog.Fatal(metrics.Serve(*etlMetricsAddr))
+				}()
+			}
+			err = etli.Daemon(*etlInterval)
+		default:
+			err = etli.Do()
+		}
+		closeQuarantine(q)
+		closeSessions(sessions)
+		closeAnomalies(anomalies)
+		writeMetrics(*etlMetricsFile)
+		if err == etl.ErrStopped {
+			glog.Infof("Stopped")
+			err = nil
+		}
+		if err != nil {
+			if errors.Is(err, etl.ErrForbidden) {
 				glog.Errorf("Wrong Livepeer API key ")
 				os.Exit(10)
 			}
 			glog.Fatal(err)
 		}
+	case "top":
+		ff.Parse(topCmd, os.Args[2:],
+			ff.WithEnvVarPrefix("CP"),
+			ff.WithConfigFileFlag("config"),
+			ff.WithConfigFileParser(ff.PlainParser),
+		)
+		flag.CommandLine.Parse(nil)
+		vFlag.Value.Set(*topVerbosity)
+		if *topBucket == "" {
+			glog.Fatalf("Please provide bucket name")
+		}
+		from, err := parseTime(*topFrom)
+		if err != nil {
+			glog.Fatalf("Invalid start time %q: %v", *topFrom, err)
+		}
+		to := from.Add(time.Hour)
+		if *topTo != "" {
+			if to, err = parseTime(*topTo); err != nil {
+				glog.Fatalf("Invalid end time %q: %v", *topTo, err)
+			}
+		}
+		cfg, err := config.ReadConfig(*topConfig)
+		if err != nil {
+			glog.Fatal(err)
+		}
+
+		glog.Infof("Version %s", model.Version)
+		glog.Info("subcommand 'top'")
+		glog.Infof("  bucket: %q", *topBucket)
+		glog.Infof("  config: %q", *topConfig)
+		gctx := context.TODO()
+		src, err := source.New(gctx, *topBucket, *topCredentials)
+		if err != nil {
+			glog.Fatal(err)
+		}
+		defer src.Close()
+		var out io.Writer = os.Stdout
+		if *topOutput != "-" {
+			fh, err := os.Create(*topOutput)
+			if err != nil {
+				glog.Fatal(err)
+			}
+			defer fh.Close()
+			out = fh
+		}
+		q := openQuarantine(*topQuarantine, false)
+		etli, err := etl.NewEtl(gctx, cfg, src, nil, etl.Options{Staging: *topStaging, Quarantine: q})
+		if err != nil {
+			glog.Fatal(err)
+		}
+		err = etli.Top(*topRegion, from, to, etl.TopOptions{Dimension: *topBy, N: *topN, Capacity: *topCapacity}, out)
+		closeQuarantine(q)
+		if err != nil {
+			glog.Fatal(err)
+		}
 	case "cat":
 		ff.Parse(catCmd, os.Args[2:],
 			ff.WithEnvVarPrefix("CP"),
@@ -161,23 +465,21 @@ func main() {
 		glog.Infof("  credentials: %q", *catCredentials)
 		glog.Infof("  config: %q", *catConfig)
 		gctx := context.TODO()
-		var opts []option.ClientOption
-		opts = append(opts, option.WithCredentialsFile(*catCredentials))
-		client, err := storage.NewClient(gctx, opts...)
+		src, err := source.New(gctx, *catBucket, *catCredentials)
 		if err != nil {
 			glog.Fatal(err)
 		}
-		query := storage.Query{
+		query := source.Query{
 			Delimiter: "",
 			Prefix:    topDirName + "/cds/",
 		}
 		ctx, cancel := context.WithTimeout(gctx, time.Second*15)
-		it := client.Bucket(*catBucket).Objects(ctx, &query)
+		it := src.List(ctx, &query)
 		defer cancel()
 		for {
 			fi, err := it.Next()
 			if err != nil {
-				if err == iterator.Done {
+				if err == source.Done {
 					break
 				}
 				glog.Errorf("Returning err=%v", err)
@@ -188,13 +490,13 @@ func main() {
 			// }
 			glog.V(common.DEBUG).Infof("==> Got file name=%q prefix=%q", fi.Name, fi.Prefix)
 			if *catDownloadDir != "" {
-				downloadFile(client, *catBucket, fi.Name, *catDownloadDir)
+				downloadFile(src, fi.Name, *catDownloadDir)
 			} else {
-				printFile(client, *catBucket, fi.Name)
+				printFile(src, fi.Name)
 			}
 		}
 
-		client.Close()
+		src.Close()
 
 	case "download":
 		ff.Parse(downloadCmd, os.Args[2:],
@@ -215,7 +517,12 @@ func main() {
 		glog.Info("  bucket:", *downloadBucket)
 		glog.Info("  download folder:", *downloadFolder)
 		glog.Info("  credentials:", *downloadCredentials)
-		err = app.ListAndDownloadFiles(*downloadBucket, *downloadFolder, *downloadCredentials)
+		src, err := source.New(context.TODO(), *downloadBucket, *downloadCredentials)
+		if err != nil {
+			glog.Fatal(err)
+		}
+		defer src.Close()
+		err = app.ListAndDownloadFiles(src, *downloadFolder)
 		if err != nil {
 			glog.Fatal(err)
 		}
@@ -229,6 +536,14 @@ func main() {
 		vFlag.Value.Set(*analyzeVerbosity)
 
 		// validate parameters
+		if *analyzeFolder == "" && *analyzeBucket == "" {
+			glog.Fatalf("Please provide folder or bucket")
+		}
+		if *analyzeBucket != "" {
+			if err := source.Validate(*analyzeBucket); err != nil {
+				glog.Fatal(err)
+			}
+		}
 		err := app.ValidateParseParameters(*analyzeFolder, *analyzeOutput, *analyzeOutputFormat)
 		if err != nil {
 			glog.Fatal(err)
@@ -236,14 +551,67 @@ func main() {
 
 		glog.Info("subcommand 'analyze'")
 		glog.Info("  folder:", *analyzeFolder)
+		glog.Info("  bucket:", *analyzeBucket)
 		glog.Info("  output:", *analyzeOutput)
 		glog.Info("  outputFormat:", *analyzeOutputFormat)
 
-		err = app.ParseFiles(*analyzeFolder, *analyzeOutput, *analyzeOutputFormat)
+		q := openQuarantine(*analyzeQuarantine, false)
+		parseOpts := app.ParseOptions{
+			Quarantine:     q,
+			Sketches:       *analyzeSketches,
+			Renditions:     *analyzeRenditions,
+			RequestClasses: *analyzeRequestClasses,
+			WatchTime:      *analyzeWatchTime || *analyzeWatchTimePerIP,
+			WatchTimePerIP: *analyzeWatchTimePerIP,
+			Edges:          *analyzeEdges,
+			Latency:        *analyzeLatency,
+			Cache:          *analyzeCache,
+			UserAgents:     *analyzeUserAgents,
+			ExcludeBots:    *analyzeExcludeBots,
+			Referers:       *analyzeReferers,
+			TopReferers:    *analyzeTopReferers,
+			Sessions:       openSessions(*analyzeSessions, *analyzeSessionTimeout, false),
+		}
+		if resolver, fields := openGeo(*analyzeGeoDB, *analyzeGeoFields); resolver != nil {
+			defer resolver.Close()
+			parseOpts.Geo, parseOpts.GeoFields = resolver, fields
+		}
+		if *analyzeGranularities != "" {
+			if parseOpts.Granularities, err = rollup.ParseList(*analyzeGranularities); err != nil {
+				glog.Fatal(err)
+			}
+		}
+		if *analyzeBucket != "" {
+			src, err := source.New(context.TODO(), *analyzeBucket, *analyzeCredentials)
+			if err != nil {
+				glog.Fatal(err)
+			}
+			defer src.Close()
+			err = app.ParseSource(src, *analyzeOutput, *analyzeOutputFormat, parseOpts)
+		} else {
+			err = app.ParseFiles(*analyzeFolder, *analyzeOutput, *analyzeOutputFormat, parseOpts)
+		}
+		closeQuarantine(q)
+		closeSessions(parseOpts.Sessions)
+		writeMetrics(*analyzeMetricsFile)
 		if err != nil {
 			glog.Fatal(err)
 		}
 
+	case "merge":
+		ff.Parse(mergeCmd, os.Args[2:], ff.WithEnvVarPrefix("CP"))
+		flag.CommandLine.Parse(nil)
+		vFlag.Value.Set(*mergeVerbosity)
+		if mergeCmd.NArg() == 0 {
+			glog.Fatalf("Please provide files to merge")
+		}
+		glog.Info("subcommand 'merge'")
+		glog.Infof("  files: %v", mergeCmd.Args())
+		glog.Infof("  period: %s", *mergePeriod)
+		if err := app.Merge(mergeCmd.Args(), *mergeOutput, *mergePeriod, *mergeGranularity, *mergeByRegion); err != nil {
+			glog.Fatal(err)
+		}
+
 	case "insert":
 		ff.Parse(insertCmd, os.Args[2:],
 			ff.WithEnvVarPrefix("CP"),
@@ -279,7 +647,7 @@ func main() {
 			os.Exit(0)
 		}
 
-		fmt.Print("expected 'etl', 'download', 'analyze' or 'insert' subcommands")
+		fmt.Print("expected 'etl', 'top', 'download', 'analyze', 'merge' or 'insert' subcommands")
 		os.Exit(1)
 	}
 
@@ -287,13 +655,26 @@ func main() {
 	glog.Infof("Execution took %s", elapsed)
 }
 
-func printFile(client *storage.Client, bucket, file string) {
+// parseTime parses time given on the command line, times without zone are in UTC
+func parseTime(val string) (time.Time, error) {
+	layouts := []string{time.RFC3339, "2006-01-02T15:04", "2006-01-02T15", "2006-01-02"}
+	var err error
+	for _, layout := range layouts {
+		var tm time.Time
+		if tm, err = time.Parse(layout, val); err == nil {
+			return tm, nil
+		}
+	}
+	return time.Time{}, err
+}
+
+func printFile(src source.Source, file string) {
 	fmt.Printf("Printing file %s\n", file)
 	ctx, cancel := context.WithTimeout(context.Background(), time.Second*6000)
 	defer cancel()
-	rc, err := client.Bucket(bucket).Object(file).NewReader(ctx)
+	rc, err := src.Open(ctx, file)
 	if err != nil {
-		panic(fmt.Errorf("Object(%q).NewReader: %v", file, err))
+		panic(err)
 	}
 	defer rc.Close()
 
@@ -310,7 +691,7 @@ func printFile(client *storage.Client, bucket, file string) {
 	}
 }
 
-func downloadFile(client *storage.Client, bucket, file, targetDir string) {
+func downloadFile(src source.Source, file, targetDir string) {
 	_, targetFileName := filepath.Split(file)
 	targetFullPath := filepath.Join(targetDir, targetFileName)
 	if _, err := os.Stat(targetFullPath); err == nil {
@@ -320,9 +701,9 @@ func downloadFile(client *storage.Client, bucket, file, targetDir string) {
 	glog.Infof("Downloading file %s", file)
 	ctx, cancel := context.WithTimeout(context.Background(), time.Second*6000)
 	defer cancel()
-	rc, err := client.Bucket(bucket).Object(file).NewReader(ctx)
+	rc, err := src.Open(ctx, file)
 	if err != nil {
-		panic(fmt.Errorf("Object(%q).NewReader: %v", file, err))
+		panic(err)
 	}
 	defer rc.Close()
 	fh, err := os.Create(targetFullPath)
@@ -335,3 +716,89 @@ func downloadFile(client *storage.Client, bucket, file, targetDir string) {
 	}
 	fh.Close()
 }
+
+// writeMetrics dumps metrics to the file if name is given
+func writeMetrics(fileName string) {
+	if fileName == "" {
+		return
+	}
+	if err := metrics.WriteTextfile(fileName); err != nil {
+		glog.Errorf("Error writing metrics to file=%s err=%v", fileName, err)
+	}
+}
+
+// openQuarantine returns nil if fileName is empty or in dry run
+func openQuarantine(fileName string, dryRun bool) *quarantine.Quarantine {
+	if fileName == "" || dryRun {
+		return nil
+	}
+	q, err := quarantine.New(fileName)
+	if err != nil {
+		glog.Fatalf("Error creating quarantine file=%s err=%v", fileName, err)
+	}
+	return q
+}
+
+func closeQuarantine(q *quarantine.Quarantine) {
+	if err := q.Close(); err != nil {
+		glog.Errorf("Error closing quarantine err=%v", err)
+	}
+}
+
+// openSessions returns nil if fileName is empty or in dry run
+func openSessions(fileName string, timeout time.Duration, dryRun bool) *session.Sessionizer {
+	if fileName == "" || dryRun {
+		return nil
+	}
+	s, err := session.New(fileName, timeout)
+	if err != nil {
+		glog.Fatalf("Error creating sessions file=%s err=%v", fileName, err)
+	}
+	return s
+}
+
+// closeSessions writes sessions that are still open
+func closeSessions(s *session.Sessionizer) {
+	if err := s.Close(); err != nil {
+		glog.Errorf("Error writing sessions err=%v", err)
+	}
+}
+
+// openAnomalies returns nil if neither report file nor webhook is set. In dry run
+// anomalies go only to the dry run output, so neither of them is used.
+func openAnomalies(fileName, webhook, stateFile string, opts anomaly.Options, dryRun bool) *anomaly.Detector {
+	if fileName == "" && webhook == "" {
+		return nil
+	}
+	if dryRun {
+		fileName, webhook = "", ""
+	}
+	d, err := anomaly.New(fileName, webhook, stateFile, opts)
+	if err != nil {
+		glog.Fatalf("Error creating anomaly detector file=%s err=%v", fileName, err)
+	}
+	return d
+}
+
+// closeAnomalies saves baselines of the streams
+func closeAnomalies(d *anomaly.Detector) {
+	if err := d.Close(); err != nil {
+		glog.Errorf("Error closing anomaly detector err=%v", err)
+	}
+}
+
+// openGeo opens geo databases, returns nil resolver if there are none
+func openGeo(fileNames, fields string) (*geo.Resolver, []string) {
+	if fileNames == "" {
+		return nil, nil
+	}
+	parsed, err := geo.ParseFields(fields)
+	if err != nil {
+		glog.Fatal(err)
+	}
+	resolver, err := geo.Open(fileNames)
+	if err != nil {
+		glog.Fatal(err)
+	}
+	return resolver, parsed
+}
@@ -0,0 +1,470 @@
+// Package anomaly flags unusual traffic of the streams in hourly aggregates:
+// spikes of bytes, requests or unique client IPs over the rolling baseline of
+// the stream, single client IP taking most of the stream's traffic, and
+// surges of 4xx/5xx responses.
+package anomaly
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/livepeer/cdn-log-puller/internal/metrics"
+)
+
+// kinds of anomalies
+const (
+	KindSpike       = "spike"
+	KindClientShare = "client_share"
+	KindErrorSurge  = "error_surge"
+)
+
+// metrics anomalies are found in
+const (
+	MetricBytes    = "bytes"
+	MetricRequests = "requests"
+	MetricUniques  = "unique_client_ips"
+	Metric4xx      = "4xx"
+	Metric5xx      = "5xx"
+)
+
+const webhookTimeout = 10 * time.Second
+
+type (
+	// Options tune the detector, zero values are taken from DefaultOptions
+	Options struct {
+		// Window is the number of the last hours with traffic the baseline of the stream is built from
+		Window int
+		// MinHistory is the number of hours in the baseline needed before spikes are flagged
+		MinHistory int
+		// Threshold is the number of standard deviations above the baseline
+		// mean the value has to be to be a spike
+		Threshold float64
+		// MinFactor is how many times the value has to exceed the baseline mean
+		// to be a spike or an error surge, so steady streams are not flagged
+		// for tiny changes
+		MinFactor float64
+		// MinRequests is the number of requests in the hour below which the stream is not checked
+		MinRequests int64
+		// ClientShare is the share of the stream's bytes taken by a single
+		// client IP that is flagged, if the stream has at least MinClients viewers
+		ClientShare float64
+		MinClients  int64
+		// ErrorRate is the share of 4xx (or 5xx) responses that is flagged,
+		// if it is also MinFactor times the baseline rate
+		ErrorRate float64
+	}
+
+	// Sample is the traffic of one stream in one region and hour
+	Sample struct {
+		Region     string
+		Hour       time.Time
+		StreamID   string
+		PlaybackID string
+		Bytes      int64
+		Requests   int64
+		Uniques    int64
+		// ClientErrors and ServerErrors are the numbers of 4xx and 5xx responses
+		ClientErrors int64
+		ServerErrors int64
+		// TopClient is the client IP with most bytes of the stream
+		TopClient      string
+		TopClientBytes int64
+	}
+
+	// Anomaly is written as JSON line to the report and posted to the webhook
+	Anomaly struct {
+		Kind       string    `json:"kind"`
+		Metric     string    `json:"metric"`
+		Region     string    `json:"region"`
+		Hour       time.Time `json:"hour"`
+		StreamID   string    `json:"stream_id,omitempty"`
+		PlaybackID string    `json:"playback_id,omitempty"`
+		Value      float64   `json:"value"`
+		// Baseline is the mean of the metric in the previous hours, or the
+		// threshold the value is compared with if there is no baseline
+		Baseline float64 `json:"baseline"`
+		ClientIP string  `json:"client_ip,omitempty"`
+		Message  string  `json:"message"`
+	}
+
+	// hourValues are the metrics of one hour in the history of the stream
+	hourValues struct {
+		Hour         time.Time `json:"hour"`
+		Bytes        float64   `json:"bytes"`
+		Requests     float64   `json:"requests"`
+		Uniques      float64   `json:"uniques"`
+		ClientErrors float64   `json:"client_error_rate"`
+		ServerErrors float64   `json:"server_error_rate"`
+	}
+
+	// Detector keeps the baselines of the streams and checks each new hour
+	// against them. Methods of nil *Detector do nothing.
+	Detector struct {
+		mu        sync.Mutex
+		opts      Options
+		history   map[string][]hourValues // by region and stream
+		latest    time.Time
+		enc       *json.Encoder
+		fh        *os.File
+		webhook   string
+		client    *http.Client
+		stateFile string
+		changed   bool // baselines differ from the state file
+		found     int
+	}
+)
+
+// DefaultOptions flag only large, clear changes
+var DefaultOptions = Options{
+	Window:      24,
+	MinHistory:  6,
+	Threshold:   4,
+	MinFactor:   3,
+	MinRequests: 100,
+	ClientShare: 0.5,
+	MinClients:  10,
+	ErrorRate:   0.2,
+}
+
+// New creates detector writing anomalies to the report file ("-" for stdout,
+// none if empty) and posting them to the webhook URL, if set. Baselines are
+// loaded from the state file, if it exists, and saved there on Close if they
+// changed, so they survive restarts.
+func New(report, webhook, stateFile string, opts Options) (*Detector, error) {
+	var w io.Writer = os.Stdout
+	var fh *os.File
+	if report == "" {
+		w = ioutil.Discard
+	} else if report != "-" {
+		var err error
+		if fh, err = os.Create(report); err != nil {
+			return nil, err
+		}
+		w = fh
+	}
+	d := NewWriter(w, opts)
+	d.fh = fh
+	d.webhook = webhook
+	d.stateFile = stateFile
+	if stateFile != "" {
+		if err := d.load(stateFile); err != nil {
+			if fh != nil {
+				fh.Close()
+			}
+			return nil, err
+		}
+	}
+	return d, nil
+}
+
+// NewWriter creates detector writing anomalies to w
+func NewWriter(w io.Writer, opts Options) *Detector {
+	def := DefaultOptions
+	if opts.Window <= 0 {
+		opts.Window = def.Window
+	}
+	if opts.MinHistory <= 0 {
+		opts.MinHistory = def.MinHistory
+	}
+	if opts.MinHistory > opts.Window {
+		opts.MinHistory = opts.Window
+	}
+	if opts.Threshold <= 0 {
+		opts.Threshold = def.Threshold
+	}
+	if opts.MinFactor <= 0 {
+		opts.MinFactor = def.MinFactor
+	}
+	if opts.MinRequests <= 0 {
+		opts.MinRequests = def.MinRequests
+	}
+	if opts.ClientShare <= 0 {
+		opts.ClientShare = def.ClientShare
+	}
+	if opts.MinClients <= 0 {
+		opts.MinClients = def.MinClients
+	}
+	if opts.ErrorRate <= 0 {
+		opts.ErrorRate = def.ErrorRate
+	}
+	return &Detector{
+		opts:    opts,
+		history: make(map[string][]hourValues),
+		enc:     json.NewEncoder(w),
+		client:  &http.Client{Timeout: webhookTimeout},
+	}
+}
+
+// Check compares samples of the hour with the baselines of their streams, then
+// adds them to the baselines. Anomalies are written to the report and posted
+// to the webhook. Samples of hours already seen for the stream are skipped,
+// so replayed hours are not counted twice. Failed webhook calls are logged,
+// only errors writing the report are returned.
+func (d *Detector) Check(samples []Sample) ([]*Anomaly, error) {
+	if d == nil {
+		return nil, nil
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var found []*Anomaly
+	for i := range samples {
+		s := &samples[i]
+		key := s.Region + "/" + s.StreamID + s.PlaybackID
+		hist := d.history[key]
+		if len(hist) > 0 && !hist[len(hist)-1].Hour.Before(s.Hour) {
+			continue
+		}
+		values := s.values()
+		if s.Requests >= d.opts.MinRequests {
+			found = append(found, d.check(s, values, hist)...)
+		}
+		hist = append(hist, values)
+		if len(hist) > d.opts.Window {
+			hist = append([]hourValues(nil), hist[len(hist)-d.opts.Window:]...)
+		}
+		d.history[key] = hist
+		d.changed = true
+		if s.Hour.After(d.latest) {
+			d.latest = s.Hour
+		}
+	}
+	d.prune()
+	sortAnomalies(found)
+	for _, a := range found {
+		metrics.Anomalies.WithLabelValues(a.Kind, a.Metric).Inc()
+		if err := d.enc.Encode(a); err != nil {
+			return found, err
+		}
+	}
+	d.found += len(found)
+	if len(found) > 0 && d.webhook != "" {
+		if err := d.post(found); err != nil {
+			glog.Errorf("Error posting anomalies to webhook err=%v", err)
+		}
+	}
+	return found, nil
+}
+
+// Evaluate finds anomalies in the samples like Check, but changes nothing:
+// baselines are not updated and anomalies are not reported nor posted.
+// It is meant for dry runs.
+func (d *Detector) Evaluate(samples []Sample) []*Anomaly {
+	if d == nil {
+		return nil
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var found []*Anomaly
+	for i := range samples {
+		s := &samples[i]
+		hist := d.history[s.Region+"/"+s.StreamID+s.PlaybackID]
+		if len(hist) > 0 && !hist[len(hist)-1].Hour.Before(s.Hour) {
+			continue
+		}
+		if s.Requests >= d.opts.MinRequests {
+			found = append(found, d.check(s, s.values(), hist)...)
+		}
+	}
+	sortAnomalies(found)
+	return found
+}
+
+func sortAnomalies(found []*Anomaly) {
+	sort.SliceStable(found, func(i, j int) bool {
+		a, b := found[i], found[j]
+		if a.Region != b.Region {
+			return a.Region < b.Region
+		}
+		return a.StreamID+a.PlaybackID < b.StreamID+b.PlaybackID
+	})
+}
+
+func (s *Sample) values() hourValues {
+	v := hourValues{
+		Hour:     s.Hour,
+		Bytes:    float64(s.Bytes),
+		Requests: float64(s.Requests),
+		Uniques:  float64(s.Uniques),
+	}
+	if s.Requests > 0 {
+		v.ClientErrors = float64(s.ClientErrors) / float64(s.Requests)
+		v.ServerErrors = float64(s.ServerErrors) / float64(s.Requests)
+	}
+	return v
+}
+
+func (d *Detector) check(s *Sample, v hourValues, hist []hourValues) []*Anomaly {
+	var res []*Anomaly
+	newAnomaly := func(kind, metric string, value, baseline float64, format string, args ...interface{}) {
+		res = append(res, &Anomaly{
+			Kind:       kind,
+			Metric:     metric,
+			Region:     s.Region,
+			Hour:       s.Hour.UTC(),
+			StreamID:   s.StreamID,
+			PlaybackID: s.PlaybackID,
+			Value:      value,
+			Baseline:   baseline,
+			Message:    fmt.Sprintf(format, args...),
+		})
+	}
+	if len(hist) >= d.opts.MinHistory {
+		for _, m := range []struct {
+			name  string
+			value func(hourValues) float64
+		}{
+			{MetricBytes, func(h hourValues) float64 { return h.Bytes }},
+			{MetricRequests, func(h hourValues) float64 { return h.Requests }},
+			{MetricUniques, func(h hourValues) float64 { return h.Uniques }},
+		} {
+			mean, std := meanStd(hist, m.value)
+			value := m.value(v)
+			if value > mean+d.opts.Threshold*std && value > d.opts.MinFactor*mean {
+				newAnomaly(KindSpike, m.name, value, mean, "%s of the stream is %.1f times the baseline", m.name, ratio(value, mean))
+			}
+		}
+	}
+	for _, m := range []struct {
+		name  string
+		value func(hourValues) float64
+	}{
+		{Metric4xx, func(h hourValues) float64 { return h.ClientErrors }},
+		{Metric5xx, func(h hourValues) float64 { return h.ServerErrors }},
+	} {
+		rate := m.value(v)
+		if rate < d.opts.ErrorRate {
+			continue
+		}
+		baseline := d.opts.ErrorRate
+		if len(hist) > 0 {
+			baseline, _ = meanStd(hist, m.value)
+			if rate <= d.opts.MinFactor*baseline {
+				continue
+			}
+		}
+		newAnomaly(KindErrorSurge, m.name, rate, baseline, "%.0f%% of the requests got %s responses", rate*100, m.name)
+	}
+	if s.Uniques >= d.opts.MinClients && s.Bytes > 0 {
+		share := float64(s.TopClientBytes) / float64(s.Bytes)
+		if share >= d.opts.ClientShare {
+			newAnomaly(KindClientShare, MetricBytes, share, d.opts.ClientShare, "client %s took %.0f%% of the bytes of the stream with %d clients",
+				s.TopClient, share*100, s.Uniques)
+			res[len(res)-1].ClientIP = s.TopClient
+		}
+	}
+	return res
+}
+
+func meanStd(hist []hourValues, value func(hourValues) float64) (float64, float64) {
+	var sum, sumSq float64
+	for _, h := range hist {
+		sum += value(h)
+	}
+	mean := sum / float64(len(hist))
+	for _, h := range hist {
+		sumSq += (value(h) - mean) * (value(h) - mean)
+	}
+	return mean, math.Sqrt(sumSq / float64(len(hist)))
+}
+
+func ratio(value, baseline float64) float64 {
+	if baseline == 0 {
+		return math.Inf(1)
+	}
+	return value / baseline
+}
+
+// prune forgets streams without traffic for the whole window
+func (d *Detector) prune() {
+	cutoff := d.latest.Add(-time.Duration(d.opts.Window) * time.Hour)
+	for key, hist := range d.history {
+		if hist[len(hist)-1].Hour.Before(cutoff) {
+			delete(d.history, key)
+		}
+	}
+}
+
+func (d *Detector) post(found []*Anomaly) error {
+	body, err := json.Marshal(found)
+	if err != nil {
+		return err
+	}
+	resp, err := d.client.Post(d.webhook, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	ioutil.ReadAll(resp.Body)
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook responded with status=%d", resp.StatusCode)
+	}
+	return nil
+}
+
+// state is saved between runs
+type state struct {
+	Latest  time.Time               `json:"latest"`
+	History map[string][]hourValues `json:"history"`
+}
+
+func (d *Detector) load(fileName string) error {
+	data, err := ioutil.ReadFile(fileName)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var st state
+	if err = json.Unmarshal(data, &st); err != nil {
+		return fmt.Errorf("error reading anomaly detector state %s: %w", fileName, err)
+	}
+	if st.History != nil {
+		d.history = st.History
+	}
+	d.latest = st.Latest
+	glog.Infof("Loaded baselines of %d streams from %s", len(d.history), fileName)
+	return nil
+}
+
+func (d *Detector) save(fileName string) error {
+	data, err := json.Marshal(&state{Latest: d.latest, History: d.history})
+	if err != nil {
+		return err
+	}
+	tmp := fileName + ".tmp"
+	if err = ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, fileName)
+}
+
+// Close saves the baselines to the state file, if set, and closes the report
+func (d *Detector) Close() error {
+	if d == nil {
+		return nil
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var err error
+	if d.stateFile != "" && d.changed {
+		err = d.save(d.stateFile)
+	}
+	glog.Infof("Found %d anomalies", d.found)
+	if d.fh != nil {
+		if ferr := d.fh.Close(); err == nil {
+			err = ferr
+		}
+	}
+	return err
+}
@@ -0,0 +1,109 @@
+package anomaly
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDetector(t *testing.T) {
+	assert := assert.New(t)
+	var posted []*Anomaly
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal("application/json", r.Header.Get("Content-Type"))
+		body, _ := ioutil.ReadAll(r.Body)
+		assert.NoError(json.Unmarshal(body, &posted))
+	}))
+	defer ts.Close()
+
+	var buf bytes.Buffer
+	d := NewWriter(&buf, Options{MinHistory: 3})
+	d.webhook = ts.URL
+	start := time.Date(2021, 11, 17, 0, 0, 0, 0, time.UTC)
+	sample := func(hour int, requests int64) Sample {
+		return Sample{
+			Region:         "fra-monster",
+			Hour:           start.Add(time.Duration(hour) * time.Hour),
+			PlaybackID:     "9e70xehvtu637q6p",
+			Bytes:          requests * 1000,
+			Requests:       requests,
+			Uniques:        requests / 10,
+			TopClient:      "104.28.131.0",
+			TopClientBytes: 10000,
+		}
+	}
+	for hour, requests := range []int64{200, 220, 180} {
+		found, err := d.Check([]Sample{sample(hour, requests)})
+		assert.NoError(err)
+		assert.Empty(found)
+	}
+	// replayed hour is not added to the baseline
+	found, err := d.Check([]Sample{sample(2, 5000)})
+	assert.NoError(err)
+	assert.Empty(found)
+
+	spike := sample(3, 2000)
+	spike.TopClientBytes = 1500000
+	spike.ClientErrors = 600
+	// evaluation leaves baselines, report and webhook alone
+	history := len(d.history["fra-monster/9e70xehvtu637q6p"])
+	assert.Len(d.Evaluate([]Sample{spike}), 5)
+	assert.Len(d.history["fra-monster/9e70xehvtu637q6p"], history)
+	assert.Empty(buf.String())
+	assert.Empty(posted)
+
+	found, err = d.Check([]Sample{spike})
+	assert.NoError(err)
+	kinds := make([]string, 0, len(found))
+	for _, a := range found {
+		kinds = append(kinds, a.Kind+" "+a.Metric)
+	}
+	assert.Equal([]string{
+		"spike bytes", "spike requests", "spike unique_client_ips", "error_surge 4xx", "client_share bytes",
+	}, kinds)
+	assert.Equal(float64(200), found[1].Baseline)
+	assert.Equal("104.28.131.0", found[4].ClientIP)
+	assert.InDelta(0.75, found[4].Value, 0.001)
+	assert.Len(posted, 5)
+	assert.Len(strings.Split(strings.TrimSpace(buf.String()), "\n"), 5)
+
+	// streams with few requests are not checked
+	quiet := sample(4, 50)
+	quiet.ServerErrors = 50
+	found, err = d.Check([]Sample{quiet})
+	assert.NoError(err)
+	assert.Empty(found)
+
+	// baselines survive restart
+	stateFile := filepath.Join(t.TempDir(), "state.json")
+	d.stateFile = stateFile
+	assert.NoError(d.Close())
+	restored, err := New(filepath.Join(t.TempDir(), "report.jsonl"), "", stateFile, Options{})
+	if assert.NoError(err) {
+		assert.Equal(d.history, restored.history)
+		assert.Equal(start.Add(4*time.Hour), restored.latest)
+		assert.NoError(restored.Close())
+	}
+
+	// streams without traffic for the whole window are forgotten
+	d = NewWriter(ioutil.Discard, Options{Window: 2})
+	d.Check([]Sample{sample(0, 200)})
+	other := sample(3, 200)
+	other.PlaybackID = "a0b1c2d3e4f5g6h7"
+	d.Check([]Sample{other})
+	assert.Len(d.history, 1)
+
+	var nilDetector *Detector
+	found, err = nilDetector.Check([]Sample{spike})
+	assert.NoError(err)
+	assert.Nil(found)
+	assert.NoError(nilDetector.Close())
+}
@@ -9,11 +9,9 @@ import (
 	"strings"
 	"time"
 
-	"cloud.google.com/go/storage"
 	"github.com/golang/glog"
 	"github.com/livepeer/cdn-log-puller/internal/common"
-	"google.golang.org/api/iterator"
-	"google.golang.org/api/option"
+	"github.com/livepeer/cdn-log-puller/internal/source"
 )
 
 func ValidateDownloadParameters(bucketUrl string, folder string) error {
@@ -21,8 +19,8 @@ func ValidateDownloadParameters(bucketUrl string, folder string) error {
 		return fmt.Errorf("bucket url cannot be null or empty")
 	}
 
-	if strings.HasPrefix(bucketUrl, "gs://") {
-		return fmt.Errorf("bucket url should not include gs:// prefix. Please remove it")
+	if err := source.Validate(bucketUrl); err != nil {
+		return err
 	}
 
 	// check if folder is a valid path
@@ -33,38 +31,26 @@ func ValidateDownloadParameters(bucketUrl string, folder string) error {
 	return nil
 }
 
-// listFiles lists objects within specified bucket.
-func ListAndDownloadFiles(bucket string, folder string, credsFile string) error {
-	// bucket := "bucket-name"
+// ListAndDownloadFiles lists objects within specified source and saves them into the folder.
+func ListAndDownloadFiles(src source.Source, folder string) error {
 	ctx := context.Background()
-	var opts []option.ClientOption
-	if credsFile != "" {
-		opts = append(opts, option.WithCredentialsFile(credsFile))
-	} else {
-		opts = append(opts, option.WithoutAuthentication())
-	}
-	client, err := storage.NewClient(ctx, opts...)
-	if err != nil {
-		return fmt.Errorf("storage.NewClient: %v", err)
-	}
-	defer client.Close()
 
 	// ctx, cancel := context.WithTimeout(ctx, time.Second*600)
 	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
 
-	it := client.Bucket(bucket).Objects(ctx, nil)
+	it := src.List(ctx, nil)
 	var skipped, downloaded int
 	for {
 		if skipped > 0 && skipped%1000 == 0 {
 			glog.V(common.VERBOSE).Infof("So far skipped %d files", skipped)
 		}
 		attrs, err := it.Next()
-		if err == iterator.Done {
+		if err == source.Done {
 			break
 		}
 		if err != nil {
-			return fmt.Errorf("Bucket(%q).Objects: %v", bucket, err)
+			return fmt.Errorf("%s list: %v", src, err)
 		}
 		// skip `cdi` dir
 		np := strings.Split(attrs.Name, "/")
@@ -81,7 +67,7 @@ func ListAndDownloadFiles(bucket string, folder string, credsFile string) error
 		}
 
 		glog.V(common.DEBUG).Info("Download file: ", attrs.Name)
-		if err = downloadAndSaveFile(client, attrs, folder); err != nil {
+		if err = downloadAndSaveFile(src, attrs, folder); err != nil {
 			glog.Errorf("Error downloading file name=%s err=%v", attrs.Name, err)
 			return err
 		}
@@ -107,7 +93,7 @@ func makeDir(dirName string) error {
 	return nil
 }
 
-func downloadAndSaveFile(client *storage.Client, attrs *storage.ObjectAttrs, folder string) error {
+func downloadAndSaveFile(src source.Source, attrs *source.ObjectAttrs, folder string) error {
 	fileName := filepath.FromSlash(folder + "/" + attrs.Name)
 	dirName := filepath.Dir(fileName)
 	if err := makeDir(dirName); err != nil {
@@ -120,7 +106,7 @@ func downloadAndSaveFile(client *storage.Client, attrs *storage.ObjectAttrs, fol
 		}
 	}
 
-	data, err := downloadFile(client, attrs.Bucket, attrs.Name)
+	data, err := downloadFile(src, attrs.Name)
 	if err != nil {
 		return err
 	}
@@ -134,15 +120,15 @@ func downloadAndSaveFile(client *storage.Client, attrs *storage.ObjectAttrs, fol
 }
 
 // downloadFile downloads an object.
-func downloadFile(client *storage.Client, bucket string, object string) ([]byte, error) {
+func downloadFile(src source.Source, object string) ([]byte, error) {
 	ctx := context.Background()
 
 	ctx, cancel := context.WithTimeout(ctx, time.Second*600)
 	defer cancel()
 
-	rc, err := client.Bucket(bucket).Object(object).NewReader(ctx)
+	rc, err := src.Open(ctx, object)
 	if err != nil {
-		return nil, fmt.Errorf("Object(%q).NewReader: %v", object, err)
+		return nil, err
 	}
 	defer rc.Close()
 
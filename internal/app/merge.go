@@ -0,0 +1,336 @@
+package app
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/livepeer/cdn-log-puller/internal/etl"
+	"github.com/livepeer/cdn-log-puller/internal/rollup"
+	"github.com/livepeer/cdn-log-puller/internal/sketch"
+)
+
+var errNoSketch = errors.New("record has no users sketch, produce input with -sketches")
+
+type (
+	mergeKey struct {
+		period     string
+		region     string
+		streamID   string
+		playbackID string
+	}
+
+	mergeRow struct {
+		users    *sketch.Uniques
+		views    int64
+		csBytes  int64
+		scBytes  int64
+		fileSize int64
+	}
+
+	// merger combines rows of the same stream and period
+	merger struct {
+		period      string
+		granularity string
+		byRegion    bool
+		rows        map[mergeKey]*mergeRow
+	}
+)
+
+// input dates can be hours (etl), days (analyze), buckets of other
+// granularities or periods of the previous merge
+var mergeDateLayouts = []string{"2006-01-02T15:04", "2006-01-02T15", "2006-01-02", "2006-01"}
+
+// Merge combines records with users sketches into rollups over period (hour, day,
+// month or all). Inputs are JSON lines files written by etl file sink (.json, .jsonl)
+// and CSV files written by analyze or merge (.csv). Regions are combined unless
+// byRegion is set. Output is CSV with the sketch of each row, so it can be merged again.
+// Only rows tagged with granularity (or not tagged at all) are read, so the same
+// data computed for several granularities is not counted more than once.
+func Merge(inputs []string, output, period, granularity string, byRegion bool) error {
+	switch period {
+	case "hour", "day", "month", "all":
+	default:
+		return fmt.Errorf("invalid period %q, valid periods are hour, day, month and all", period)
+	}
+	g, err := rollup.Parse(granularity)
+	if err != nil {
+		return err
+	}
+	m := &merger{period: period, granularity: g.String(), byRegion: byRegion, rows: make(map[mergeKey]*mergeRow)}
+	for _, input := range inputs {
+		var err error
+		switch filepath.Ext(input) {
+		case ".json", ".jsonl":
+			err = m.readJSONFile(input)
+		case ".csv":
+			err = m.readCSVFile(input)
+		default:
+			err = errors.New("unknown file type, expected .jsonl or .csv")
+		}
+		if err != nil {
+			return fmt.Errorf("error reading %s: %w", input, err)
+		}
+	}
+	glog.Infof("Merged %d files into %d rows", len(inputs), len(m.rows))
+
+	var w io.Writer = os.Stdout
+	if output != "" && output != "-" {
+		fh, err := os.Create(output)
+		if err != nil {
+			return err
+		}
+		defer fh.Close()
+		w = fh
+	}
+	return m.write(w)
+}
+
+func (m *merger) periodOf(tm time.Time) string {
+	switch m.period {
+	case "hour":
+		return tm.UTC().Format("2006-01-02T15")
+	case "day":
+		return tm.UTC().Format("2006-01-02")
+	case "month":
+		return tm.UTC().Format("2006-01")
+	}
+	return "all"
+}
+
+// finerThan reports if input date is precise enough for the rollup period
+func (m *merger) finerThan(date string) bool {
+	if date == "all" {
+		return m.period == "all"
+	}
+	switch m.period {
+	case "hour":
+		return len(date) >= len("2006-01-02T15")
+	case "day":
+		return len(date) >= len("2006-01-02")
+	}
+	return true
+}
+
+func (m *merger) skipped(granularity string) bool {
+	return granularity != "" && granularity != m.granularity
+}
+
+func (m *merger) add(tm time.Time, region, streamID, playbackID string, row *mergeRow) error {
+	key := mergeKey{period: m.periodOf(tm), streamID: streamID, playbackID: playbackID}
+	if m.byRegion {
+		key.region = region
+	}
+	existing, ok := m.rows[key]
+	if !ok {
+		m.rows[key] = row
+		return nil
+	}
+	existing.views += row.views
+	existing.csBytes += row.csBytes
+	existing.scBytes += row.scBytes
+	existing.fileSize += row.fileSize
+	return existing.users.Merge(row.users)
+}
+
+// readJSONFile reads etl output. Records marked with `replace` flag supersede
+// previous records of the same batch or, without batch ID, of the same region and hour.
+// Repeated batches are counted once.
+func (m *merger) readJSONFile(fileName string) error {
+	fh, err := os.Open(fileName)
+	if err != nil {
+		return err
+	}
+	defer fh.Close()
+	type regionHour struct {
+		region string
+		date   int64
+	}
+	var records []*etl.SendData
+	byBatch := make(map[string]int)
+	dec := json.NewDecoder(bufio.NewReader(fh))
+	for {
+		sd := &etl.SendData{}
+		if err = dec.Decode(sd); err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+		if sd.Replace && sd.BatchID == "" {
+			for i, prev := range records {
+				if prev != nil && (regionHour{prev.Region, prev.Date}) == (regionHour{sd.Region, sd.Date}) {
+					records[i] = nil
+				}
+			}
+		}
+		if sd.BatchID != "" {
+			if i, ok := byBatch[sd.BatchID]; ok {
+				records[i] = nil
+			}
+			byBatch[sd.BatchID] = len(records)
+		}
+		records = append(records, sd)
+	}
+	for _, sd := range records {
+		if sd == nil || m.skipped(sd.Granularity) {
+			continue
+		}
+		for _, vs := range sd.Data {
+			if vs.UsersSketch == "" {
+				return errNoSketch
+			}
+			users, err := sketch.Decode(vs.UsersSketch)
+			if err != nil {
+				return err
+			}
+			row := &mergeRow{
+				users:    users,
+				views:    int64(vs.Count),
+				csBytes:  vs.TotalCsBytes,
+				scBytes:  vs.TotalScBytes,
+				fileSize: vs.TotalFilesize,
+			}
+			if err = m.add(time.Unix(sd.Date, 0), sd.Region, vs.StreamID, vs.PlaybackID, row); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// readCSVFile reads output of analyze (date and manifest_id columns)
+// or of previous merge (period, region and playback_id columns)
+func (m *merger) readCSVFile(fileName string) error {
+	fh, err := os.Open(fileName)
+	if err != nil {
+		return err
+	}
+	defer fh.Close()
+	r := csv.NewReader(bufio.NewReader(fh))
+	header, err := r.Read()
+	if err != nil {
+		return err
+	}
+	cols := make(map[string]int)
+	for i, name := range header {
+		cols[name] = i
+	}
+	if _, ok := cols["users_sketch"]; !ok {
+		return errNoSketch
+	}
+	for {
+		rec, err := r.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		get := func(names ...string) string {
+			for _, name := range names {
+				if i, ok := cols[name]; ok {
+					return rec[i]
+				}
+			}
+			return ""
+		}
+		getInt := func(name string) (int64, error) {
+			return strconv.ParseInt(get(name), 10, 64)
+		}
+		if m.skipped(get("granularity")) {
+			continue
+		}
+		date := get("date", "period")
+		tm, err := parseMergeDate(date)
+		if err != nil {
+			return err
+		}
+		if !m.finerThan(date) {
+			return fmt.Errorf("can't make %s rollup of data for %q", m.period, date)
+		}
+		users, err := sketch.Decode(get("users_sketch"))
+		if err != nil {
+			return err
+		}
+		row := &mergeRow{users: users}
+		if row.views, err = getInt("total_views"); err != nil {
+			return err
+		}
+		if row.csBytes, err = getInt("total_cs_bytes"); err != nil {
+			return err
+		}
+		if row.scBytes, err = getInt("total_sc_bytes"); err != nil {
+			return err
+		}
+		if row.fileSize, err = getInt("total_file_size"); err != nil {
+			return err
+		}
+		if err = m.add(tm, get("region"), get("stream_id"), get("manifest_id", "playback_id"), row); err != nil {
+			return err
+		}
+	}
+}
+
+func parseMergeDate(date string) (time.Time, error) {
+	if date == "all" {
+		return time.Time{}, nil
+	}
+	var err error
+	for _, layout := range mergeDateLayouts {
+		var tm time.Time
+		if tm, err = time.Parse(layout, date); err == nil {
+			return tm, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid date %q: %w", date, err)
+}
+
+func getMergeHeader() string {
+	return "period,region,stream_id,playback_id,unique_users,total_views,total_cs_bytes,total_sc_bytes,total_file_size,users_sketch"
+}
+
+func (m *merger) write(w io.Writer) error {
+	keys := make([]mergeKey, 0, len(m.rows))
+	for key := range m.rows {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		a, b := keys[i], keys[j]
+		if a.period != b.period {
+			return a.period < b.period
+		}
+		if a.region != b.region {
+			return a.region < b.region
+		}
+		if a.streamID != b.streamID {
+			return a.streamID < b.streamID
+		}
+		return a.playbackID < b.playbackID
+	})
+	bw := bufio.NewWriter(w)
+	if _, err := bw.WriteString(getMergeHeader() + "\n"); err != nil {
+		return err
+	}
+	for _, key := range keys {
+		row := m.rows[key]
+		encoded, err := row.users.Encode()
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(bw, "%s,%s,%s,%s,%d,%d,%d,%d,%d,%s\n", key.period, key.region, key.streamID, key.playbackID,
+			row.users.Count(), row.views, row.csBytes, row.scBytes, row.fileSize, encoded)
+		if err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
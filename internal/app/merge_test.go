@@ -0,0 +1,86 @@
+package app
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/livepeer/cdn-log-puller/internal/etl"
+	"github.com/livepeer/cdn-log-puller/internal/sketch"
+	"github.com/stretchr/testify/assert"
+)
+
+func encodedUsers(t *testing.T, ips ...string) string {
+	u := sketch.New()
+	for _, ip := range ips {
+		u.Add(ip)
+	}
+	encoded, err := u.Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return encoded
+}
+
+func TestMerge(t *testing.T) {
+	assert := assert.New(t)
+	dir := t.TempDir()
+	records := []*etl.SendData{{
+		Date: 1637164800, Region: "fra", BatchID: "b1",
+		Data: []*etl.VideoStatsExt{{PlaybackID: "p1", UniqueUsers: 2, Count: 3, TotalScBytes: 100, UsersSketch: encodedUsers(t, "1.1.1.1", "2.2.2.2")}},
+	}, {
+		// same batch sent again is counted once
+		Date: 1637164800, Region: "fra", BatchID: "b1", Replace: true,
+		Data: []*etl.VideoStatsExt{{PlaybackID: "p1", UniqueUsers: 2, Count: 3, TotalScBytes: 100, UsersSketch: encodedUsers(t, "1.1.1.1", "2.2.2.2")}},
+	}, {
+		Date: 1637179200, Region: "mdw", BatchID: "b2",
+		Data: []*etl.VideoStatsExt{{PlaybackID: "p1", UniqueUsers: 2, Count: 2, TotalScBytes: 50, UsersSketch: encodedUsers(t, "2.2.2.2", "3.3.3.3")}},
+	}, {
+		// daily rollup of the same data is skipped
+		Date: 1637107200, Region: "fra", BatchID: "b3", Granularity: "1d",
+		Data: []*etl.VideoStatsExt{{PlaybackID: "p1", UniqueUsers: 3, Count: 5, TotalScBytes: 150, UsersSketch: encodedUsers(t, "1.1.1.1", "2.2.2.2", "3.3.3.3")}},
+	}}
+	var lines []string
+	for _, sd := range records {
+		data, _ := json.Marshal(sd)
+		lines = append(lines, string(data))
+	}
+	jsonFile := filepath.Join(dir, "hourly.jsonl")
+	assert.NoError(ioutil.WriteFile(jsonFile, []byte(strings.Join(lines, "\n")), 0644))
+	csvFile := filepath.Join(dir, "analyze.csv")
+	csvData := getCsvHeader() + ",users_sketch\n" +
+		getCsvLine("2021-11-17", "", "p1", "", 1, 1, 0, 10, 0, "200") + "," + encodedUsers(t, "4.4.4.4") + "\n"
+	assert.NoError(ioutil.WriteFile(csvFile, []byte(csvData), 0644))
+
+	out := filepath.Join(dir, "daily.csv")
+	assert.NoError(Merge([]string{jsonFile, csvFile}, out, "day", "1h", false))
+	data, err := ioutil.ReadFile(out)
+	if !assert.NoError(err) {
+		return
+	}
+	res := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if assert.Len(res, 2) {
+		assert.Equal(getMergeHeader(), res[0])
+		assert.True(strings.HasPrefix(res[1], "2021-11-17,,,p1,4,6,0,160,0,"), res[1])
+	}
+
+	// merge output can be merged again
+	monthly := filepath.Join(dir, "monthly.csv")
+	assert.NoError(Merge([]string{out}, monthly, "month", "1h", false))
+	data, _ = ioutil.ReadFile(monthly)
+	assert.Contains(string(data), "\n2021-11,,,p1,4,6,0,160,0,")
+	assert.Error(Merge([]string{monthly}, out, "day", "1h", false))
+
+	assert.NoError(Merge([]string{jsonFile}, out, "all", "1h", true))
+	data, _ = ioutil.ReadFile(out)
+	assert.Contains(string(data), "\nall,fra,,p1,2,3,0,100,0,")
+	assert.Contains(string(data), "\nall,mdw,,p1,2,2,0,50,0,")
+
+	assert.Error(Merge([]string{jsonFile}, out, "day", "7m", false))
+
+	noSketch := filepath.Join(dir, "old.csv")
+	assert.NoError(ioutil.WriteFile(noSketch, []byte(getCsvHeader()+"\n"), 0644))
+	assert.Error(Merge([]string{noSketch}, out, "day", "1h", false))
+}
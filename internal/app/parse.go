@@ -3,36 +3,139 @@ package app
 import (
 	"bufio"
 	"compress/gzip"
+	"context"
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/golang/glog"
 	"github.com/livepeer/cdn-log-puller/internal/common"
+	"github.com/livepeer/cdn-log-puller/internal/geo"
+	"github.com/livepeer/cdn-log-puller/internal/metrics"
+	"github.com/livepeer/cdn-log-puller/internal/quarantine"
+	"github.com/livepeer/cdn-log-puller/internal/rollup"
+	"github.com/livepeer/cdn-log-puller/internal/session"
+	"github.com/livepeer/cdn-log-puller/internal/sketch"
+	"github.com/livepeer/cdn-log-puller/internal/source"
+	"github.com/livepeer/cdn-log-puller/internal/useragent"
 	"github.com/livepeer/cdn-log-puller/internal/utils"
 	// "github.com/pkg/profile"
 )
 
 type VideoStats struct {
-	IPs           []string
+	Users         *sketch.Uniques // client IPs
 	TotalFilesize int64
 	TotalCsBytes  int64
 	TotalScyBytes int64
 	Count         int
+	WatchTime     int64 // ms
+	// segments already counted in WatchTime by client IP
+	watched map[string]struct{}
+	latency *sketch.Quantiles // time taken in ms, only if enabled
+	cache   cacheStats        // only if enabled
+}
+
+// cacheStats count requests by cache status, lines without it are not counted
+type cacheStats struct {
+	hits   int
+	misses int
+	// originBytes is the size of the files fetched from the origin on misses
+	originBytes int64
 }
 
 type VideoStat struct {
-	date     string
-	streamId string
-	itemType string
-	IP       string
-	Filesize int64
-	CsBytes  int64
-	ScyBytes int64
-	httpCode string
+	tm        time.Time
+	streamId  string
+	itemType  string
+	rendition string
+	kind      utils.SegmentKind
+	watchTime int64 // segment duration in ms, if it counts as watched
+	segment   string
+	IP        string
+	userAgent string
+	sessionID string
+	edge      string
+	timeTaken float64 // ms, negative if not logged
+	cache     utils.CacheStatus
+	location  geo.Location
+	agent     useragent.Info
+	referer   string // host only
+	excluded  bool   // adds only to the bytes, not to users, views and watch time
+	Filesize  int64
+	CsBytes   int64
+	ScyBytes  int64
+	httpCode  string
+	fileEnd   bool // marks the end of the file, nothing else is set
+}
+
+// ParseOptions are optional parameters of ParseSource
+type ParseOptions struct {
+	// Quarantine, if set, records rejected lines
+	Quarantine *quarantine.Quarantine
+	// Sketches adds users_sketch column with sketch of client IPs to the output
+	Sketches bool
+	// Granularities are the sizes of the buckets data is aggregated into, all of
+	// them are computed in one pass. If empty, data is aggregated by day and
+	// rows are not tagged, otherwise granularity column is added to the output.
+	Granularities []rollup.Granularity
+	// Renditions splits rows by rendition, adding rendition column to the output
+	Renditions bool
+	// RequestClasses splits rows by the kind of requested file (manifest,
+	// segment, init, vod), adding request_class column to the output
+	RequestClasses bool
+	// WatchTime adds watch_time_ms column, sum of durations of media segments served with 2xx
+	WatchTime bool
+	// WatchTimePerIP counts each segment in watch time once per client IP
+	WatchTimePerIP bool
+	// Edges splits rows by edge server, adding edge column to the output
+	Edges bool
+	// Latency adds latency_p50_ms, latency_p90_ms and latency_p99_ms columns,
+	// quantiles of time taken to serve the requests
+	Latency bool
+	// Cache adds cache_hits, cache_misses, origin_bytes and cache_hit_ratio columns
+	Cache bool
+	// Sessions, if set, gets every request to group them into playback sessions
+	Sessions *session.Sessionizer
+	// Geo, if set, splits rows by location of the clients, adding a column for
+	// each of GeoFields (country if empty): country, city, asn and as_org
+	Geo       geo.Locator
+	GeoFields []string
+	// UserAgents splits rows by class of the user agent, adding device, os,
+	// player and bot columns to the output
+	UserAgents bool
+	// ExcludeBots keeps requests of bots out of unique users, views and watch time
+	ExcludeBots bool
+	// Referers, if set, is the CSV file ("-" for console) to write TopReferers
+	// (DefaultTopReferers if 0) referer hosts with most views of each stream to
+	Referers    string
+	TopReferers int
+}
+
+// sqlColumn is optional column of the output
+type sqlColumn struct {
+	name    string
+	sqlType string
+}
+
+// bucketKey is the date (start of the bucket) formatted for the granularity
+type bucketKey struct {
+	granularity rollup.Granularity
+	date        string
+}
+
+// statKey identifies the row of the stream, optional dimensions are empty if not enabled
+type statKey struct {
+	httpCode  string
+	rendition string
+	class     utils.SegmentKind
+	edge      string
+	location  geo.Location
+	agent     useragent.Info
 }
 
 // const (
@@ -41,9 +144,11 @@ type VideoStat struct {
 // )
 
 func ValidateParseParameters(folder string, output string, format string) error {
-	// check if folder is a valid path
-	if _, err := os.Stat(folder); err != nil {
-		return fmt.Errorf("%s is an invalid path. Error: %+v", folder, err)
+	// check if folder is a valid path (empty folder means logs are read from the bucket)
+	if folder != "" {
+		if _, err := os.Stat(folder); err != nil {
+			return fmt.Errorf("%s is an invalid path. Error: %+v", folder, err)
+		}
 	}
 
 	// check if output path is valid
@@ -59,74 +164,154 @@ func ValidateParseParameters(folder string, output string, format string) error
 	return nil
 }
 
-func ParseFiles(folder string, output string, format string) error {
+// ParseFiles analyzes logs located in the local folder
+func ParseFiles(folder string, output string, format string, opts ParseOptions) error {
+	src, err := source.NewLocal(folder)
+	if err != nil {
+		return err
+	}
+	return ParseSource(src, output, format, opts)
+}
+
+// ParseSource analyzes all the logs files found in the source
+func ParseSource(src source.Source, output string, format string, opts ParseOptions) error {
 	// defer profile.Start(profile.MemProfile).Stop()
 
-	arrDetails := make(map[string]map[string]map[string]map[string]*VideoStats)
+	arrDetails := make(map[bucketKey]map[string]map[string]map[statKey]*VideoStats)
+	referers := make(refererReport)
+	if opts.Geo != nil && len(opts.GeoFields) == 0 {
+		opts.GeoFields = []string{geo.FieldCountry}
+	}
+	granularities := opts.Granularities
+	tagged := len(granularities) > 0
+	if !tagged {
+		granularities = []rollup.Granularity{rollup.Daily}
+	}
 	// get file list
 	var wg sync.WaitGroup
 	var mu sync.Mutex
+	var sessionsErr error
 	c := make(chan VideoStat)
 
 	go func() {
 		mu.Lock()
+		var latest time.Time
 		for chainVideoStat := range c {
-			var tempVideoStat VideoStats
-			if arrDetails[chainVideoStat.date] == nil {
-				arrDetails[chainVideoStat.date] = make(map[string]map[string]map[string]*VideoStats)
+			if chainVideoStat.fileEnd {
+				// write sessions ended as of the latest request seen, so they are not all kept till the end
+				if err := opts.Sessions.Flush(latest); err != nil && sessionsErr == nil {
+					sessionsErr = err
+				}
+				continue
+			}
+			if chainVideoStat.tm.After(latest) {
+				latest = chainVideoStat.tm
 			}
-			if arrDetails[chainVideoStat.date][chainVideoStat.itemType] == nil {
-				arrDetails[chainVideoStat.date][chainVideoStat.itemType] = make(map[string]map[string]*VideoStats)
+			opts.Sessions.Add(chainVideoStat.sessionRequest())
+			if opts.Geo != nil {
+				chainVideoStat.location = opts.Geo.Locate(chainVideoStat.IP).Only(opts.GeoFields)
 			}
-			if arrDetails[chainVideoStat.date][chainVideoStat.itemType][chainVideoStat.streamId] == nil {
-				arrDetails[chainVideoStat.date][chainVideoStat.itemType][chainVideoStat.streamId] = make(map[string]*VideoStats)
+			if opts.UserAgents || opts.ExcludeBots {
+				chainVideoStat.agent = useragent.Classify(chainVideoStat.userAgent)
+				chainVideoStat.excluded = opts.ExcludeBots && chainVideoStat.agent.Bot
 			}
+			if opts.Referers != "" {
+				referers.add(&chainVideoStat)
+			}
+			views := 1
+			if chainVideoStat.excluded {
+				views = 0
+			}
+			for _, g := range granularities {
+				date := bucketKey{granularity: g, date: g.Format(chainVideoStat.tm)}
+				key := statKey{httpCode: chainVideoStat.httpCode}
+				if opts.Renditions {
+					key.rendition = chainVideoStat.rendition
+				}
+				if opts.RequestClasses {
+					key.class = chainVideoStat.kind
+				}
+				if opts.Edges {
+					key.edge = chainVideoStat.edge
+				}
+				key.location = chainVideoStat.location
+				if opts.UserAgents {
+					key.agent = chainVideoStat.agent
+				}
+				var tempVideoStat VideoStats
+				if arrDetails[date] == nil {
+					arrDetails[date] = make(map[string]map[string]map[statKey]*VideoStats)
+				}
+				if arrDetails[date][chainVideoStat.itemType] == nil {
+					arrDetails[date][chainVideoStat.itemType] = make(map[string]map[statKey]*VideoStats)
+				}
+				if arrDetails[date][chainVideoStat.itemType][chainVideoStat.streamId] == nil {
+					arrDetails[date][chainVideoStat.itemType][chainVideoStat.streamId] = make(map[statKey]*VideoStats)
+				}
 
-			if arrDetails[chainVideoStat.date][chainVideoStat.itemType][chainVideoStat.streamId][chainVideoStat.httpCode] != nil {
-				if !utils.Includes(arrDetails[chainVideoStat.date][chainVideoStat.itemType][chainVideoStat.streamId][chainVideoStat.httpCode].IPs, chainVideoStat.IP) {
-					tempVideoStat.IPs = append(arrDetails[chainVideoStat.date][chainVideoStat.itemType][chainVideoStat.streamId][chainVideoStat.httpCode].IPs, chainVideoStat.IP)
+				if arrDetails[date][chainVideoStat.itemType][chainVideoStat.streamId][key] != nil {
+					tempVideoStat.Users = arrDetails[date][chainVideoStat.itemType][chainVideoStat.streamId][key].Users
+					tempVideoStat.Count = arrDetails[date][chainVideoStat.itemType][chainVideoStat.streamId][key].Count + views
+					tempVideoStat.TotalFilesize = arrDetails[date][chainVideoStat.itemType][chainVideoStat.streamId][key].TotalFilesize + chainVideoStat.Filesize
+					tempVideoStat.TotalCsBytes = arrDetails[date][chainVideoStat.itemType][chainVideoStat.streamId][key].TotalCsBytes + chainVideoStat.CsBytes
+					tempVideoStat.TotalScyBytes = arrDetails[date][chainVideoStat.itemType][chainVideoStat.streamId][key].TotalScyBytes + chainVideoStat.ScyBytes
+					tempVideoStat.WatchTime = arrDetails[date][chainVideoStat.itemType][chainVideoStat.streamId][key].WatchTime
+					tempVideoStat.watched = arrDetails[date][chainVideoStat.itemType][chainVideoStat.streamId][key].watched
+					tempVideoStat.latency = arrDetails[date][chainVideoStat.itemType][chainVideoStat.streamId][key].latency
+					tempVideoStat.cache = arrDetails[date][chainVideoStat.itemType][chainVideoStat.streamId][key].cache
 				} else {
-					tempVideoStat.IPs = arrDetails[chainVideoStat.date][chainVideoStat.itemType][chainVideoStat.streamId][chainVideoStat.httpCode].IPs
+					tempVideoStat.Users = sketch.New()
+					tempVideoStat.TotalFilesize = chainVideoStat.Filesize
+					tempVideoStat.TotalCsBytes = chainVideoStat.CsBytes
+					tempVideoStat.TotalScyBytes = chainVideoStat.ScyBytes
+					tempVideoStat.Count = views
+				}
+				if !chainVideoStat.excluded {
+					tempVideoStat.Users.Add(chainVideoStat.IP)
+				}
+				tempVideoStat.addWatchTime(&chainVideoStat, opts.WatchTimePerIP)
+				if opts.Latency {
+					if tempVideoStat.latency == nil {
+						tempVideoStat.latency = sketch.NewQuantiles()
+					}
+					tempVideoStat.latency.Add(chainVideoStat.timeTaken)
 				}
-				tempVideoStat.Count = arrDetails[chainVideoStat.date][chainVideoStat.itemType][chainVideoStat.streamId][chainVideoStat.httpCode].Count + 1
-				tempVideoStat.TotalFilesize = arrDetails[chainVideoStat.date][chainVideoStat.itemType][chainVideoStat.streamId][chainVideoStat.httpCode].TotalFilesize + chainVideoStat.Filesize
-				tempVideoStat.TotalCsBytes = arrDetails[chainVideoStat.date][chainVideoStat.itemType][chainVideoStat.streamId][chainVideoStat.httpCode].TotalCsBytes + chainVideoStat.CsBytes
-				tempVideoStat.TotalScyBytes = arrDetails[chainVideoStat.date][chainVideoStat.itemType][chainVideoStat.streamId][chainVideoStat.httpCode].TotalScyBytes + chainVideoStat.ScyBytes
-			} else {
-				tempVideoStat.IPs = []string{chainVideoStat.IP}
-				tempVideoStat.TotalFilesize = chainVideoStat.Filesize
-				tempVideoStat.TotalCsBytes = chainVideoStat.CsBytes
-				tempVideoStat.TotalScyBytes = chainVideoStat.ScyBytes
-				tempVideoStat.Count = 1
+				if opts.Cache {
+					tempVideoStat.cache.add(&chainVideoStat)
+				}
+				arrDetails[date][chainVideoStat.itemType][chainVideoStat.streamId][key] = &tempVideoStat
 			}
-			arrDetails[chainVideoStat.date][chainVideoStat.itemType][chainVideoStat.streamId][chainVideoStat.httpCode] = &tempVideoStat
 		}
 		mu.Unlock()
 	}()
 
-	err := filepath.Walk(folder,
-		func(path string, info os.FileInfo, err error) error {
-			if err != nil {
-				return err
-			}
-			if isValidFile(path) {
-				wg.Add(1)
-				go func() {
-					glog.V(common.VERBOSE).Info("Parse file: ", path)
-					err = parseFile(path, c)
-					glog.V(common.VERBOSE).Info("End parse file: ", path)
-					wg.Done()
-				}()
-				wg.Wait()
+	it := src.List(context.Background(), nil)
+	for {
+		attrs, err := it.Next()
+		if err == source.Done {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		path := attrs.Name
+		if isValidFile(path) {
+			wg.Add(1)
+			go func() {
+				glog.V(common.VERBOSE).Info("Parse file: ", path)
+				err = parseFile(src, path, c, opts.Quarantine)
+				glog.V(common.VERBOSE).Info("End parse file: ", path)
+				wg.Done()
+			}()
+			wg.Wait()
+			if err == nil && opts.Sessions != nil {
+				c <- VideoStat{fileEnd: true}
 			}
+		}
 
-			if err != nil {
-				return err
-			}
-			return nil
-		})
-	if err != nil {
-		return err
+		if err != nil {
+			return err
+		}
 	}
 	glog.Info("Wait for goroutine to finish")
 
@@ -144,12 +329,57 @@ func ParseFiles(folder string, output string, format string) error {
 
 	datawriter := bufio.NewWriter(file)
 
+	// optional columns, in the order they are added to each row
+	var extraColumns []sqlColumn
+	if tagged {
+		extraColumns = append(extraColumns, sqlColumn{"granularity", "text"})
+	}
+	if opts.Renditions {
+		extraColumns = append(extraColumns, sqlColumn{"rendition", "text"})
+	}
+	if opts.RequestClasses {
+		extraColumns = append(extraColumns, sqlColumn{"request_class", "text"})
+	}
+	if opts.Edges {
+		extraColumns = append(extraColumns, sqlColumn{"edge", "text"})
+	}
+	geoColumns := geoColumns(opts)
+	extraColumns = append(extraColumns, geoColumns...)
+	if opts.UserAgents {
+		for _, name := range []string{"device", "os", "player"} {
+			extraColumns = append(extraColumns, sqlColumn{name, "text"})
+		}
+		extraColumns = append(extraColumns, sqlColumn{"bot", "boolean"})
+	}
+	if opts.WatchTime {
+		extraColumns = append(extraColumns, sqlColumn{"watch_time_ms", "bigint"})
+	}
+	if opts.Latency {
+		for _, name := range []string{"latency_p50_ms", "latency_p90_ms", "latency_p99_ms"} {
+			extraColumns = append(extraColumns, sqlColumn{name, "double precision"})
+		}
+	}
+	if opts.Cache {
+		for _, name := range []string{"cache_hits", "cache_misses", "origin_bytes"} {
+			extraColumns = append(extraColumns, sqlColumn{name, "bigint"})
+		}
+		extraColumns = append(extraColumns, sqlColumn{"cache_hit_ratio", "double precision"})
+	}
+	if opts.Sketches {
+		extraColumns = append(extraColumns, sqlColumn{"users_sketch", "text"})
+	}
 	bufString := ""
 	switch format {
 	case "csv":
 		bufString = getCsvHeader()
+		for _, column := range extraColumns {
+			bufString += "," + column.name
+		}
 	case "sql":
 		bufString = getSqlHeader()
+		for _, column := range extraColumns {
+			bufString += "\n" + getSqlAddColumn(column.name, column.sqlType)
+		}
 	default:
 		return fmt.Errorf("invalid output format %s, valid format are csv and sql", format)
 	}
@@ -160,36 +390,93 @@ func ParseFiles(folder string, output string, format string) error {
 	}
 
 	mu.Lock()
-	for date, val := range arrDetails {
+	for key, val := range arrDetails {
+		date := key.date
 		for itemType, val1 := range val {
 			for stream, val2 := range val1 {
-				for httpCode, details := range val2 {
+				for sk, details := range val2 {
+					httpCode := sk.httpCode
+					// values of extraColumns, the ones making rows distinct are part of the SQL ID
+					var extra, idParts []string
+					if tagged {
+						extra = append(extra, key.granularity.String())
+						idParts = append(idParts, key.granularity.String())
+					}
+					if opts.Renditions {
+						extra = append(extra, sk.rendition)
+						idParts = append(idParts, sk.rendition)
+					}
+					if opts.RequestClasses {
+						extra = append(extra, string(sk.class))
+						idParts = append(idParts, string(sk.class))
+					}
+					if opts.Edges {
+						extra = append(extra, sk.edge)
+						idParts = append(idParts, sk.edge)
+					}
+					for _, column := range geoColumns {
+						value := geoValue(sk.location, column.name)
+						extra = append(extra, value)
+						idParts = append(idParts, value)
+					}
+					if opts.UserAgents {
+						agent := []string{sk.agent.Device, sk.agent.OS, sk.agent.Player, strconv.FormatBool(sk.agent.Bot)}
+						extra = append(extra, agent...)
+						idParts = append(idParts, agent...)
+					}
+					if opts.WatchTime {
+						extra = append(extra, strconv.FormatInt(details.WatchTime, 10))
+					}
+					if opts.Latency {
+						for _, p := range []float64{0.5, 0.9, 0.99} {
+							extra = append(extra, strconv.FormatFloat(details.latency.Quantile(p), 'f', 1, 64))
+						}
+					}
+					if opts.Cache {
+						c := details.cache
+						extra = append(extra, strconv.Itoa(c.hits), strconv.Itoa(c.misses),
+							strconv.FormatInt(c.originBytes, 10), strconv.FormatFloat(c.hitRatio(), 'f', 4, 64))
+					}
+					if opts.Sketches {
+						encoded, err := details.Users.Encode()
+						if err != nil {
+							return err
+						}
+						extra = append(extra, encoded)
+					}
 					bufString := ""
 					switch format {
 					case "csv":
 						switch itemType {
 						case "manifest_id":
-							bufString = getCsvLine(date, "", stream, "", len(details.IPs), details.Count, details.TotalCsBytes, details.TotalScyBytes, details.TotalFilesize, httpCode)
+							bufString = getCsvLine(date, "", stream, "", details.Users.Count(), details.Count, details.TotalCsBytes, details.TotalScyBytes, details.TotalFilesize, httpCode)
 						case "stream_id":
-							bufString = getCsvLine(date, stream, "", "", len(details.IPs), details.Count, details.TotalCsBytes, details.TotalScyBytes, details.TotalFilesize, httpCode)
+							bufString = getCsvLine(date, stream, "", "", details.Users.Count(), details.Count, details.TotalCsBytes, details.TotalScyBytes, details.TotalFilesize, httpCode)
 						case "stream_name":
-							bufString = getCsvLine(date, "", "", stream, len(details.IPs), details.Count, details.TotalCsBytes, details.TotalScyBytes, details.TotalFilesize, httpCode)
+							bufString = getCsvLine(date, "", "", stream, details.Users.Count(), details.Count, details.TotalCsBytes, details.TotalScyBytes, details.TotalFilesize, httpCode)
 						default:
 						}
 
 					case "sql":
 						switch itemType {
 						case "manifest_id":
-							bufString = getSqlLine(date, "", stream, "", len(details.IPs), details.Count, details.TotalCsBytes, details.TotalScyBytes, details.TotalFilesize, itemType, httpCode)
+							bufString = getSqlLine(date, "", stream, "", details.Users.Count(), details.Count, details.TotalCsBytes, details.TotalScyBytes, details.TotalFilesize, itemType, httpCode, idParts...)
 						case "stream_id":
-							bufString = getSqlLine(date, stream, "", "", len(details.IPs), details.Count, details.TotalCsBytes, details.TotalScyBytes, details.TotalFilesize, itemType, httpCode)
+							bufString = getSqlLine(date, stream, "", "", details.Users.Count(), details.Count, details.TotalCsBytes, details.TotalScyBytes, details.TotalFilesize, itemType, httpCode, idParts...)
 						case "stream_name":
-							bufString = getSqlLine(date, "", "", stream, len(details.IPs), details.Count, details.TotalCsBytes, details.TotalScyBytes, details.TotalFilesize, itemType, httpCode)
+							bufString = getSqlLine(date, "", "", stream, details.Users.Count(), details.Count, details.TotalCsBytes, details.TotalScyBytes, details.TotalFilesize, itemType, httpCode, idParts...)
 						default:
 						}
 					default:
 						return fmt.Errorf("invalid output format %s, valid format are csv and sql", format)
 					}
+					for i := 0; i < len(extra) && bufString != ""; i++ {
+						if format == "csv" {
+							bufString += "," + csvEscape(extra[i])
+						} else {
+							bufString += "\n" + getSqlSetLine(getSqlID(date, stream, itemType, httpCode, idParts...), extraColumns[i].name, extra[i])
+						}
+					}
 
 					_, err = datawriter.WriteString(bufString + "\n")
 
@@ -201,14 +488,28 @@ func ParseFiles(folder string, output string, format string) error {
 		}
 	}
 	mu.Unlock()
-	datawriter.Flush()
+	if sessionsErr != nil {
+		return fmt.Errorf("failed writing sessions: %w", sessionsErr)
+	}
+	if err = datawriter.Flush(); err != nil {
+		return err
+	}
 
+	if opts.Referers != "" {
+		top := opts.TopReferers
+		if top <= 0 {
+			top = DefaultTopReferers
+		}
+		if err = referers.write(opts.Referers, top); err != nil {
+			return fmt.Errorf("failed writing referers to %s: %w", opts.Referers, err)
+		}
+	}
 	return nil
 }
 
-func parseFile(file string, c chan VideoStat) error {
+func parseFile(src source.Source, file string, c chan VideoStat, q *quarantine.Quarantine) error {
 	// Create new reader to decompress gzip.
-	f, err := os.Open(file)
+	f, err := src.Open(context.Background(), file)
 	if err != nil {
 		return err
 	}
@@ -217,69 +518,182 @@ func parseFile(file string, c chan VideoStat) error {
 		return err
 	}
 	defer reader.Close()
+	metrics.FilesRead.Inc()
 
 	contents := bufio.NewScanner(reader)
+	lineNum := 0
 	for contents.Scan() {
+		lineNum++
 		if utils.IsCommentLine(contents.Text()) || utils.IsEmptyLine(contents.Text()) {
 			continue
 		}
+		metrics.LinesParsed.Inc()
 
-		parseLine(contents.Text(), c)
+		if err := parseLine(contents.Text(), c); err != nil {
+			reason := rejectReason(err)
+			metrics.LinesRejected.WithLabelValues(reason).Inc()
+			q.Reject(file, lineNum, reason, contents.Text())
+		}
 	}
 	f.Close()
 	glog.V(common.VERBOSE).Info("End file: ", file)
 	return nil
 }
 
-func parseLine(line string, c chan VideoStat) {
+var (
+	errInvalidLine = errors.New("invalid line")
+	errBadURL      = errors.New("invalid URL")
+	errBadInt      = errors.New("invalid int")
+)
+
+func rejectReason(err error) string {
+	switch err {
+	case errBadURL:
+		return metrics.ReasonBadURL
+	case errBadInt:
+		return metrics.ReasonBadInt
+	}
+	return metrics.ReasonInvalidLine
+}
+
+// parseLine sends parsed line to c. errBadInt is returned for the lines
+// that are still counted, with zeroes in place of invalid values.
+func parseLine(line string, c chan VideoStat) error {
 	toks := strings.Split(line, "\t")
 
 	if len(toks) < 17 {
 		glog.V(common.VERBOSE).Infof("Warning: line is not following the log standard. '%s'", line)
-		return
+		return errInvalidLine
 	}
 
-	date := toks[0]
+	tm, err := time.Parse("2006-01-02 15:04:05", toks[0]+" "+toks[1])
+	if err != nil {
+		glog.V(common.VERBOSE).Infof("Warning: invalid date=%q time=%q line=%q", toks[0], toks[1], line)
+		return errInvalidLine
+	}
 	fileSize := toks[7]
 	csBytes := toks[8]
 	scBytes := toks[9]
 	url := toks[14]
 
-	streamId, streamType, err := utils.GetStreamId(url)
+	pu, err := utils.ParseURL(url)
+	if errors.Is(err, utils.ErrNotPlaybackURL) {
+		// valid request of something else, like favicon.ico
+		glog.V(common.VVERBOSE).Infof("Skipping request which is not playback url=%q", url)
+		return nil
+	}
 	if err != nil {
 		glog.Warningf("Warning: invalid URL format: '%s'.", url)
-		return
+		return errBadURL
 	}
 
-	if date == "" || streamId == "" {
+	if pu.ID == "" {
 		glog.Warningf("Warning: Invalid line: %s", line)
 	}
 
+	var badInt bool
 	csBytesInt, err := strconv.ParseInt(csBytes, 10, 64)
 	if err != nil {
 		glog.Warningf("Error: invalid int conversion format: '%s'", csBytes)
+		badInt = true
 	}
 
 	scBytesInt, err := strconv.ParseInt(scBytes, 10, 64)
 	if err != nil {
 		glog.Warningf("Error: invalid int conversion format: '%s'", scBytes)
+		badInt = true
 	}
 
 	fileSizeInt, err := strconv.ParseInt(fileSize, 10, 64)
 	if err != nil {
 		glog.Warningf("Error: invalid int conversion format: '%s'", fileSize)
+		badInt = true
 	}
 	var tempVideoStat VideoStat
 	tempVideoStat.IP = toks[3]
+	tempVideoStat.userAgent = toks[6]
+	tempVideoStat.referer = utils.RefererHost(toks[5])
+	tempVideoStat.sessionID = utils.SessionID(toks[13])
+	tempVideoStat.edge = toks[10]
+	tempVideoStat.timeTaken = -1
+	if timeTaken, err := strconv.ParseFloat(toks[11], 64); err == nil {
+		tempVideoStat.timeTaken = timeTaken * 1000
+	}
+	tempVideoStat.cache = utils.ParseCacheStatus(toks[15], toks[16])
 	tempVideoStat.Filesize = fileSizeInt
 	tempVideoStat.CsBytes = csBytesInt
 	tempVideoStat.ScyBytes = scBytesInt
-	tempVideoStat.date = date
-	tempVideoStat.streamId = streamId
-	tempVideoStat.itemType = string(streamType)
+	tempVideoStat.tm = tm
+	tempVideoStat.streamId = pu.ID
+	tempVideoStat.itemType = string(pu.IDType)
+	tempVideoStat.rendition = pu.Rendition
+	tempVideoStat.kind = pu.Kind
 	tempVideoStat.httpCode = toks[12]
+	if pu.Kind == utils.SegmentKindSegment && strings.HasPrefix(tempVideoStat.httpCode, "2") {
+		tempVideoStat.watchTime = utils.SegmentDuration(toks[13], url)
+		tempVideoStat.segment = url
+	}
 
 	c <- tempVideoStat
+	if badInt {
+		return errBadInt
+	}
+	return nil
+}
+
+func (vs *VideoStat) sessionRequest() session.Request {
+	return session.Request{
+		Time:      vs.tm,
+		ID:        vs.streamId,
+		IDType:    utils.IDType(vs.itemType),
+		IP:        vs.IP,
+		UserAgent: vs.userAgent,
+		SessionID: vs.sessionID,
+		Rendition: vs.rendition,
+		Kind:      vs.kind,
+		Bytes:     vs.ScyBytes,
+	}
+}
+
+// add counts the request the same way etl does
+func (c *cacheStats) add(vs *VideoStat) {
+	switch vs.cache {
+	case utils.CacheHit:
+		c.hits++
+	case utils.CacheMiss:
+		c.misses++
+		// whole file is fetched from the origin, even for range requests
+		if vs.Filesize > 0 {
+			c.originBytes += vs.Filesize
+		} else {
+			c.originBytes += vs.ScyBytes
+		}
+	}
+}
+
+// hitRatio is hits/(hits+misses), 0 if there are none
+func (c cacheStats) hitRatio() float64 {
+	if c.hits+c.misses == 0 {
+		return 0
+	}
+	return float64(c.hits) / float64(c.hits+c.misses)
+}
+
+func (vs *VideoStats) addWatchTime(stat *VideoStat, perIP bool) {
+	if stat.watchTime == 0 || stat.excluded {
+		return
+	}
+	if perIP {
+		if vs.watched == nil {
+			vs.watched = make(map[string]struct{})
+		}
+		key := stat.IP + " " + stat.segment
+		if _, ok := vs.watched[key]; ok {
+			return
+		}
+		vs.watched[key] = struct{}{}
+	}
+	vs.WatchTime += stat.watchTime
 }
 
 func isValidFile(path string) bool {
@@ -307,7 +721,7 @@ func getCsvLine(date string, streamId string, manifestId string, manifestName st
 	return fmt.Sprintf("%s,%s,%s,%s,%d,%d,%d,%d,%d,%s", date, streamId, manifestId, manifestName, countUniqueIPs, contIPs, totalCsBytes, totalScyBytes, totalFilesize, httpCode)
 }
 
-func getSqlLine(date string, streamId string, manifestId string, streamName string, countUniqueIPs int, contIPs int, totalCsBytes int64, totalScyBytes int64, totalFilesize int64, itemType string, httpCode string) string {
+func getSqlLine(date string, streamId string, manifestId string, streamName string, countUniqueIPs int, contIPs int, totalCsBytes int64, totalScyBytes int64, totalFilesize int64, itemType string, httpCode string, idParts ...string) string {
 	template := `INSERT INTO cdn_stats (id, date,stream_id,manifest_id,stream_name,unique_users,total_views,total_cs_bytes,total_sc_bytes,total_file_size,http_code) 
 		VALUES ('%s', '%s', '%s', '%s', '%s', %d, %d, %d, %d, %d, '%s')
 		ON CONFLICT (id) DO UPDATE 
@@ -321,10 +735,76 @@ func getSqlLine(date string, streamId string, manifestId string, streamName stri
 			total_sc_bytes = %d,
 			total_file_size = %d,
 			http_code = %s;`
-	id := date + "_" + itemType + "_" + streamId + manifestId + streamName + "_" + httpCode
+	id := getSqlID(date, streamId+manifestId+streamName, itemType, httpCode, idParts...)
 	return fmt.Sprintf(template, id, date, streamId, manifestId, streamName, countUniqueIPs, contIPs, totalCsBytes, totalScyBytes, totalFilesize, httpCode, date, streamId, manifestId, streamName, countUniqueIPs, contIPs, totalCsBytes, totalScyBytes, totalFilesize, httpCode)
 }
 
+// idParts are values of optional columns (granularity, rendition...) that make
+// rows distinct, without them IDs are the same as before these columns were added
+func getSqlID(date, stream, itemType, httpCode string, idParts ...string) string {
+	id := date + "_" + itemType + "_" + stream + "_" + httpCode
+	for _, part := range idParts {
+		id += "_" + part
+	}
+	return id
+}
+
+// getSqlSetLine sets optional column of the row inserted by getSqlLine
+func getSqlSetLine(id, column, value string) string {
+	return fmt.Sprintf("UPDATE cdn_stats SET %s = '%s' WHERE id = '%s';", column, strings.ReplaceAll(value, "'", "''"), id)
+}
+
+// geoColumns are the columns of enabled geo fields, city comes with country
+func geoColumns(opts ParseOptions) []sqlColumn {
+	if opts.Geo == nil {
+		return nil
+	}
+	var columns []sqlColumn
+	add := func(c sqlColumn) {
+		for _, column := range columns {
+			if column.name == c.name {
+				return
+			}
+		}
+		columns = append(columns, c)
+	}
+	for _, field := range opts.GeoFields {
+		switch field {
+		case geo.FieldCountry:
+			add(sqlColumn{"country", "text"})
+		case geo.FieldCity:
+			add(sqlColumn{"country", "text"})
+			add(sqlColumn{"city", "text"})
+		case geo.FieldASN:
+			add(sqlColumn{"asn", "bigint"})
+			add(sqlColumn{"as_org", "text"})
+		}
+	}
+	return columns
+}
+
+func geoValue(loc geo.Location, column string) string {
+	switch column {
+	case "country":
+		return loc.Country
+	case "city":
+		return loc.City
+	case "asn":
+		return strconv.FormatUint(uint64(loc.ASN), 10)
+	case "as_org":
+		return loc.ASOrg
+	}
+	return ""
+}
+
+// csvEscape quotes values with commas, such as city or AS names
+func csvEscape(value string) string {
+	if !strings.ContainsAny(value, ",\"\n") {
+		return value
+	}
+	return `"` + strings.ReplaceAll(value, `"`, `""`) + `"`
+}
+
 func getCsvHeader() string {
 	return "date,stream_id,manifest_id,stream_name,unique_users,total_views,total_cs_bytes,total_sc_bytes,total_file_size,httpCode"
 }
@@ -344,3 +824,7 @@ func getSqlHeader() string {
 		http_code text
 	 );`
 }
+
+func getSqlAddColumn(column, sqlType string) string {
+	return fmt.Sprintf("ALTER TABLE cdn_stats ADD COLUMN IF NOT EXISTS %s %s;", column, sqlType)
+}
@@ -2,10 +2,21 @@ package app
 
 import (
 	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"regexp"
+	"strconv"
+	"strings"
 	"testing"
+
+	"github.com/livepeer/cdn-log-puller/internal/geo"
+	"github.com/livepeer/cdn-log-puller/internal/rollup"
+	"github.com/livepeer/cdn-log-puller/internal/session"
+	"github.com/stretchr/testify/assert"
 )
 
 func TestValidateParseParameters(t *testing.T) {
@@ -36,7 +47,7 @@ func TestParseFiles(t *testing.T) {
 		os.Remove("./tests_resources/out.csv")
 	}
 
-	err := ParseFiles("../../tests_resources/logs_empty", emptyCsvFileName, "csv")
+	err := ParseFiles("../../tests_resources/logs_empty", emptyCsvFileName, "csv", ParseOptions{})
 	if err != nil {
 		t.Errorf("ParseFiles should not throw. errror: %+v", err)
 	}
@@ -79,7 +90,7 @@ func TestParseFiles(t *testing.T) {
 		}
 	}
 
-	err = ParseFiles("../../tests_resources/logs", "../../tests_resources/out.csv", "csv")
+	err = ParseFiles("../../tests_resources/logs", "../../tests_resources/out.csv", "csv", ParseOptions{})
 	if err != nil {
 		t.Errorf("ParseFiles should not throw. errror: %+v", err)
 	}
@@ -198,3 +209,218 @@ func TestGetCsvHeader_valid(t *testing.T) {
 		t.Errorf("Invalid header. Expected value: %s, received value: %s", val, h)
 	}
 }
+
+// writeGzLog writes the lines as gzipped log file name inside dir
+func writeGzLog(t *testing.T, dir, name string, lines ...string) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write([]byte(strings.Join(lines, "\n"))); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, name), buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// readLines returns lines of the output file, header included
+func readLines(t *testing.T, fileName string) []string {
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.Split(strings.TrimSpace(string(data)), "\n")
+}
+
+func TestParseFilesBreakdowns(t *testing.T) {
+	assert := assert.New(t)
+	dir := t.TempDir()
+	writeGzLog(t, dir, "cds_20211117-164716.log.gz",
+		"2021-11-17\t16:47:17\tGET\t104.28.131.0\thttps\t-\t-\t72756\t736\t74134\t151.139.34.203\t0.542\t200\tmsn=516&dur=2000\t/hls/video+9e70xehvtu637q6p/5/chunk_1031999.ts\t-\t-",
+		"2021-11-17\t16:47:19\tGET\t104.28.131.0\thttps\t-\t-\t81780\t736\t83205\t151.139.34.195\t0.784\t200\tmsn=517&dur=2000\t/hls/video+9e70xehvtu637q6p/5/chunk_1033999.ts\t-\t-",
+		"2021-11-17\t17:02:01\tGET\t104.28.106.0\thttps\t-\t-\t1000\t700\t1200\t151.139.86.3\t0.186\t200\t-\t/hls/9e70xehvtu637q6p/0/chunk_1.ts\t-\t-",
+		"2021-11-17\t17:02:03\tGET\t104.28.106.0\thttps\t-\t-\t300\t700\t400\t151.139.86.3\t0.010\t200\t-\t/hls/9e70xehvtu637q6p/0/index.m3u8\t-\t-",
+	)
+
+	out := filepath.Join(dir, "out.csv")
+	opts := ParseOptions{Renditions: true, RequestClasses: true, WatchTime: true, Granularities: []rollup.Granularity{rollup.Hourly}}
+	if !assert.NoError(ParseFiles(dir, out, "csv", opts)) {
+		return
+	}
+	res := readLines(t, out)
+	if assert.Len(res, 4) {
+		assert.Equal(getCsvHeader()+",granularity,rendition,request_class,watch_time_ms", res[0])
+		assert.ElementsMatch([]string{
+			"2021-11-17T16,,9e70xehvtu637q6p,,1,2,1472,157339,154536,200,1h,5,segment,4000",
+			"2021-11-17T17,,9e70xehvtu637q6p,,1,1,700,1200,1000,200,1h,0,segment,0",
+			"2021-11-17T17,,9e70xehvtu637q6p,,1,1,700,400,300,200,1h,0,manifest,0",
+		}, res[1:])
+	}
+
+	opts = ParseOptions{Edges: true, Latency: true}
+	if !assert.NoError(ParseFiles(dir, out, "csv", opts)) {
+		return
+	}
+	res = readLines(t, out)
+	if assert.Len(res, 4) {
+		assert.Equal(getCsvHeader()+",edge,latency_p50_ms,latency_p90_ms,latency_p99_ms", res[0])
+		latency := make(map[string]float64)
+		for _, row := range res[1:] {
+			fields := strings.Split(row, ",")
+			latency[fields[10]], _ = strconv.ParseFloat(fields[11], 64)
+		}
+		assert.InEpsilon(542, latency["151.139.34.203"], 0.01)
+		assert.InEpsilon(784, latency["151.139.34.195"], 0.01)
+		assert.InEpsilon(10, latency["151.139.86.3"], 0.01)
+	}
+
+	opts = ParseOptions{Geo: fakeLocator{
+		"104.28.131.0": {Country: "US", City: "Chicago", ASN: 13335, ASOrg: "Cloudflare, Inc."},
+		"104.28.106.0": {Country: "DE", City: "Berlin"},
+	}, GeoFields: []string{geo.FieldCountry, geo.FieldASN}}
+	out = filepath.Join(dir, "geo.csv")
+	if !assert.NoError(ParseFiles(dir, out, "csv", opts)) {
+		return
+	}
+	res = readLines(t, out)
+	if assert.Len(res, 3) {
+		assert.Equal(getCsvHeader()+",country,asn,as_org", res[0])
+		assert.ElementsMatch([]string{
+			`2021-11-17,,9e70xehvtu637q6p,,1,2,1472,157339,154536,200,US,13335,"Cloudflare, Inc."`,
+			"2021-11-17,,9e70xehvtu637q6p,,1,2,1400,1600,1300,200,DE,0,",
+		}, res[1:])
+	}
+}
+
+func TestParseFilesCache(t *testing.T) {
+	assert := assert.New(t)
+	dir := t.TempDir()
+	line := "2021-11-17\t16:47:17\tGET\t104.28.131.0\thttps\t-\t-\t%d\t736\t%d\t151.139.34.203\t0.542\t206\t-\t/hls/9e70xehvtu637q6p/0/chunk_1.ts\t%s\t%s"
+	writeGzLog(t, dir, "cds_20211117-164716.log.gz",
+		fmt.Sprintf(line, 72756, 74134, "TCP_HIT", "-"),
+		fmt.Sprintf(line, 72756, 1000, "MISS", "-"),
+		// filesize not logged, bytes sent are fetched
+		fmt.Sprintf(line, 0, 2000, "", "EXPIRED"),
+		fmt.Sprintf(line, 500, 600, "-", "-"),
+	)
+
+	out := filepath.Join(dir, "out.csv")
+	if !assert.NoError(ParseFiles(dir, out, "csv", ParseOptions{Cache: true})) {
+		return
+	}
+	res := readLines(t, out)
+	if assert.Len(res, 2) {
+		assert.Equal(getCsvHeader()+",cache_hits,cache_misses,origin_bytes,cache_hit_ratio", res[0])
+		assert.Equal("2021-11-17,,9e70xehvtu637q6p,,1,4,2944,77734,146012,206,1,2,74756,0.3333", res[1])
+	}
+}
+
+func TestParseLineOtherRequests(t *testing.T) {
+	assert := assert.New(t)
+	line := "2021-11-17\t16:50:00\tGET\t1.1.1.1\thttps\t-\t-\t400\t700\t500\t151.139.34.203\t0.010\t200\t-\t%s\t-\t-"
+	c := make(chan VideoStat)
+	// skipped without sending anything
+	assert.NoError(parseLine(fmt.Sprintf(line, "/favicon.ico"), c))
+	assert.NoError(parseLine(fmt.Sprintf(line, "/crossdomain.xml"), c))
+	assert.Equal(errBadURL, parseLine(fmt.Sprintf(line, "garbage"), c))
+}
+
+func TestParseFilesFlushesSessions(t *testing.T) {
+	assert := assert.New(t)
+	dir := t.TempDir()
+	files := map[string]string{
+		"cds_20211117-164716.log.gz": "2021-11-17\t16:47:17\tGET\t104.28.131.0\thttps\t-\t-\t72756\t736\t74134\t151.139.34.203\t0.542\t200\tmsn=516&dur=2000\t/hls/video+9e70xehvtu637q6p/5/chunk_1031999.ts\t-\t-",
+		"cds_20211117-170201.log.gz": "2021-11-17\t17:02:01\tGET\t104.28.106.0\thttps\t-\t-\t1000\t700\t1200\t151.139.86.3\t0.186\t200\t-\t/hls/9e70xehvtu637q6p/0/chunk_1.ts\t-\t-",
+	}
+	for name, line := range files {
+		writeGzLog(t, dir, name, line)
+	}
+
+	var out bytes.Buffer
+	sessions := session.NewWriter(&out, 0)
+	if !assert.NoError(ParseFiles(dir, filepath.Join(dir, "out.csv"), "csv", ParseOptions{Sessions: sessions})) {
+		return
+	}
+	// first session ended before the request of the second file
+	assert.Equal(1, strings.Count(out.String(), "\n"))
+	assert.Contains(out.String(), "104.28.131.0")
+	assert.NoError(sessions.Close())
+	assert.Equal(2, strings.Count(out.String(), "\n"))
+}
+
+type fakeLocator map[string]geo.Location
+
+func (l fakeLocator) Locate(ip string) geo.Location {
+	return l[ip]
+}
+
+func TestParseFilesUserAgents(t *testing.T) {
+	assert := assert.New(t)
+	dir := t.TempDir()
+	safari := "Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/15.1 Safari/605.1.15"
+	googlebot := "Mozilla/5.0 (compatible; Googlebot/2.1; +http://www.google.com/bot.html)"
+	writeGzLog(t, dir, "cds_20211117-164716.log.gz",
+		"2021-11-17\t16:47:17\tGET\t104.28.131.0\thttps\t-\t"+safari+"\t72756\t736\t74134\t151.139.34.203\t0.542\t200\tdur=2000\t/hls/video+9e70xehvtu637q6p/5/chunk_1.ts\t-\t-",
+		"2021-11-17\t16:47:19\tGET\t104.28.131.0\thttps\t-\t"+safari+"\t81780\t736\t83205\t151.139.34.203\t0.784\t200\tdur=2000\t/hls/video+9e70xehvtu637q6p/5/chunk_2.ts\t-\t-",
+		"2021-11-17\t16:48:01\tGET\t66.249.66.1\thttps\t-\t"+googlebot+"\t1000\t700\t1200\t151.139.34.203\t0.186\t200\tdur=2000\t/hls/video+9e70xehvtu637q6p/5/chunk_1.ts\t-\t-",
+	)
+
+	out := filepath.Join(dir, "out.csv")
+	opts := ParseOptions{UserAgents: true, WatchTime: true}
+	if !assert.NoError(ParseFiles(dir, out, "csv", opts)) {
+		return
+	}
+	res := readLines(t, out)
+	if assert.Len(res, 3) {
+		assert.Equal(getCsvHeader()+",device,os,player,bot,watch_time_ms", res[0])
+		assert.ElementsMatch([]string{
+			"2021-11-17,,9e70xehvtu637q6p,,1,2,1472,157339,154536,200,desktop,macos,safari,false,4000",
+			"2021-11-17,,9e70xehvtu637q6p,,1,1,700,1200,1000,200,bot,other,other,true,2000",
+		}, res[1:])
+	}
+
+	// bot still adds to the bytes
+	opts = ParseOptions{ExcludeBots: true, WatchTime: true}
+	out = filepath.Join(dir, "nobots.csv")
+	if !assert.NoError(ParseFiles(dir, out, "csv", opts)) {
+		return
+	}
+	res = readLines(t, out)
+	if assert.Len(res, 2) {
+		assert.Equal("2021-11-17,,9e70xehvtu637q6p,,1,2,2172,158539,155536,200,4000", res[1])
+	}
+}
+
+func TestParseFilesReferers(t *testing.T) {
+	assert := assert.New(t)
+	dir := t.TempDir()
+	line := func(ip, referer, stream string, scBytes int) string {
+		return fmt.Sprintf("2021-11-17\t16:47:17\tGET\t%s\thttps\t%s\t-\t1000\t700\t%d\t151.139.34.203\t0.542\t200\t-\t/hls/%s/0/chunk_1.ts\t-\t-", ip, referer, scBytes, stream)
+	}
+	writeGzLog(t, dir, "cds_20211117-164716.log.gz",
+		line("104.28.131.0", "https://cdn.livepeer.monster/", "9e70xehvtu637q6p", 1200),
+		line("104.28.131.1", "https://www.livepeer.monster/watch", "9e70xehvtu637q6p", 1200),
+		line("104.28.131.2", "https://livepeer.monster/", "9e70xehvtu637q6p", 1200),
+		line("104.28.131.3", "https://hotlinker.example/", "9e70xehvtu637q6p", 1200),
+		line("104.28.131.4", "-", "9e70xehvtu637q6p", 5000),
+		line("104.28.131.5", "-", "a0b1c2d3e4f5g6h7", 100),
+	)
+
+	out := filepath.Join(dir, "out.csv")
+	referers := filepath.Join(dir, "referers.csv")
+	opts := ParseOptions{Referers: referers, TopReferers: 3}
+	if !assert.NoError(ParseFiles(dir, out, "csv", opts)) {
+		return
+	}
+	data, err := ioutil.ReadFile(referers)
+	assert.NoError(err)
+	assert.Equal(strings.Join([]string{
+		getReferersHeader(),
+		",9e70xehvtu637q6p,,1,livepeer.monster,2,2,1400,2400,2000",
+		",9e70xehvtu637q6p,,2,,1,1,700,5000,1000",
+		",9e70xehvtu637q6p,,3,cdn.livepeer.monster,1,1,700,1200,1000",
+		",a0b1c2d3e4f5g6h7,,1,,1,1,700,100,1000",
+	}, "\n")+"\n", string(data))
+}
@@ -0,0 +1,114 @@
+package app
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+
+	"github.com/livepeer/cdn-log-puller/internal/sketch"
+)
+
+// DefaultTopReferers is the number of referers listed for each stream if not set
+const DefaultTopReferers = 10
+
+type (
+	// refererReport collects requests of each stream by referer host
+	refererReport map[refererKey]map[string]*VideoStats
+
+	refererKey struct {
+		itemType string
+		stream   string
+	}
+)
+
+func (r refererReport) add(vs *VideoStat) {
+	key := refererKey{itemType: vs.itemType, stream: vs.streamId}
+	byHost := r[key]
+	if byHost == nil {
+		byHost = make(map[string]*VideoStats)
+		r[key] = byHost
+	}
+	stats := byHost[vs.referer]
+	if stats == nil {
+		stats = &VideoStats{Users: sketch.New()}
+		byHost[vs.referer] = stats
+	}
+	stats.TotalFilesize += vs.Filesize
+	stats.TotalCsBytes += vs.CsBytes
+	stats.TotalScyBytes += vs.ScyBytes
+	if !vs.excluded {
+		stats.Users.Add(vs.IP)
+		stats.Count++
+	}
+}
+
+func getReferersHeader() string {
+	return "stream_id,manifest_id,stream_name,rank,referer,unique_users,total_views,total_cs_bytes,total_sc_bytes,total_file_size"
+}
+
+// write writes CSV with n referers with most views of each stream, to the file or to stdout for "-"
+func (r refererReport) write(fileName string, n int) error {
+	var w io.Writer = os.Stdout
+	if fileName != "-" {
+		fh, err := os.Create(fileName)
+		if err != nil {
+			return err
+		}
+		defer fh.Close()
+		w = fh
+	}
+	keys := make([]refererKey, 0, len(r))
+	for key := range r {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].stream != keys[j].stream {
+			return keys[i].stream < keys[j].stream
+		}
+		return keys[i].itemType < keys[j].itemType
+	})
+	bw := bufio.NewWriter(w)
+	if _, err := bw.WriteString(getReferersHeader() + "\n"); err != nil {
+		return err
+	}
+	for _, key := range keys {
+		hosts := make([]string, 0, len(r[key]))
+		for host := range r[key] {
+			hosts = append(hosts, host)
+		}
+		byHost := r[key]
+		sort.Slice(hosts, func(i, j int) bool {
+			a, b := byHost[hosts[i]], byHost[hosts[j]]
+			if a.Count != b.Count {
+				return a.Count > b.Count
+			}
+			if a.TotalScyBytes != b.TotalScyBytes {
+				return a.TotalScyBytes > b.TotalScyBytes
+			}
+			return hosts[i] < hosts[j]
+		})
+		if len(hosts) > n {
+			hosts = hosts[:n]
+		}
+		var ids [3]string
+		switch key.itemType {
+		case "stream_id":
+			ids[0] = key.stream
+		case "manifest_id":
+			ids[1] = key.stream
+		case "stream_name":
+			ids[2] = key.stream
+		}
+		for i, host := range hosts {
+			stats := byHost[host]
+			_, err := fmt.Fprintf(bw, "%s,%s,%s,%d,%s,%d,%d,%d,%d,%d\n", ids[0], ids[1], ids[2], i+1, csvEscape(host),
+				stats.Users.Count(), stats.Count, stats.TotalCsBytes, stats.TotalScyBytes, stats.TotalFilesize)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return bw.Flush()
+}
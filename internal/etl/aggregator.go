@@ -2,32 +2,50 @@ package etl
 
 import (
 	"bufio"
-	"bytes"
 	"compress/gzip"
 	"context"
-	"encoding/json"
 	"errors"
 	"fmt"
-	"io/ioutil"
-	"net/http"
 	"os"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
 
-	"cloud.google.com/go/storage"
 	"github.com/golang/glog"
 	"github.com/livepeer/cdn-log-puller/internal/common"
+	"github.com/livepeer/cdn-log-puller/internal/geo"
+	"github.com/livepeer/cdn-log-puller/internal/metrics"
+	"github.com/livepeer/cdn-log-puller/internal/quarantine"
+	"github.com/livepeer/cdn-log-puller/internal/rollup"
+	"github.com/livepeer/cdn-log-puller/internal/session"
+	"github.com/livepeer/cdn-log-puller/internal/sketch"
+	"github.com/livepeer/cdn-log-puller/internal/source"
+	"github.com/livepeer/cdn-log-puller/internal/useragent"
 	"github.com/livepeer/cdn-log-puller/internal/utils"
 )
 
 type (
 	VideoStats struct {
-		IPs           []string `json:"i_ps,omitempty"`
-		TotalFilesize int64    `json:"total_filesize,omitempty"`
-		TotalCsBytes  int64    `json:"total_cs_bytes,omitempty"`
-		TotalScBytes  int64    `json:"total_sc_bytes,omitempty"`
-		Count         int      `json:"count,omitempty"`
+		Users         *sketch.Uniques `json:"-"` // client IPs
+		TotalFilesize int64           `json:"total_filesize,omitempty"`
+		TotalCsBytes  int64           `json:"total_cs_bytes,omitempty"`
+		TotalScBytes  int64           `json:"total_sc_bytes,omitempty"`
+		Count         int             `json:"count,omitempty"`
+		// WatchTime is the sum of durations of media segments served with 2xx, in ms
+		WatchTime int64 `json:"watch_time_ms,omitempty"`
+		// segments already counted in WatchTime by client IP, only if
+		// watch time is counted once per client
+		watched map[string]struct{}
+		// per rendition, per request class and per status breakdowns, only if enabled
+		renditions map[string]*VideoStats
+		classes    map[utils.SegmentKind]*VideoStats // without users
+		statuses   map[string]*VideoStats            // without users
+		geo        map[geo.Location]*VideoStats
+		agents     map[useragent.Info]*VideoStats
+		referers   map[string]*VideoStats // by referer host
+		cache      CacheStats
+		latency    *sketch.Quantiles // only if enabled
 	}
 
 	VideoStatsExt struct {
@@ -38,50 +56,239 @@ type (
 		TotalCsBytes  int64  `json:"total_cs_bytes"`
 		TotalScBytes  int64  `json:"total_sc_bytes"`
 		Count         int    `json:"count"`
+		// WatchTimeMs is estimated viewing time, sum of durations of the
+		// media segments delivered with 2xx status
+		WatchTimeMs int64 `json:"watch_time_ms"`
+		// UsersSketch is base64-encoded HyperLogLog++ sketch of client IPs,
+		// set if etl is run with sketches enabled (see `merge` subcommand)
+		UsersSketch string `json:"users_sketch,omitempty"`
+		// Renditions break the totals down by rendition, if enabled
+		Renditions []*RenditionStats `json:"renditions,omitempty"`
+		// RequestClasses break the totals down by the kind of requested
+		// file, so playlist refreshes can be told from segments, if enabled
+		RequestClasses []*RequestClassStats `json:"request_classes,omitempty"`
+		// Statuses break the totals down by HTTP status code or its class
+		// (2xx, 3xx, 4xx, 5xx), if enabled
+		Statuses []*StatusStats `json:"statuses,omitempty"`
+		// Cache tells how the stream was served from the edge cache, if enabled
+		Cache *CacheStats `json:"cache,omitempty"`
+		// Latency is the distribution of time taken to serve the stream, if enabled
+		Latency *LatencyStats `json:"latency,omitempty"`
+		// Geo breaks the totals down by location of the clients, if enabled
+		Geo []*GeoStats `json:"geo,omitempty"`
+		// UserAgents break the totals down by class of the user agent, if
+		// enabled. Bots are listed even if excluded from the totals.
+		UserAgents []*UserAgentStats `json:"user_agents,omitempty"`
+		// Referers are the sites the stream is watched from the most, if enabled
+		Referers []*RefererStats `json:"referers,omitempty"`
+	}
+
+	// RefererStats are totals of the requests with the referer host, empty
+	// host is for requests without referer (native players, direct links)
+	RefererStats struct {
+		Host          string `json:"host"`
+		UniqueUsers   int    `json:"unique_client_ips"`
+		TotalFilesize int64  `json:"total_filesize"`
+		TotalCsBytes  int64  `json:"total_cs_bytes"`
+		TotalScBytes  int64  `json:"total_sc_bytes"`
+		Count         int    `json:"count"`
+	}
+
+	UserAgentStats struct {
+		Device        string `json:"device"`
+		OS            string `json:"os"`
+		Player        string `json:"player"`
+		Bot           bool   `json:"bot"`
+		UniqueUsers   int    `json:"unique_client_ips"`
+		TotalFilesize int64  `json:"total_filesize"`
+		TotalCsBytes  int64  `json:"total_cs_bytes"`
+		TotalScBytes  int64  `json:"total_sc_bytes"`
+		Count         int    `json:"count"`
+		WatchTimeMs   int64  `json:"watch_time_ms"`
+	}
+
+	// GeoStats are totals of the clients from one location, only the fields
+	// data is grouped by are set, empty if location is not known
+	GeoStats struct {
+		Country       string `json:"country,omitempty"`
+		City          string `json:"city,omitempty"`
+		ASN           uint   `json:"asn,omitempty"`
+		ASOrg         string `json:"as_org,omitempty"`
+		UniqueUsers   int    `json:"unique_client_ips"`
+		TotalFilesize int64  `json:"total_filesize"`
+		TotalCsBytes  int64  `json:"total_cs_bytes"`
+		TotalScBytes  int64  `json:"total_sc_bytes"`
+		Count         int    `json:"count"`
+		WatchTimeMs   int64  `json:"watch_time_ms"`
+	}
+
+	// LatencyStats are quantiles of time taken by the edge to serve requests
+	LatencyStats struct {
+		P50Ms float64 `json:"p50_ms"`
+		P90Ms float64 `json:"p90_ms"`
+		P99Ms float64 `json:"p99_ms"`
+		// Sketch is base64-encoded quantiles sketch of the time taken in ms, set if
+		// sketches are enabled, so quantiles can be computed over longer periods
+		Sketch string `json:"sketch,omitempty"`
+	}
+
+	// CacheStats show how much of the traffic was served from the edge cache
+	CacheStats struct {
+		Hits   int `json:"hits"`
+		Misses int `json:"misses"`
+		// HitRatio is hits/(hits+misses), lines without cache status are not counted
+		HitRatio float64 `json:"hit_ratio"`
+		// OriginBytes is the size of the files fetched from the origin on misses
+		OriginBytes int64 `json:"origin_bytes"`
+	}
+
+	EdgeStats struct {
+		// Edge is IP address of the edge server
+		Edge string `json:"edge"`
+		*CacheStats
+		Latency *LatencyStats `json:"latency,omitempty"`
+	}
+
+	// edgeData is collected for each edge server
+	edgeData struct {
+		cache   CacheStats
+		latency *sketch.Quantiles // only if withLatency is set
+	}
+
+	StatusStats struct {
+		// Status is the response code (206, 404) or its class (2xx, 4xx)
+		Status        string `json:"status"`
+		TotalFilesize int64  `json:"total_filesize"`
+		TotalCsBytes  int64  `json:"total_cs_bytes"`
+		TotalScBytes  int64  `json:"total_sc_bytes"`
+		Count         int    `json:"count"`
+	}
+
+	RequestClassStats struct {
+		// Class is one of manifest, segment, init or vod
+		Class         string `json:"class"`
+		TotalFilesize int64  `json:"total_filesize"`
+		TotalCsBytes  int64  `json:"total_cs_bytes"`
+		TotalScBytes  int64  `json:"total_sc_bytes"`
+		Count         int    `json:"count"`
+	}
+
+	RenditionStats struct {
+		// Rendition is empty for requests of the stream as a whole (master playlist)
+		Rendition     string `json:"rendition"`
+		UniqueUsers   int    `json:"unique_client_ips"`
+		TotalFilesize int64  `json:"total_filesize"`
+		TotalCsBytes  int64  `json:"total_cs_bytes"`
+		TotalScBytes  int64  `json:"total_sc_bytes"`
+		Count         int    `json:"count"`
+		WatchTimeMs   int64  `json:"watch_time_ms"`
 	}
 
 	SendData struct {
-		Date     int64            `json:"date"` // hour in Unix epoch
+		Date     int64            `json:"date"` // start of the bucket in Unix epoch
 		Region   string           `json:"region"`
 		FileName string           `json:"file_name"`
 		Data     []*VideoStatsExt `json:"data"`
+		// Granularity is the size of the bucket data is aggregated over (1h, 5m, 1d, 1mo...)
+		Granularity string `json:"granularity,omitempty"`
+		// Cache and Latency are the cache usage and the latency of the region,
+		// and Edges of its edge servers, if enabled
+		Cache   *CacheStats   `json:"cache,omitempty"`
+		Latency *LatencyStats `json:"latency,omitempty"`
+		Edges   []*EdgeStats  `json:"edges,omitempty"`
+		// BatchID identifies data computed from the same range of files,
+		// so sending the same batch twice can be detected
+		BatchID string `json:"batch_id,omitempty"`
+		// Replace is set when data replaces previously sent data for the same
+		// region and date, or for the same batch if BatchID is set
+		Replace bool `json:"replace,omitempty"`
 	}
 
 	VideoStat struct {
-		date     string
-		streamId string
-		itemType utils.IDType
-		IP       string
-		Filesize int64
-		CsBytes  int64
-		ScBytes  int64
-		httpCode string
+		tm        time.Time
+		streamId  string
+		itemType  utils.IDType
+		rendition string
+		kind      utils.SegmentKind
+		watchTime int64  // segment duration in ms, if it counts as watched
+		segment   string // URL of the segment
+		IP        string
+		userAgent string
+		sessionID string
+		edge      string // IP of the edge server
+		cache     utils.CacheStatus
+		timeTaken float64 // ms, negative if not logged
+		location  geo.Location
+		agent     useragent.Info
+		referer   string // host only
+		excluded  bool   // adds only to the bytes, not to users, count and watch time
+		Filesize  int64
+		CsBytes   int64
+		ScBytes   int64
+		httpCode  string
 	}
 
 	aggregator struct {
-		ctx            context.Context
-		cancel         context.CancelFunc
-		gsClient       *storage.Client
-		bucket         string
-		data           map[string]map[utils.IDType]map[string]map[string]*VideoStats
-		otherTraffic   int64 // traffic sent from CDN to clients not related to video streaming
-		livepeerAPIKey string
-		livepeerAPIUrl string
+		ctx          context.Context
+		cancel       context.CancelFunc
+		src          source.Source
+		data         map[bucket]map[utils.IDType]map[string]*VideoStats
+		otherTraffic int64 // traffic sent from CDN to clients not related to video streaming
+		videoTraffic int64
+		cacheTotal   CacheStats
+		// cache usage and latency by edge server, only if enabled
+		edges        map[bucket]map[string]*edgeData
+		quarantine   *quarantine.Quarantine
+		withSketches bool
+		// withRenditions adds per rendition breakdown to the stats of each stream
+		withRenditions bool
+		// withClasses adds per request class breakdown to the stats of each stream
+		withClasses bool
+		// withCache adds cache usage of each stream, region and edge server
+		withCache bool
+		// withLatency adds latency quantiles of each stream, region and edge server
+		withLatency bool
+		// geo, if set, is used to break the data of each stream down by
+		// location of the clients, grouped by geoFields
+		geo       geo.Locator
+		geoFields []string
+		// withUserAgents adds per user agent class breakdown to the stats of each stream
+		withUserAgents bool
+		// topReferers is the number of referer hosts listed for each stream, 0 disables them
+		topReferers int
+		// excludeBots keeps bot requests out of users, counts and watch time
+		excludeBots bool
+		// statusCodes adds per status breakdown, StatusCodesClass or StatusCodesExact
+		statusCodes string
+		// watchTimePerIP makes each segment count in watch time once per client IP
+		watchTimePerIP bool
+		// each line is added to the bucket of every granularity
+		granularities []rollup.Granularity
+		// sessions, if set, gets every video request, tagged with the region
+		sessions *session.Sessionizer
+		region   string
+		// top, if set, gets every video request instead of the data, only
+		// heavy hitters are kept
+		top *heavyHitters
+		// anomalies, if set, gets traffic of each stream for the anomaly detector
+		anomalies map[string]*anomalyData
 	}
-)
 
-func newAggregator(gctx context.Context, gsClient *storage.Client, bucket,
-	livepeerAPIKey, livepeerAPIUrl string) *aggregator {
+	bucket struct {
+		granularity rollup.Granularity
+		start       int64
+	}
+)
 
+func newAggregator(gctx context.Context, src source.Source) *aggregator {
 	ctx, cancel := context.WithCancel(gctx)
 	return &aggregator{
-		ctx:            ctx,
-		cancel:         cancel,
-		gsClient:       gsClient,
-		bucket:         bucket,
-		data:           make(map[string]map[utils.IDType]map[string]map[string]*VideoStats), // date:IdType:streamId:httpCode
-		livepeerAPIKey: livepeerAPIKey,
-		livepeerAPIUrl: livepeerAPIUrl,
+		ctx:           ctx,
+		cancel:        cancel,
+		src:           src,
+		data:          make(map[bucket]map[utils.IDType]map[string]*VideoStats), // bucket:IdType:streamId
+		edges:         make(map[bucket]map[string]*edgeData),
+		granularities: []rollup.Granularity{rollup.Hourly},
 	}
 }
 
@@ -96,143 +303,516 @@ func (ag *aggregator) incomingDataLoop(doneC chan struct{}, c chan VideoStat) {
 			// In that case ScBytes in 0, so just skipping
 			continue
 		}
-		// treat all codes in the same way
-		chainVideoStat.httpCode = "200"
-		// glog.Infof("~~~ inserting line for date %s stream id %s", chainVideoStat.date, chainVideoStat.streamId)
-		byDate := ag.data[chainVideoStat.date]
-		if byDate == nil {
-			byDate = make(map[utils.IDType]map[string]map[string]*VideoStats)
-			ag.data[chainVideoStat.date] = byDate
-		}
-		byType := byDate[chainVideoStat.itemType]
-		if byType == nil {
-			byType = make(map[string]map[string]*VideoStats)
-			byDate[chainVideoStat.itemType] = byType
-		}
-		byStreamID := byType[chainVideoStat.streamId]
-		if byStreamID == nil {
-			byStreamID = make(map[string]*VideoStats)
-			byType[chainVideoStat.streamId] = byStreamID
-		}
-		if stats, ok := byStreamID[chainVideoStat.httpCode]; ok {
-			if !utils.Includes(stats.IPs, chainVideoStat.IP) {
-				stats.IPs = append(stats.IPs, chainVideoStat.IP)
+		ag.videoTraffic += chainVideoStat.ScBytes
+		ag.cacheTotal.add(&chainVideoStat)
+		if ag.top != nil {
+			ag.top.add(&chainVideoStat)
+			continue
+		}
+		if ag.anomalies != nil {
+			ag.addAnomalyData(&chainVideoStat)
+		}
+		if ag.geo != nil {
+			chainVideoStat.location = ag.geo.Locate(chainVideoStat.IP).Only(ag.geoFields)
+		}
+		if ag.withUserAgents || ag.excludeBots {
+			chainVideoStat.agent = useragent.Classify(chainVideoStat.userAgent)
+			chainVideoStat.excluded = ag.excludeBots && chainVideoStat.agent.Bot
+		}
+		if ag.sessions != nil {
+			r := chainVideoStat.sessionRequest()
+			r.Region = ag.region
+			ag.sessions.Add(r)
+		}
+		for _, g := range ag.granularities {
+			ag.add(bucket{granularity: g, start: g.Start(chainVideoStat.tm).Unix()}, &chainVideoStat)
+		}
+	}
+	doneC <- struct{}{}
+}
+
+func (vs *VideoStat) sessionRequest() session.Request {
+	return session.Request{
+		Time:      vs.tm,
+		ID:        vs.streamId,
+		IDType:    vs.itemType,
+		IP:        vs.IP,
+		UserAgent: vs.userAgent,
+		SessionID: vs.sessionID,
+		Rendition: vs.rendition,
+		Kind:      vs.kind,
+		Bytes:     vs.ScBytes,
+	}
+}
+
+func (ag *aggregator) add(b bucket, vs *VideoStat) {
+	byDate := ag.data[b]
+	if byDate == nil {
+		byDate = make(map[utils.IDType]map[string]*VideoStats)
+		ag.data[b] = byDate
+	}
+	byType := byDate[vs.itemType]
+	if byType == nil {
+		byType = make(map[string]*VideoStats)
+		byDate[vs.itemType] = byType
+	}
+	// all status codes are counted in the totals of the stream
+	stats, ok := byType[vs.streamId]
+	if !ok {
+		stats = &VideoStats{Users: sketch.New()}
+		byType[vs.streamId] = stats
+	}
+	stats.add(vs, ag.watchTimePerIP)
+	if ag.withRenditions {
+		if stats.renditions == nil {
+			stats.renditions = make(map[string]*VideoStats)
+		}
+		rs, ok := stats.renditions[vs.rendition]
+		if !ok {
+			rs = &VideoStats{Users: sketch.New()}
+			stats.renditions[vs.rendition] = rs
+		}
+		rs.add(vs, ag.watchTimePerIP)
+	}
+	if ag.withClasses {
+		if stats.classes == nil {
+			stats.classes = make(map[utils.SegmentKind]*VideoStats)
+		}
+		cs, ok := stats.classes[vs.kind]
+		if !ok {
+			cs = &VideoStats{}
+			stats.classes[vs.kind] = cs
+		}
+		cs.add(vs, ag.watchTimePerIP)
+	}
+	if ag.withCache || ag.withLatency {
+		byEdge := ag.edges[b]
+		if byEdge == nil {
+			byEdge = make(map[string]*edgeData)
+			ag.edges[b] = byEdge
+		}
+		ed, ok := byEdge[vs.edge]
+		if !ok {
+			ed = &edgeData{}
+			byEdge[vs.edge] = ed
+		}
+		ed.cache.add(vs)
+		if ag.withLatency {
+			if ed.latency == nil {
+				ed.latency = sketch.NewQuantiles()
 			}
-			stats.Count++
-			stats.TotalFilesize += chainVideoStat.Filesize
-			stats.TotalCsBytes += chainVideoStat.CsBytes
-			stats.TotalScBytes += chainVideoStat.ScBytes
+			ed.latency.Add(vs.timeTaken)
+		}
+	}
+	if ag.geo != nil {
+		if stats.geo == nil {
+			stats.geo = make(map[geo.Location]*VideoStats)
+		}
+		gs, ok := stats.geo[vs.location]
+		if !ok {
+			gs = &VideoStats{Users: sketch.New()}
+			stats.geo[vs.location] = gs
+		}
+		gs.add(vs, ag.watchTimePerIP)
+	}
+	if ag.withUserAgents {
+		if stats.agents == nil {
+			stats.agents = make(map[useragent.Info]*VideoStats)
+		}
+		as, ok := stats.agents[vs.agent]
+		if !ok {
+			as = &VideoStats{Users: sketch.New()}
+			stats.agents[vs.agent] = as
+		}
+		// bots are counted here even if excluded, to tell how much traffic they make
+		counted := *vs
+		counted.excluded = false
+		as.add(&counted, ag.watchTimePerIP)
+	}
+	if ag.topReferers > 0 {
+		if stats.referers == nil {
+			stats.referers = make(map[string]*VideoStats)
+		}
+		rs, ok := stats.referers[vs.referer]
+		if !ok {
+			rs = &VideoStats{Users: sketch.New()}
+			stats.referers[vs.referer] = rs
+		}
+		rs.add(vs, ag.watchTimePerIP)
+	}
+	if ag.withLatency {
+		if stats.latency == nil {
+			stats.latency = sketch.NewQuantiles()
+		}
+		stats.latency.Add(vs.timeTaken)
+	}
+	if ag.statusCodes != "" {
+		if stats.statuses == nil {
+			stats.statuses = make(map[string]*VideoStats)
+		}
+		status := vs.httpCode
+		if ag.statusCodes == StatusCodesClass {
+			status = statusClass(status)
+		}
+		ss, ok := stats.statuses[status]
+		if !ok {
+			ss = &VideoStats{}
+			stats.statuses[status] = ss
+		}
+		ss.add(vs, ag.watchTimePerIP)
+	}
+}
+
+func (c *CacheStats) add(vs *VideoStat) {
+	switch vs.cache {
+	case utils.CacheHit:
+		c.Hits++
+	case utils.CacheMiss:
+		c.Misses++
+		// whole file is fetched from the origin, even for range requests
+		if vs.Filesize > 0 {
+			c.OriginBytes += vs.Filesize
 		} else {
-			byStreamID[chainVideoStat.httpCode] = &VideoStats{
-				IPs:           []string{chainVideoStat.IP},
-				TotalFilesize: chainVideoStat.Filesize,
-				TotalCsBytes:  chainVideoStat.CsBytes,
-				TotalScBytes:  chainVideoStat.ScBytes,
-				Count:         1,
-			}
+			c.OriginBytes += vs.ScBytes
 		}
 	}
-	doneC <- struct{}{}
 }
 
-func hourToUnix(hour string) int64 {
-	tm, err := time.Parse("2006-01-0215", hour)
-	if err != nil {
-		panic(err)
+// withRatio returns copy of the stats with HitRatio set
+func (c CacheStats) withRatio() *CacheStats {
+	if c.Hits+c.Misses > 0 {
+		c.HitRatio = float64(c.Hits) / float64(c.Hits+c.Misses)
 	}
-	glog.Infof("==> hour=%s parsed as %s", hour, tm)
-	return tm.Unix()
+	return &c
 }
 
-func (ag *aggregator) flatten(region string, startHour time.Time, lastFileName string) []*SendData {
-	var toSend []*SendData
-	for date, val := range ag.data {
-		glog.Infof("--> date: %s", date)
-		sd := &SendData{
-			Region:   region,
-			Date:     hourToUnix(date),
-			FileName: lastFileName,
+func (ag *aggregator) latencyStats(q *sketch.Quantiles) *LatencyStats {
+	ls := &LatencyStats{
+		P50Ms: q.Quantile(0.5),
+		P90Ms: q.Quantile(0.9),
+		P99Ms: q.Quantile(0.99),
+	}
+	if ag.withSketches {
+		encoded, err := q.Encode()
+		if err != nil {
+			glog.Errorf("Error encoding latency sketch err=%v", err)
 		}
-		toSend = append(toSend, sd)
+		ls.Sketch = encoded
+	}
+	return ls
+}
 
-		for itemType, val1 := range val {
-			glog.Infof("--> item type %q", itemType)
-			for stream, val2 := range val1 {
-				glog.Infof("## stream %s", stream)
-				for status, details := range val2 {
-					// glog.Infof("---> status: %s", status)
-					if status != "200" {
-						panic("xstop")
-					}
-					if stream == "bad0aqlrxtr9cvuv" {
-						glog.Infof("-> itemType %s stream %s dat %+v", itemType, stream, details)
-					}
-					vstat := &VideoStatsExt{
-						Count:         details.Count,
-						TotalFilesize: details.TotalFilesize,
-						TotalCsBytes:  details.TotalCsBytes,
-						TotalScBytes:  details.TotalScBytes,
-						UniqueUsers:   len(details.IPs),
-					}
-					switch itemType {
-					case utils.IDTypeManifestID:
-						vstat.PlaybackID = stream
-					case utils.IDTypeStreamID:
-						vstat.StreamID = stream
-					default:
-						panic("shouldn't happen")
-					}
-					sd.Data = append(sd.Data, vstat)
+// setRegionStats sets cache usage and latency of the region and of its
+// edge servers, sorted by edge
+func (ag *aggregator) setRegionStats(sd *SendData, b bucket) {
+	var cache CacheStats
+	latency := sketch.NewQuantiles()
+	sd.Edges = make([]*EdgeStats, 0, len(ag.edges[b]))
+	for edge, ed := range ag.edges[b] {
+		es := &EdgeStats{Edge: edge}
+		if ag.withCache {
+			es.CacheStats = ed.cache.withRatio()
+			cache.Hits += ed.cache.Hits
+			cache.Misses += ed.cache.Misses
+			cache.OriginBytes += ed.cache.OriginBytes
+		}
+		if ag.withLatency {
+			es.Latency = ag.latencyStats(ed.latency)
+			latency.Merge(ed.latency)
+		}
+		sd.Edges = append(sd.Edges, es)
+	}
+	sort.Slice(sd.Edges, func(i, j int) bool {
+		return sd.Edges[i].Edge < sd.Edges[j].Edge
+	})
+	if ag.withCache {
+		sd.Cache = cache.withRatio()
+	}
+	if ag.withLatency {
+		sd.Latency = ag.latencyStats(latency)
+	}
+}
 
-				}
-			}
+// statusClass returns 2xx for 200, 206 etc. Codes that are not
+// three digits are returned as is.
+func statusClass(code string) string {
+	if len(code) != 3 || code[0] < '1' || code[0] > '5' {
+		return code
+	}
+	return code[:1] + "xx"
+}
+
+func (s *VideoStats) add(vs *VideoStat, watchTimePerIP bool) {
+	s.TotalFilesize += vs.Filesize
+	s.TotalCsBytes += vs.CsBytes
+	s.TotalScBytes += vs.ScBytes
+	s.cache.add(vs)
+	if vs.excluded {
+		return
+	}
+	if s.Users != nil {
+		s.Users.Add(vs.IP)
+	}
+	s.Count++
+	if vs.watchTime == 0 {
+		return
+	}
+	if watchTimePerIP {
+		if s.watched == nil {
+			s.watched = make(map[string]struct{})
+		}
+		key := vs.IP + " " + vs.segment
+		if _, ok := s.watched[key]; ok {
+			return
 		}
+		s.watched[key] = struct{}{}
 	}
-	glog.V(common.DEBUG).Infof("flatten toSend=%+v", toSend)
-	return toSend
+	s.WatchTime += vs.watchTime
 }
 
-const httpTimeout = 64 * time.Second
+// renditionStats lists breakdown sorted by rendition
+func (s *VideoStats) renditionStats() []*RenditionStats {
+	res := make([]*RenditionStats, 0, len(s.renditions))
+	for rendition, rs := range s.renditions {
+		res = append(res, &RenditionStats{
+			Rendition:     rendition,
+			UniqueUsers:   rs.Users.Count(),
+			TotalFilesize: rs.TotalFilesize,
+			TotalCsBytes:  rs.TotalCsBytes,
+			TotalScBytes:  rs.TotalScBytes,
+			Count:         rs.Count,
+			WatchTimeMs:   rs.WatchTime,
+		})
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].Rendition < res[j].Rendition
+	})
+	return res
+}
 
-var defaultHTTPClient = &http.Client{
-	// Transport: &http2.Transport{TLSClientConfig: tlsConfig},
-	// Transport: &http2.Transport{AllowHTTP: true},
-	Timeout: httpTimeout,
+// classStats lists breakdown sorted by class
+func (s *VideoStats) classStats() []*RequestClassStats {
+	res := make([]*RequestClassStats, 0, len(s.classes))
+	for class, cs := range s.classes {
+		res = append(res, &RequestClassStats{
+			Class:         string(class),
+			TotalFilesize: cs.TotalFilesize,
+			TotalCsBytes:  cs.TotalCsBytes,
+			TotalScBytes:  cs.TotalScBytes,
+			Count:         cs.Count,
+		})
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].Class < res[j].Class
+	})
+	return res
 }
 
-func (ag *aggregator) postToAPI(data []*SendData) error {
-	uri := fmt.Sprintf("%s/api/cdn-data", ag.livepeerAPIUrl)
-	bin, err := json.Marshal(data)
-	if err != nil {
-		glog.Errorf("Error mashalling SendData err=%v", err)
-		return err
+// geoStats lists breakdown sorted by location
+func (s *VideoStats) geoStats() []*GeoStats {
+	res := make([]*GeoStats, 0, len(s.geo))
+	for loc, gs := range s.geo {
+		res = append(res, &GeoStats{
+			Country:       loc.Country,
+			City:          loc.City,
+			ASN:           loc.ASN,
+			ASOrg:         loc.ASOrg,
+			UniqueUsers:   gs.Users.Count(),
+			TotalFilesize: gs.TotalFilesize,
+			TotalCsBytes:  gs.TotalCsBytes,
+			TotalScBytes:  gs.TotalScBytes,
+			Count:         gs.Count,
+			WatchTimeMs:   gs.WatchTime,
+		})
 	}
-	glog.V(common.INSANE2).Infof("Posting dataLen=%d data=%s", len(bin), string(bin))
+	sort.Slice(res, func(i, j int) bool {
+		a, b := res[i], res[j]
+		if a.Country != b.Country {
+			return a.Country < b.Country
+		}
+		if a.City != b.City {
+			return a.City < b.City
+		}
+		return a.ASN < b.ASN
+	})
+	return res
+}
 
-	req, err := http.NewRequest("POST", uri, bytes.NewBuffer(bin))
-	if err != nil {
-		return err
+// userAgentStats lists breakdown sorted by device, OS and player
+func (s *VideoStats) userAgentStats() []*UserAgentStats {
+	res := make([]*UserAgentStats, 0, len(s.agents))
+	for info, as := range s.agents {
+		res = append(res, &UserAgentStats{
+			Device:        info.Device,
+			OS:            info.OS,
+			Player:        info.Player,
+			Bot:           info.Bot,
+			UniqueUsers:   as.Users.Count(),
+			TotalFilesize: as.TotalFilesize,
+			TotalCsBytes:  as.TotalCsBytes,
+			TotalScBytes:  as.TotalScBytes,
+			Count:         as.Count,
+			WatchTimeMs:   as.WatchTime,
+		})
 	}
-	req.Header.Add("Authorization", "Bearer "+ag.livepeerAPIKey)
-	req.Header.Add("Content-Type", "application/json")
-	resp, err := defaultHTTPClient.Do(req)
-	if err != nil {
-		return err
+	sort.Slice(res, func(i, j int) bool {
+		a, b := res[i], res[j]
+		if a.Device != b.Device {
+			return a.Device < b.Device
+		}
+		if a.OS != b.OS {
+			return a.OS < b.OS
+		}
+		if a.Player != b.Player {
+			return a.Player < b.Player
+		}
+		return !a.Bot && b.Bot
+	})
+	return res
+}
+
+// refererStats lists n referers with most requests
+func (s *VideoStats) refererStats(n int) []*RefererStats {
+	res := make([]*RefererStats, 0, len(s.referers))
+	for host, rs := range s.referers {
+		res = append(res, &RefererStats{
+			Host:          host,
+			UniqueUsers:   rs.Users.Count(),
+			TotalFilesize: rs.TotalFilesize,
+			TotalCsBytes:  rs.TotalCsBytes,
+			TotalScBytes:  rs.TotalScBytes,
+			Count:         rs.Count,
+		})
 	}
-	defer resp.Body.Close()
-	bin, err = ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return err
+	sort.Slice(res, func(i, j int) bool {
+		a, b := res[i], res[j]
+		if a.Count != b.Count {
+			return a.Count > b.Count
+		}
+		if a.TotalScBytes != b.TotalScBytes {
+			return a.TotalScBytes > b.TotalScBytes
+		}
+		return a.Host < b.Host
+	})
+	if len(res) > n {
+		res = res[:n]
+	}
+	return res
+}
+
+// statusStats lists breakdown sorted by status
+func (s *VideoStats) statusStats() []*StatusStats {
+	res := make([]*StatusStats, 0, len(s.statuses))
+	for status, ss := range s.statuses {
+		res = append(res, &StatusStats{
+			Status:        status,
+			TotalFilesize: ss.TotalFilesize,
+			TotalCsBytes:  ss.TotalCsBytes,
+			TotalScBytes:  ss.TotalScBytes,
+			Count:         ss.Count,
+		})
 	}
-	glog.Infof("SendData post response=%s", string(bin))
-	if resp.StatusCode != http.StatusOK {
-		glog.Errorf("Response from the API /cdn-data code=%v status=%s", resp.StatusCode, resp.Status)
-		if resp.StatusCode == http.StatusForbidden {
-			return ErrForbidden
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].Status < res[j].Status
+	})
+	return res
+}
+
+// sortedBuckets orders buckets by granularity (in the order they were
+// configured) and then by time, so each granularity is sent in order
+func (ag *aggregator) sortedBuckets() []bucket {
+	order := make(map[rollup.Granularity]int, len(ag.granularities))
+	for i, g := range ag.granularities {
+		order[g] = i
+	}
+	buckets := make([]bucket, 0, len(ag.data))
+	for b := range ag.data {
+		buckets = append(buckets, b)
+	}
+	sort.Slice(buckets, func(i, j int) bool {
+		a, b := buckets[i], buckets[j]
+		if a.granularity != b.granularity {
+			return order[a.granularity] < order[b.granularity]
+		}
+		return a.start < b.start
+	})
+	return buckets
+}
+
+func (ag *aggregator) flatten(region string, startHour time.Time, lastFileName string) []*SendData {
+	var toSend []*SendData
+	for _, b := range ag.sortedBuckets() {
+		val := ag.data[b]
+		glog.V(common.DEBUG).Infof("Flattening date=%s granularity=%s", time.Unix(b.start, 0).UTC(), b.granularity)
+		sd := &SendData{
+			Region:      region,
+			Date:        b.start,
+			FileName:    lastFileName,
+			Granularity: b.granularity.String(),
+		}
+		if ag.withCache || ag.withLatency {
+			ag.setRegionStats(sd, b)
+		}
+		toSend = append(toSend, sd)
+
+		for itemType, val1 := range val {
+			for stream, details := range val1 {
+				glog.V(common.DEBUG).Infof("Flattening itemType=%s stream=%s", itemType, stream)
+				vstat := &VideoStatsExt{
+					Count:         details.Count,
+					TotalFilesize: details.TotalFilesize,
+					TotalCsBytes:  details.TotalCsBytes,
+					TotalScBytes:  details.TotalScBytes,
+					UniqueUsers:   details.Users.Count(),
+					WatchTimeMs:   details.WatchTime,
+				}
+				// buckets longer than an hour are sent by every hourly pass, the
+				// sink merges their sketches to count each client once
+				if ag.withSketches || b.granularity.Exceeds(aggregationDuration) {
+					encoded, err := details.Users.Encode()
+					if err != nil {
+						glog.Errorf("Error encoding users sketch stream=%s err=%v", stream, err)
+					}
+					vstat.UsersSketch = encoded
+				}
+				if ag.withRenditions {
+					vstat.Renditions = details.renditionStats()
+				}
+				if ag.withClasses {
+					vstat.RequestClasses = details.classStats()
+				}
+				if ag.statusCodes != "" {
+					vstat.Statuses = details.statusStats()
+				}
+				if ag.withCache {
+					vstat.Cache = details.cache.withRatio()
+				}
+				if ag.withLatency {
+					vstat.Latency = ag.latencyStats(details.latency)
+				}
+				if ag.geo != nil {
+					vstat.Geo = details.geoStats()
+				}
+				if ag.withUserAgents {
+					vstat.UserAgents = details.userAgentStats()
+				}
+				if ag.topReferers > 0 {
+					vstat.Referers = details.refererStats(ag.topReferers)
+				}
+				switch itemType {
+				case utils.IDTypeManifestID:
+					vstat.PlaybackID = stream
+				case utils.IDTypeStreamID:
+					vstat.StreamID = stream
+				default:
+					panic("shouldn't happen")
+				}
+				sd.Data = append(sd.Data, vstat)
+			}
 		}
-		return fmt.Errorf("error sending data status=%s", resp.Status)
 	}
-	return nil
+	glog.V(common.DEBUG).Infof("flatten toSend=%+v", toSend)
+	return toSend
 }
 
 func (ag *aggregator) aggregate(region string) {
@@ -256,43 +836,43 @@ func (ag *aggregator) aggregate(region string) {
 	}
 
 	format := "csv"
-	for date, val := range ag.data {
+	for b, val := range ag.data {
+		date := b.granularity.Format(time.Unix(b.start, 0))
 		for itemType, val1 := range val {
-			for stream, val2 := range val1 {
-				for httpCode, details := range val2 {
-					bufString := ""
-					switch format {
-					case "csv":
-						switch itemType {
-						case "manifest_id":
-							bufString = getCsvLine(date, "", stream, "", len(details.IPs), details.Count, details.TotalCsBytes, details.TotalScBytes, details.TotalFilesize, httpCode)
-						case "stream_id":
-							bufString = getCsvLine(date, stream, "", "", len(details.IPs), details.Count, details.TotalCsBytes, details.TotalScBytes, details.TotalFilesize, httpCode)
-						case "stream_name":
-							bufString = getCsvLine(date, "", "", stream, len(details.IPs), details.Count, details.TotalCsBytes, details.TotalScBytes, details.TotalFilesize, httpCode)
-						default:
-						}
-
-					case "sql":
-						// switch itemType {
-						// case "manifest_id":
-						// 	bufString = getSqlLine(date, "", stream, "", len(details.IPs), details.Count, details.TotalCsBytes, details.TotalScyBytes, details.TotalFilesize, itemType, httpCode)
-						// case "stream_id":
-						// 	bufString = getSqlLine(date, stream, "", "", len(details.IPs), details.Count, details.TotalCsBytes, details.TotalScyBytes, details.TotalFilesize, itemType, httpCode)
-						// case "stream_name":
-						// 	bufString = getSqlLine(date, "", "", stream, len(details.IPs), details.Count, details.TotalCsBytes, details.TotalScyBytes, details.TotalFilesize, itemType, httpCode)
-						// default:
-						// }
+			for stream, details := range val1 {
+				httpCode := "200"
+				bufString := ""
+				switch format {
+				case "csv":
+					switch itemType {
+					case "manifest_id":
+						bufString = getCsvLine(date, "", stream, "", details.Users.Count(), details.Count, details.TotalCsBytes, details.TotalScBytes, details.TotalFilesize, httpCode)
+					case "stream_id":
+						bufString = getCsvLine(date, stream, "", "", details.Users.Count(), details.Count, details.TotalCsBytes, details.TotalScBytes, details.TotalFilesize, httpCode)
+					case "stream_name":
+						bufString = getCsvLine(date, "", "", stream, details.Users.Count(), details.Count, details.TotalCsBytes, details.TotalScBytes, details.TotalFilesize, httpCode)
 					default:
-						// return fmt.Errorf("invalid output format %s, valid format are csv and sql", format)
 					}
 
-					_, err = datawriter.WriteString(bufString + "\n")
+				case "sql":
+					// switch itemType {
+					// case "manifest_id":
+					// 	bufString = getSqlLine(date, "", stream, "", details.Users.Count(), details.Count, details.TotalCsBytes, details.TotalScyBytes, details.TotalFilesize, itemType, httpCode)
+					// case "stream_id":
+					// 	bufString = getSqlLine(date, stream, "", "", details.Users.Count(), details.Count, details.TotalCsBytes, details.TotalScyBytes, details.TotalFilesize, itemType, httpCode)
+					// case "stream_name":
+					// 	bufString = getSqlLine(date, "", "", stream, details.Users.Count(), details.Count, details.TotalCsBytes, details.TotalScyBytes, details.TotalFilesize, itemType, httpCode)
+					// default:
+					// }
+				default:
+					// return fmt.Errorf("invalid output format %s, valid format are csv and sql", format)
+				}
 
-					if err != nil {
-						panic(fmt.Errorf("failed writing line %s to file: %s", bufString, err))
-						// return fmt.Errorf("failed writing line %s to file: %s", bufString, err)
-					}
+				_, err = datawriter.WriteString(bufString + "\n")
+
+				if err != nil {
+					panic(fmt.Errorf("failed writing line %s to file: %s", bufString, err))
+					// return fmt.Errorf("failed writing line %s to file: %s", bufString, err)
 				}
 			}
 		}
@@ -307,7 +887,7 @@ func (ag *aggregator) Done() <-chan struct{} {
 func (ag *aggregator) parseFileWorker(fileNameChan chan string, doneC chan struct{}, c chan VideoStat) {
 	for fileName := range fileNameChan {
 		glog.V(common.DEBUG).Infof("Got file=%s to process", fileName)
-		err := parseFile(ag.ctx, ag.gsClient, ag.bucket, fileName, c)
+		err := parseFile(ag.ctx, ag.src, fileName, c, ag.quarantine)
 		if err != nil {
 			glog.Errorf("Error processing file=%s err=%v", fileName, err)
 		}
@@ -315,17 +895,18 @@ func (ag *aggregator) parseFileWorker(fileNameChan chan string, doneC chan struc
 	doneC <- struct{}{}
 }
 
-func parseFile(ctx context.Context, gsClient *storage.Client, bucket, file string, c chan VideoStat) error {
+// parseFile sends parsed lines of the file to c, rejected lines are put into quarantine
+func parseFile(ctx context.Context, src source.Source, file string, c chan VideoStat, q *quarantine.Quarantine) error {
 	ctx, cancel := context.WithTimeout(ctx, time.Second*600)
 	defer cancel()
 	started := time.Now()
 	defer func(s time.Time) {
-		glog.V(common.VERBOSE).Infof("End parsing file bucket=%s file=%s took=%s", bucket, file, time.Since(s))
+		glog.V(common.VERBOSE).Infof("End parsing file source=%s file=%s took=%s", src, file, time.Since(s))
 	}(started)
 
-	rc, err := gsClient.Bucket(bucket).Object(file).NewReader(ctx)
+	rc, err := src.Open(ctx, file)
 	if err != nil {
-		return fmt.Errorf("Object(%q).NewReader: %v", file, err)
+		return err
 	}
 	defer rc.Close()
 
@@ -334,20 +915,46 @@ func parseFile(ctx context.Context, gsClient *storage.Client, bucket, file strin
 		return err
 	}
 	defer reader.Close()
+	metrics.FilesRead.Inc()
 
 	contents := bufio.NewScanner(reader)
+	lineNum := 0
 	for contents.Scan() {
+		lineNum++
 		line := contents.Text()
 		if utils.IsCommentLine(line) || utils.IsEmptyLine(line) {
 			continue
 		}
-		parseLine(line, c)
+		metrics.LinesParsed.Inc()
+		if err := parseLine(line, c); err != nil {
+			reason := rejectReason(err)
+			metrics.LinesRejected.WithLabelValues(reason).Inc()
+			q.Reject(file, lineNum, reason, line)
+		}
 	}
 	return contents.Err()
 }
 
-var errInvalidLine = errors.New("invalid line")
+var (
+	errInvalidLine = errors.New("invalid line")
+	errBadURL      = errors.New("invalid URL")
+	errBadInt      = errors.New("invalid int")
+)
+
+func rejectReason(err error) string {
+	switch err {
+	case errBadURL:
+		return metrics.ReasonBadURL
+	case errBadInt:
+		return metrics.ReasonBadInt
+	}
+	return metrics.ReasonInvalidLine
+}
 
+// parseLine sends parsed line to c. Error is returned if line is rejected,
+// errBadURL and errBadInt lines are still accounted for, as other traffic
+// and with zeroes in place of invalid values respectively. Requests of
+// anything but playback are other traffic too, but are not rejected.
 func parseLine(line string, c chan VideoStat) error {
 	toks := strings.Split(line, "\t")
 	// glog.Infof("Parsing line:%s", line)
@@ -358,60 +965,88 @@ func parseLine(line string, c chan VideoStat) error {
 		return errInvalidLine
 	}
 
-	date := toks[0]
+	tm, err := time.Parse("2006-01-02 15:04:05", toks[0]+" "+toks[1])
+	if err != nil {
+		glog.V(common.VERBOSE).Infof("Warning: invalid date=%q time=%q line=%q", toks[0], toks[1], line)
+		return errInvalidLine
+	}
 	fileSize := toks[7]
 	csBytes := toks[8]
 	scBytes := toks[9]
 	url := toks[14]
-	// add hour
-	date += strings.Split(toks[1], ":")[0]
 
-	streamId, streamType, err := utils.GetStreamId(url)
+	pu, err := utils.ParseURL(url)
 	if err != nil {
-		glog.V(common.VVERBOSE).Infof("Warning: invalid URL format: '%s'. line=%q", url, line)
-		scBytesInt, err := strconv.ParseInt(scBytes, 10, 64)
-		if err != nil {
-			return errInvalidLine
+		glog.V(common.VVERBOSE).Infof("Warning: not a playback URL: '%s'. line=%q err=%v", url, line, err)
+		scBytesInt, perr := strconv.ParseInt(scBytes, 10, 64)
+		if perr != nil {
+			return errBadInt
 		}
 		c <- VideoStat{
 			httpCode: "other",
 			ScBytes:  scBytesInt,
 		}
-		return nil
+		if errors.Is(err, utils.ErrNotPlaybackURL) {
+			// valid request of something else, like favicon.ico
+			return nil
+		}
+		return errBadURL
 	}
 
-	if date == "" || streamId == "" {
+	if pu.ID == "" {
 		glog.Warningf("Warning: Invalid line: %s", line)
 	}
 
+	var badInt bool
 	csBytesInt, err := strconv.ParseInt(csBytes, 10, 64)
 	if err != nil {
 		glog.Warningf("Error: invalid int conversion format: '%s'", csBytes)
+		badInt = true
 	}
 
 	scBytesInt, err := strconv.ParseInt(scBytes, 10, 64)
 	if err != nil {
 		glog.Warningf("Error: invalid int conversion format: '%s'", scBytes)
+		badInt = true
 	}
 
 	fileSizeInt, err := strconv.ParseInt(fileSize, 10, 64)
 	if err != nil {
 		glog.Warningf("Error: invalid int conversion format: '%s'", fileSize)
+		badInt = true
 	}
 	var tempVideoStat VideoStat
 	tempVideoStat.IP = toks[3]
+	tempVideoStat.userAgent = toks[6]
+	tempVideoStat.referer = utils.RefererHost(toks[5])
+	tempVideoStat.sessionID = utils.SessionID(toks[13])
+	tempVideoStat.edge = toks[10]
+	tempVideoStat.timeTaken = -1
+	if timeTaken, err := strconv.ParseFloat(toks[11], 64); err == nil {
+		tempVideoStat.timeTaken = timeTaken * 1000
+	}
+	tempVideoStat.cache = utils.ParseCacheStatus(toks[15], toks[16])
 	tempVideoStat.Filesize = fileSizeInt
 	tempVideoStat.CsBytes = csBytesInt
 	tempVideoStat.ScBytes = scBytesInt
-	tempVideoStat.date = date
-	tempVideoStat.streamId = streamId
-	tempVideoStat.itemType = streamType
+	tempVideoStat.tm = tm
+	tempVideoStat.streamId = pu.ID
+	tempVideoStat.itemType = pu.IDType
+	tempVideoStat.rendition = pu.Rendition
+	tempVideoStat.kind = pu.Kind
 	tempVideoStat.httpCode = toks[12]
+	if pu.Kind == utils.SegmentKindSegment && strings.HasPrefix(tempVideoStat.httpCode, "2") {
+		tempVideoStat.watchTime = utils.SegmentDuration(toks[13], url)
+		tempVideoStat.segment = url
+	}
 	// if tempVideoStat.httpCode == "-" {
 	// 	glog.Infof("==============> %q", line)
 	// }
 
 	c <- tempVideoStat
+	if badInt {
+		return errBadInt
+	}
 	return nil
 }
 
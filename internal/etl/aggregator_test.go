@@ -1,10 +1,14 @@
 package etl
 
 import (
+	"fmt"
 	"strings"
 	"testing"
 	"time"
 
+	"github.com/livepeer/cdn-log-puller/internal/geo"
+	"github.com/livepeer/cdn-log-puller/internal/rollup"
+	"github.com/livepeer/cdn-log-puller/internal/sketch"
 	"github.com/livepeer/cdn-log-puller/internal/utils"
 	"github.com/stretchr/testify/assert"
 	"golang.org/x/net/context"
@@ -34,7 +38,7 @@ func TestParseLine(t *testing.T) {
 	assert.Equal("499", vs.httpCode)
 	assert.Equal(utils.IDTypeManifestID, vs.itemType)
 	assert.Equal(int64(0), vs.ScBytes)
-	assert.Equal("2021-11-1716", vs.date)
+	assert.Equal(time.Date(2021, 11, 17, 16, 47, 16, 0, time.UTC), vs.tm)
 	err = parseLine(lines[1], datac)
 	if !assert.NoError(err) {
 		return
@@ -44,7 +48,7 @@ func TestParseLine(t *testing.T) {
 	assert.Equal("200", vs.httpCode)
 	assert.Equal(utils.IDTypeManifestID, vs.itemType)
 	assert.Equal(int64(74134), vs.ScBytes)
-	assert.Equal("2021-11-1716", vs.date)
+	assert.Equal(time.Date(2021, 11, 17, 16, 47, 17, 0, time.UTC), vs.tm)
 	err = parseLine(lines[3], datac)
 	if !assert.NoError(err) {
 		return
@@ -54,7 +58,7 @@ func TestParseLine(t *testing.T) {
 	assert.Equal("200", vs.httpCode)
 	assert.Equal(utils.IDTypeManifestID, vs.itemType)
 	assert.Equal(int64(20029), vs.ScBytes)
-	assert.Equal("2021-11-1720", vs.date)
+	assert.Equal(time.Date(2021, 11, 17, 20, 49, 4, 0, time.UTC), vs.tm)
 }
 
 func TestAggregation(t *testing.T) {
@@ -63,7 +67,7 @@ func TestAggregation(t *testing.T) {
 	lines := strings.Split(testLines, "\n")
 	datac := make(chan VideoStat, len(lines))
 	ctx, cancel := context.WithCancel(context.Background())
-	agg := newAggregator(ctx, nil, "bucket", "", "")
+	agg := newAggregator(ctx, nil)
 
 	doneChan := make(chan struct{})
 
@@ -110,3 +114,266 @@ func TestAggregation(t *testing.T) {
 
 	cancel()
 }
+
+func TestAggregationGranularities(t *testing.T) {
+	assert := assert.New(t)
+	grans, err := rollup.ParseList("5m,1h,1d")
+	if !assert.NoError(err) {
+		return
+	}
+	datac := make(chan VideoStat, 10)
+	agg := newAggregator(context.Background(), nil)
+	agg.granularities = grans
+	doneChan := make(chan struct{})
+	go agg.incomingDataLoop(doneChan, datac)
+	for _, line := range strings.Split(strings.TrimSpace(testLines), "\n") {
+		assert.NoError(parseLine(line, datac))
+	}
+	close(datac)
+	<-doneChan
+
+	res := agg.flatten("test-region", time.Now(), "test.file.name")
+	var got []string
+	for _, sd := range res {
+		got = append(got, fmt.Sprintf("%s %s %d", sd.Granularity, time.Unix(sd.Date, 0).UTC().Format("15:04"), sd.Data[0].Count))
+	}
+	assert.Equal([]string{"5m 16:45 3", "5m 20:40 1", "5m 20:45 1", "1h 16:00 3", "1h 20:00 2", "1d 00:00 5"}, got)
+}
+
+func TestAggregationBreakdowns(t *testing.T) {
+	assert := assert.New(t)
+	datac := make(chan VideoStat, 10)
+	agg := newAggregator(context.Background(), nil)
+	agg.withRenditions = true
+	agg.withClasses = true
+	agg.statusCodes = StatusCodesExact
+	doneChan := make(chan struct{})
+	go agg.incomingDataLoop(doneChan, datac)
+	for _, line := range strings.Split(strings.TrimSpace(testLines), "\n") {
+		assert.NoError(parseLine(line, datac))
+	}
+	close(datac)
+	<-doneChan
+
+	res := agg.flatten("test-region", time.Now(), "test.file.name")
+	if !assert.Len(res, 2) {
+		return
+	}
+	assert.Equal([]*RenditionStats{
+		{Rendition: "0", UniqueUsers: 1, TotalFilesize: 10484, TotalCsBytes: 756, TotalScBytes: 11929, Count: 1, WatchTimeMs: 500},
+		{Rendition: "5", UniqueUsers: 1, TotalFilesize: 18584, TotalCsBytes: 777, TotalScBytes: 20029, Count: 1, WatchTimeMs: 500},
+	}, res[1].Data[0].Renditions)
+	assert.Len(res[0].Data[0].Renditions, 1)
+	assert.Equal([]*RequestClassStats{
+		{Class: "segment", TotalFilesize: 72756 + 81780, TotalCsBytes: 736 * 3, TotalScBytes: 74134 + 83205, Count: 3},
+	}, res[0].Data[0].RequestClasses)
+	// aborted request is still counted in the totals
+	assert.Equal(3, res[0].Data[0].Count)
+	assert.Equal([]*StatusStats{
+		{Status: "200", TotalFilesize: 72756 + 81780, TotalCsBytes: 736 * 2, TotalScBytes: 74134 + 83205, Count: 2},
+		{Status: "499", TotalCsBytes: 736, Count: 1},
+	}, res[0].Data[0].Statuses)
+
+	assert.Equal("2xx", statusClass("206"))
+	assert.Equal("4xx", statusClass("499"))
+	assert.Equal("-", statusClass("-"))
+}
+
+func TestWatchTime(t *testing.T) {
+	assert := assert.New(t)
+	lines := strings.Split(strings.TrimSpace(testLines), "\n")
+	// the same segment requested again by the same client
+	lines = append(lines, lines[1])
+	watchTime := func(perIP bool) []int64 {
+		datac := make(chan VideoStat, 10)
+		agg := newAggregator(context.Background(), nil)
+		agg.watchTimePerIP = perIP
+		doneChan := make(chan struct{})
+		go agg.incomingDataLoop(doneChan, datac)
+		for _, line := range lines {
+			assert.NoError(parseLine(line, datac))
+		}
+		close(datac)
+		<-doneChan
+		var res []int64
+		for _, sd := range agg.flatten("test-region", time.Now(), "test.file.name") {
+			res = append(res, sd.Data[0].WatchTimeMs)
+		}
+		return res
+	}
+	// 499 response is not counted
+	assert.Equal([]int64{6000, 1000}, watchTime(false))
+	assert.Equal([]int64{4000, 1000}, watchTime(true))
+}
+
+func TestAggregationCache(t *testing.T) {
+	assert := assert.New(t)
+	lines := strings.Split(strings.TrimSpace(testLines), "\n")
+	lines[1] = strings.TrimSuffix(lines[1], "\t-\t-") + "\tMISS\t-"
+	lines[2] = strings.TrimSuffix(lines[2], "\t-\t-") + "\t-\tTCP_HIT"
+	datac := make(chan VideoStat, 10)
+	agg := newAggregator(context.Background(), nil)
+	agg.withCache = true
+	doneChan := make(chan struct{})
+	go agg.incomingDataLoop(doneChan, datac)
+	for _, line := range lines {
+		assert.NoError(parseLine(line, datac))
+	}
+	close(datac)
+	<-doneChan
+
+	res := agg.flatten("test-region", time.Now(), "test.file.name")
+	if !assert.Len(res, 2) {
+		return
+	}
+	expected := &CacheStats{Hits: 1, Misses: 1, HitRatio: 0.5, OriginBytes: 72756}
+	assert.Equal(expected, res[0].Data[0].Cache)
+	assert.Equal(expected, res[0].Cache)
+	assert.Equal([]*EdgeStats{
+		{Edge: "151.139.34.195", CacheStats: &CacheStats{Hits: 1, HitRatio: 1}},
+		{Edge: "151.139.34.203", CacheStats: &CacheStats{Misses: 1, OriginBytes: 72756}},
+	}, res[0].Edges)
+	// lines without cache status
+	assert.Equal(&CacheStats{}, res[1].Data[0].Cache)
+	assert.Equal(expected, agg.cacheTotal.withRatio())
+}
+
+func TestAggregationLatency(t *testing.T) {
+	assert := assert.New(t)
+	datac := make(chan VideoStat, 10)
+	agg := newAggregator(context.Background(), nil)
+	agg.withLatency = true
+	agg.withSketches = true
+	doneChan := make(chan struct{})
+	go agg.incomingDataLoop(doneChan, datac)
+	for _, line := range strings.Split(strings.TrimSpace(testLines), "\n") {
+		assert.NoError(parseLine(line, datac))
+	}
+	close(datac)
+	<-doneChan
+
+	res := agg.flatten("test-region", time.Now(), "test.file.name")
+	if !assert.Len(res, 2) {
+		return
+	}
+	latency := res[0].Data[0].Latency
+	assert.InEpsilon(784, latency.P50Ms, 0.01)
+	assert.InEpsilon(784, latency.P90Ms, 0.01)
+	q, err := sketch.DecodeQuantiles(latency.Sketch)
+	if assert.NoError(err) {
+		assert.Equal(uint64(3), q.Count())
+		assert.InEpsilon(2147, q.Quantile(1), 0.01)
+	}
+	assert.InEpsilon(784, res[0].Latency.P50Ms, 0.01)
+	if assert.Len(res[0].Edges, 2) {
+		assert.Nil(res[0].Edges[0].CacheStats)
+		assert.InEpsilon(542, res[0].Edges[1].Latency.P50Ms, 0.01)
+	}
+}
+
+type fakeLocator map[string]geo.Location
+
+func (l fakeLocator) Locate(ip string) geo.Location {
+	return l[ip]
+}
+
+func TestAggregationGeo(t *testing.T) {
+	assert := assert.New(t)
+	datac := make(chan VideoStat, 10)
+	agg := newAggregator(context.Background(), nil)
+	agg.geo = fakeLocator{
+		"104.28.131.0": {Country: "US", City: "Chicago", ASN: 13335, ASOrg: "CLOUDFLARENET"},
+	}
+	agg.geoFields = []string{geo.FieldCountry, geo.FieldASN}
+	doneChan := make(chan struct{})
+	go agg.incomingDataLoop(doneChan, datac)
+	for _, line := range strings.Split(strings.TrimSpace(testLines), "\n") {
+		assert.NoError(parseLine(line, datac))
+	}
+	close(datac)
+	<-doneChan
+
+	res := agg.flatten("test-region", time.Now(), "test.file.name")
+	if !assert.Len(res, 2) {
+		return
+	}
+	assert.Equal([]*GeoStats{
+		{Country: "US", ASN: 13335, ASOrg: "CLOUDFLARENET", UniqueUsers: 1, TotalFilesize: 72756 + 81780, TotalCsBytes: 736 * 3, TotalScBytes: 74134 + 83205, Count: 3, WatchTimeMs: 4000},
+	}, res[0].Data[0].Geo)
+	// not found location is kept, so breakdown adds up to the totals
+	if assert.Len(res[1].Data[0].Geo, 1) {
+		assert.Equal("", res[1].Data[0].Geo[0].Country)
+		assert.Equal(res[1].Data[0].Count, res[1].Data[0].Geo[0].Count)
+	}
+}
+
+func TestAggregationUserAgents(t *testing.T) {
+	assert := assert.New(t)
+	lines := strings.Split(strings.TrimSpace(testLines), "\n")
+	bot := strings.Split(lines[1], "\t")
+	bot[3] = "66.249.66.1"
+	bot[6] = "Mozilla/5.0 (compatible; Googlebot/2.1; +http://www.google.com/bot.html)"
+	lines = append(lines, strings.Join(bot, "\t"))
+
+	datac := make(chan VideoStat, 10)
+	agg := newAggregator(context.Background(), nil)
+	agg.withUserAgents = true
+	agg.excludeBots = true
+	doneChan := make(chan struct{})
+	go agg.incomingDataLoop(doneChan, datac)
+	for _, line := range lines {
+		assert.NoError(parseLine(line, datac))
+	}
+	close(datac)
+	<-doneChan
+
+	res := agg.flatten("test-region", time.Now(), "test.file.name")
+	if !assert.Len(res, 2) {
+		return
+	}
+	stats := res[0].Data[0]
+	// bot adds only to the bytes
+	assert.Equal(1, stats.UniqueUsers)
+	assert.Equal(3, stats.Count)
+	assert.Equal(int64(4000), stats.WatchTimeMs)
+	assert.Equal(int64(74134*2+83205), stats.TotalScBytes)
+	assert.Equal([]*UserAgentStats{
+		{Device: "bot", OS: "other", Player: "other", Bot: true, UniqueUsers: 1, TotalFilesize: 72756, TotalCsBytes: 736, TotalScBytes: 74134, Count: 1, WatchTimeMs: 2000},
+		{Device: "desktop", OS: "macos", Player: "safari", UniqueUsers: 1, TotalFilesize: 72756 + 81780, TotalCsBytes: 736 * 3, TotalScBytes: 74134 + 83205, Count: 3, WatchTimeMs: 4000},
+	}, stats.UserAgents)
+}
+
+func TestAggregationReferers(t *testing.T) {
+	assert := assert.New(t)
+	lines := strings.Split(strings.TrimSpace(testLines), "\n")
+	hotlink := strings.Split(lines[1], "\t")
+	hotlink[3] = "66.249.66.1"
+	hotlink[5] = "https://www.hotlinker.example/live"
+	lines = append(lines, strings.Join(hotlink, "\t"))
+
+	datac := make(chan VideoStat, 10)
+	agg := newAggregator(context.Background(), nil)
+	agg.topReferers = 1
+	doneChan := make(chan struct{})
+	go agg.incomingDataLoop(doneChan, datac)
+	for _, line := range lines {
+		assert.NoError(parseLine(line, datac))
+	}
+	close(datac)
+	<-doneChan
+
+	res := agg.flatten("test-region", time.Now(), "test.file.name")
+	if !assert.Len(res, 2) {
+		return
+	}
+	assert.Equal([]*RefererStats{
+		{Host: "cdn.livepeer.monster", UniqueUsers: 1, TotalFilesize: 72756 + 81780, TotalCsBytes: 736 * 3, TotalScBytes: 74134 + 83205, Count: 3},
+	}, res[0].Data[0].Referers)
+
+	agg.topReferers = 10
+	res = agg.flatten("test-region", time.Now(), "test.file.name")
+	if assert.Len(res[0].Data[0].Referers, 2) {
+		assert.Equal("hotlinker.example", res[0].Data[0].Referers[1].Host)
+		assert.Equal(1, res[0].Data[0].Referers[1].Count)
+	}
+}
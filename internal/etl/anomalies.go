@@ -0,0 +1,88 @@
+package etl
+
+import (
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/livepeer/cdn-log-puller/internal/anomaly"
+	"github.com/livepeer/cdn-log-puller/internal/sketch"
+)
+
+// number of client IPs tracked for each stream, any client with more than
+// that fraction of the stream's bytes is found
+const anomalyClientsTracked = 16
+
+// anomalyData is the traffic of the stream in the processed hour, for the anomaly detector
+type anomalyData struct {
+	bytes        int64
+	requests     int64
+	users        *sketch.Uniques
+	clientErrors int64
+	serverErrors int64
+	clients      *sketch.TopK // bytes by client IP
+}
+
+func (ag *aggregator) addAnomalyData(vs *VideoStat) {
+	key := streamKey(vs)
+	ad := ag.anomalies[key]
+	if ad == nil {
+		ad = &anomalyData{users: sketch.New(), clients: sketch.NewTopK(anomalyClientsTracked)}
+		ag.anomalies[key] = ad
+	}
+	ad.bytes += vs.ScBytes
+	ad.requests++
+	ad.users.Add(vs.IP)
+	ad.clients.Add(vs.IP, vs.ScBytes)
+	switch {
+	case strings.HasPrefix(vs.httpCode, "4"):
+		ad.clientErrors++
+	case strings.HasPrefix(vs.httpCode, "5"):
+		ad.serverErrors++
+	}
+}
+
+// anomalySamples returns traffic of each stream in all the lines of the hour's files
+func (ag *aggregator) anomalySamples(region string, hour time.Time) []anomaly.Sample {
+	keys := make([]string, 0, len(ag.anomalies))
+	for key := range ag.anomalies {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	res := make([]anomaly.Sample, 0, len(keys))
+	for _, key := range keys {
+		ad := ag.anomalies[key]
+		s := anomaly.Sample{
+			Region:       region,
+			Hour:         hour,
+			Bytes:        ad.bytes,
+			Requests:     ad.requests,
+			Uniques:      int64(ad.users.Count()),
+			ClientErrors: ad.clientErrors,
+			ServerErrors: ad.serverErrors,
+		}
+		s.StreamID, s.PlaybackID = splitStreamKey(key)
+		if top := ad.clients.Top(1); len(top) > 0 {
+			s.TopClient, s.TopClientBytes = top[0].Key, top[0].Count
+		}
+		res = append(res, s)
+	}
+	return res
+}
+
+// checkAnomalies passes traffic of the hour to the anomaly detector, if enabled
+func (etl *Etl) checkAnomalies(region string, hour time.Time, agg *aggregator) error {
+	if etl.anomalies == nil {
+		return nil
+	}
+	found, err := etl.anomalies.Check(agg.anomalySamples(region, hour))
+	if err != nil {
+		glog.Errorf("Error writing anomalies region=%s hour=%s err=%v", region, hour, err)
+		return err
+	}
+	if len(found) > 0 {
+		glog.Warningf("Found %d anomalies region=%s hour=%s", len(found), region, hour)
+	}
+	return nil
+}
@@ -0,0 +1,281 @@
+package etl
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/livepeer/cdn-log-puller/internal/common"
+	"github.com/livepeer/cdn-log-puller/internal/metrics"
+)
+
+// ErrCircuitOpen is returned without contacting the API after too many
+// consecutive failures, until cooldown period passes
+var ErrCircuitOpen = errors.New("livepeer API circuit breaker is open")
+
+// longest Retry-After we agree to wait for
+const maxRetryAfter = 5 * time.Minute
+
+type (
+	// APIError is returned when the API responds with unexpected status code
+	APIError struct {
+		Method     string
+		Path       string
+		StatusCode int
+		Body       string
+	}
+
+	APIClientOptions struct {
+		// MaxRetries is the number of attempts made after the first failed one
+		MaxRetries int
+		// MinBackoff is the delay before the first retry, it is doubled on each
+		// next one up to MaxBackoff. Actual delay is randomized by up to a half.
+		// Negative MinBackoff makes retries go without delay (unless the API
+		// asks for it with Retry-After).
+		MinBackoff time.Duration
+		MaxBackoff time.Duration
+		// BreakerThreshold is the number of consecutive failed calls (each
+		// with all its retries) after which the API is not called for
+		// BreakerCooldown. Zero disables the breaker.
+		BreakerThreshold int
+		BreakerCooldown  time.Duration
+		// IdempotencyKeys tells that the API honours Idempotency-Key header,
+		// so POSTs carrying it can be retried after network errors and 5xx
+		IdempotencyKeys bool
+		HTTPClient      *http.Client
+	}
+
+	// APIClient calls Livepeer API, retrying on network errors, 429 and 5xx
+	// responses. POSTs are not idempotent, so they are retried only on 429
+	// unless sent with idempotency key the API honours. It is shared by the
+	// API sink and the etl, so they trip the same circuit breaker.
+	APIClient struct {
+		key     string
+		baseUrl string
+		opts    APIClientOptions
+
+		mu        sync.Mutex
+		failures  int
+		openUntil time.Time
+	}
+)
+
+// DefaultAPIClientOptions are recommended settings, zero durations
+// passed to NewAPIClient are taken from here
+var DefaultAPIClientOptions = APIClientOptions{
+	MaxRetries:       5,
+	MinBackoff:       time.Second,
+	MaxBackoff:       time.Minute,
+	BreakerThreshold: 5,
+	BreakerCooldown:  5 * time.Minute,
+}
+
+func (ae *APIError) Error() string {
+	return fmt.Sprintf("livepeer API %s %s status=%d body=%q", ae.Method, ae.Path, ae.StatusCode, ae.Body)
+}
+
+// Unwrap makes errors.Is(err, ErrForbidden) work for 403 responses
+func (ae *APIError) Unwrap() error {
+	if ae.StatusCode == http.StatusForbidden {
+		return ErrForbidden
+	}
+	return nil
+}
+
+func (ae *APIError) temporary() bool {
+	return ae.StatusCode == http.StatusTooManyRequests || ae.StatusCode >= 500
+}
+
+func NewAPIClient(key string, apiUrl *url.URL, opts APIClientOptions) *APIClient {
+	if opts.MaxBackoff == 0 {
+		opts.MaxBackoff = DefaultAPIClientOptions.MaxBackoff
+	}
+	if opts.MinBackoff == 0 {
+		opts.MinBackoff = DefaultAPIClientOptions.MinBackoff
+	}
+	if opts.BreakerCooldown == 0 {
+		opts.BreakerCooldown = DefaultAPIClientOptions.BreakerCooldown
+	}
+	if opts.HTTPClient == nil {
+		opts.HTTPClient = defaultHTTPClient
+	}
+	return &APIClient{
+		key:     key,
+		baseUrl: apiBaseUrl(apiUrl),
+		opts:    opts,
+	}
+}
+
+// Do makes request to the API and returns status code and body of the
+// 2xx response. Other responses are returned as *APIError.
+func (ac *APIClient) Do(ctx context.Context, method, path string, body []byte) (int, []byte, error) {
+	return ac.call(ctx, method, path, body, "")
+}
+
+// Post makes POST request to the API. With non-empty idempotencyKey the request
+// is sent with Idempotency-Key header, so it can be safely retried if the API
+// honours it (see APIClientOptions.IdempotencyKeys).
+func (ac *APIClient) Post(ctx context.Context, path string, body []byte, idempotencyKey string) (int, []byte, error) {
+	return ac.call(ctx, "POST", path, body, idempotencyKey)
+}
+
+func (ac *APIClient) call(ctx context.Context, method, path string, body []byte, idempotencyKey string) (int, []byte, error) {
+	status, resp, err := ac.do(ctx, method, path, body, idempotencyKey)
+	if err != nil {
+		metrics.APIErrors.WithLabelValues(method).Inc()
+	}
+	return status, resp, err
+}
+
+func (ac *APIClient) do(ctx context.Context, method, path string, body []byte, idempotencyKey string) (int, []byte, error) {
+	if !ac.allow() {
+		return 0, nil, ErrCircuitOpen
+	}
+	idempotent := method != "POST" || (idempotencyKey != "" && ac.opts.IdempotencyKeys)
+	for attempt := 0; ; attempt++ {
+		status, resp, retryAfter, err := ac.doOnce(ctx, method, path, body, idempotencyKey)
+		if err == nil {
+			ac.report(true)
+			return status, resp, nil
+		}
+		if ctx.Err() != nil {
+			return status, nil, err
+		}
+		var ae *APIError
+		if errors.As(err, &ae) && !ae.temporary() {
+			// API is up, so the call does not count as failure
+			ac.report(true)
+			return status, nil, err
+		}
+		// request might have been processed, except when it was throttled
+		throttled := ae != nil && ae.StatusCode == http.StatusTooManyRequests
+		if attempt >= ac.opts.MaxRetries || !(idempotent || throttled) {
+			ac.report(false)
+			return status, nil, err
+		}
+		delay := ac.backoff(attempt)
+		if retryAfter > delay {
+			delay = retryAfter
+		}
+		glog.Warningf("Livepeer API call failed, retrying method=%s path=%s attempt=%d delay=%s err=%v", method, path, attempt+1, delay, err)
+		select {
+		case <-ctx.Done():
+			return 0, nil, ctx.Err()
+		case <-time.After(delay):
+		}
+	}
+}
+
+func (ac *APIClient) doOnce(ctx context.Context, method, path string, body []byte, idempotencyKey string) (int, []byte, time.Duration, error) {
+	req, err := http.NewRequestWithContext(ctx, method, ac.baseUrl+path, bytes.NewReader(body))
+	if err != nil {
+		return 0, nil, 0, err
+	}
+	req.Header.Add("Authorization", "Bearer "+ac.key)
+	req.Header.Add("Content-Type", "application/json")
+	if idempotencyKey != "" {
+		req.Header.Add("Idempotency-Key", idempotencyKey)
+	}
+	started := time.Now()
+	resp, err := ac.opts.HTTPClient.Do(req)
+	if err != nil {
+		metrics.APIDuration.WithLabelValues(method, "error").Observe(time.Since(started).Seconds())
+		return 0, nil, 0, err
+	}
+	metrics.APIDuration.WithLabelValues(method, strconv.Itoa(resp.StatusCode)).Observe(time.Since(started).Seconds())
+	defer resp.Body.Close()
+	bin, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return resp.StatusCode, nil, 0, err
+	}
+	glog.V(common.VERBOSE).Infof("Livepeer API response method=%s path=%s status=%d body=%s", method, path, resp.StatusCode, string(bin))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		var retryAfter time.Duration
+		if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusServiceUnavailable {
+			retryAfter = parseRetryAfter(resp.Header.Get("Retry-After"), time.Now())
+		}
+		return resp.StatusCode, nil, retryAfter, &APIError{Method: method, Path: path, StatusCode: resp.StatusCode, Body: string(bin)}
+	}
+	return resp.StatusCode, bin, 0, nil
+}
+
+// backoff returns exponential delay for the attempt with jitter
+func (ac *APIClient) backoff(attempt int) time.Duration {
+	if ac.opts.MinBackoff < 0 {
+		return 0
+	}
+	d := ac.opts.MinBackoff
+	for i := 0; i < attempt && d < ac.opts.MaxBackoff; i++ {
+		d *= 2
+	}
+	if d > ac.opts.MaxBackoff {
+		d = ac.opts.MaxBackoff
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// parseRetryAfter understands both delay in seconds and HTTP date
+func parseRetryAfter(value string, now time.Time) time.Duration {
+	if value == "" {
+		return 0
+	}
+	var d time.Duration
+	if secs, err := strconv.Atoi(value); err == nil {
+		d = time.Duration(secs) * time.Second
+	} else if tm, err := http.ParseTime(value); err == nil {
+		d = tm.Sub(now)
+	}
+	if d < 0 {
+		return 0
+	}
+	if d > maxRetryAfter {
+		return maxRetryAfter
+	}
+	return d
+}
+
+// allow reports if the call can be made. Once cooldown is over one call is
+// let through, and the breaker is closed if it succeeds.
+func (ac *APIClient) allow() bool {
+	if ac.opts.BreakerThreshold <= 0 {
+		return true
+	}
+	ac.mu.Lock()
+	defer ac.mu.Unlock()
+	now := time.Now()
+	if now.Before(ac.openUntil) {
+		return false
+	}
+	if ac.failures >= ac.opts.BreakerThreshold {
+		// half-open, block others until the result of this call is known
+		ac.openUntil = now.Add(ac.opts.BreakerCooldown)
+	}
+	return true
+}
+
+func (ac *APIClient) report(success bool) {
+	if ac.opts.BreakerThreshold <= 0 {
+		return
+	}
+	ac.mu.Lock()
+	defer ac.mu.Unlock()
+	if success {
+		ac.failures = 0
+		ac.openUntil = time.Time{}
+		return
+	}
+	ac.failures++
+	if ac.failures >= ac.opts.BreakerThreshold {
+		glog.Errorf("Livepeer API failed %d times in a row, not calling it for %s", ac.failures, ac.opts.BreakerCooldown)
+		ac.openUntil = time.Now().Add(ac.opts.BreakerCooldown)
+	}
+}
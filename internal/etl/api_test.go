@@ -0,0 +1,151 @@
+package etl
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestAPIClient(t *testing.T, handler http.HandlerFunc, opts APIClientOptions) *APIClient {
+	ts := httptest.NewServer(handler)
+	t.Cleanup(ts.Close)
+	apiUrl, _ := url.Parse(ts.URL)
+	opts.MinBackoff = time.Millisecond
+	opts.MaxBackoff = 4 * time.Millisecond
+	return NewAPIClient("key", apiUrl, opts)
+}
+
+func TestAPIClientRetries(t *testing.T) {
+	assert := assert.New(t)
+	var calls int32
+	api := newTestAPIClient(t, func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&calls, 1)
+		assert.Equal("Bearer key", r.Header.Get("Authorization"))
+		switch n {
+		case 1:
+			w.WriteHeader(http.StatusBadGateway)
+		case 2:
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(http.StatusTooManyRequests)
+		default:
+			w.Write([]byte("ok"))
+		}
+	}, APIClientOptions{MaxRetries: 3})
+
+	status, body, err := api.Do(context.Background(), "GET", "/api/cdn-data/region/test", nil)
+	assert.NoError(err)
+	assert.Equal(http.StatusOK, status)
+	assert.Equal("ok", string(body))
+	assert.Equal(int32(3), atomic.LoadInt32(&calls))
+
+	// not retried
+	atomic.StoreInt32(&calls, 0)
+	api = newTestAPIClient(t, func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.WriteHeader(http.StatusForbidden)
+	}, APIClientOptions{MaxRetries: 3})
+	_, _, err = api.Do(context.Background(), "GET", "/api/cdn-data/region/test", nil)
+	assert.True(errors.Is(err, ErrForbidden))
+	var ae *APIError
+	if assert.True(errors.As(err, &ae)) {
+		assert.Equal(http.StatusForbidden, ae.StatusCode)
+	}
+	assert.Equal(int32(1), atomic.LoadInt32(&calls))
+}
+
+func TestAPIClientRetriesPost(t *testing.T) {
+	assert := assert.New(t)
+	var calls int32
+	var keys []string
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&calls, 1)
+		keys = append(keys, r.Header.Get("Idempotency-Key"))
+		switch n {
+		case 1:
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(http.StatusTooManyRequests)
+		case 2:
+			w.WriteHeader(http.StatusBadGateway)
+		default:
+			w.Write([]byte("ok"))
+		}
+	}
+
+	// throttled post is retried, failed one might have been applied
+	api := newTestAPIClient(t, handler, APIClientOptions{MaxRetries: 3})
+	_, _, err := api.Post(context.Background(), "/api/cdn-data", []byte("[]"), "key1")
+	var ae *APIError
+	if assert.True(errors.As(err, &ae)) {
+		assert.Equal(http.StatusBadGateway, ae.StatusCode)
+	}
+	assert.Equal(int32(2), atomic.LoadInt32(&calls))
+
+	atomic.StoreInt32(&calls, 0)
+	keys = nil
+	api = newTestAPIClient(t, handler, APIClientOptions{MaxRetries: 3, IdempotencyKeys: true})
+	_, body, err := api.Post(context.Background(), "/api/cdn-data", []byte("[]"), "key1")
+	assert.NoError(err)
+	assert.Equal("ok", string(body))
+	assert.Equal([]string{"key1", "key1", "key1"}, keys)
+
+	// no key, so not retried even if the API honours them
+	atomic.StoreInt32(&calls, 0)
+	_, _, err = api.Post(context.Background(), "/api/cdn-data", []byte("[]"), "")
+	assert.Error(err)
+	assert.Equal(int32(2), atomic.LoadInt32(&calls))
+}
+
+func TestAPIClientNoBackoff(t *testing.T) {
+	assert := assert.New(t)
+	api := NewAPIClient("key", nil, APIClientOptions{MinBackoff: -1})
+	assert.Equal(time.Duration(0), api.backoff(3))
+	api = NewAPIClient("key", nil, APIClientOptions{})
+	assert.Equal(DefaultAPIClientOptions.MinBackoff, api.opts.MinBackoff)
+}
+
+func TestAPIClientCircuitBreaker(t *testing.T) {
+	assert := assert.New(t)
+	var calls int32
+	var failing int32 = 1
+	api := newTestAPIClient(t, func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		if atomic.LoadInt32(&failing) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}, APIClientOptions{MaxRetries: 1, BreakerThreshold: 2, BreakerCooldown: 50 * time.Millisecond})
+
+	for i := 0; i < 2; i++ {
+		_, _, err := api.Do(context.Background(), "GET", "/", nil)
+		var ae *APIError
+		assert.True(errors.As(err, &ae))
+	}
+	assert.Equal(int32(4), atomic.LoadInt32(&calls))
+	_, _, err := api.Do(context.Background(), "GET", "/", nil)
+	assert.Equal(ErrCircuitOpen, err)
+	assert.Equal(int32(4), atomic.LoadInt32(&calls))
+
+	time.Sleep(60 * time.Millisecond)
+	atomic.StoreInt32(&failing, 0)
+	_, _, err = api.Do(context.Background(), "GET", "/", nil)
+	assert.NoError(err)
+	_, _, err = api.Do(context.Background(), "GET", "/", nil)
+	assert.NoError(err)
+	assert.Equal(int32(6), atomic.LoadInt32(&calls))
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	assert := assert.New(t)
+	now := time.Date(2021, 11, 17, 16, 0, 0, 0, time.UTC)
+	assert.Equal(time.Duration(0), parseRetryAfter("", now))
+	assert.Equal(3*time.Second, parseRetryAfter("3", now))
+	assert.Equal(10*time.Second, parseRetryAfter("Wed, 17 Nov 2021 16:00:10 GMT", now))
+	assert.Equal(maxRetryAfter, parseRetryAfter("86400", now))
+	assert.Equal(time.Duration(0), parseRetryAfter("garbage", now))
+}
@@ -0,0 +1,149 @@
+package etl
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// ErrBackfillNotSupported is returned if backfill is run with the Livepeer API sink,
+// which tracks the last processed file on its own and would be moved back
+var ErrBackfillNotSupported = errors.New("livepeer API sink does not support backfill")
+
+// ErrReplaceLongBuckets is returned if backfill with replace is run with granularities
+// longer than an hour: such buckets hold data of the hours outside of the range too
+var ErrReplaceLongBuckets = errors.New("replace is not supported with granularities longer than an hour")
+
+// Backfill reprocesses logs of the region for the hours in [from, to) range.
+// Only data for the dates inside the range is sent to the sink, lines of the
+// neighbouring hours found in the files are covered by the regular processing.
+// If replace is set, data already stored by the sink for each date is replaced
+// (on first occurrence of the date) instead of being added to. Replace works
+// only with hourly and shorter buckets, longer ones can't be rebuilt from the
+// hours in range. Batches are committed to the checkpoint store as by the regular
+// processing, so without replace data already sent is skipped. Checkpoint is
+// never moved back. Sessions, if enabled, are written for all the lines found
+// in the files (except in dry run).
+func (etl *Etl) Backfill(region string, from, to time.Time, replace bool) error {
+	siteHash := etl.siteHashByRegion(region)
+	if siteHash == "" {
+		return fmt.Errorf("region %s is invalid", region)
+	}
+	from = from.Truncate(aggregationDuration)
+	if !from.Before(to) {
+		return fmt.Errorf("invalid time range from=%s to=%s", from, to)
+	}
+	var replacer Replacer
+	if replace {
+		for _, g := range etl.rollups {
+			if g.Exceeds(aggregationDuration) {
+				return ErrReplaceLongBuckets
+			}
+		}
+	}
+	if replace && etl.dryRun == nil {
+		var ok bool
+		if replacer, ok = etl.sink.(Replacer); !ok {
+			return ErrReplaceNotSupported
+		}
+	}
+	if _, ok := etl.sink.(*apiSink); ok && etl.dryRun == nil {
+		return ErrBackfillNotSupported
+	}
+	glog.Infof("Start backfill for hash=%s region=%s from=%s to=%s replace=%v", siteHash, region, from, to, replace)
+	type bucketKey struct {
+		granularity string
+		date        int64
+	}
+	replaced := make(map[bucketKey]bool)
+	for hour := from; hour.Before(to); hour = hour.Add(aggregationDuration) {
+		if etl.stopped() {
+			return ErrStopped
+		}
+		agg, fileNames, err := etl.extractHour(siteHash, hour, "")
+		if err == errEmpty {
+			if err = etl.sessions.FlushRegion(region, hour.Add(aggregationDuration)); err != nil {
+				return err
+			}
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if etl.dryRun != nil {
+			if err = etl.writeDryRunReport(siteHash, hour, fileNames, agg); err != nil {
+				return err
+			}
+			continue
+		}
+		if err = etl.sessions.FlushRegion(region, hour.Add(aggregationDuration)); err != nil {
+			return err
+		}
+		if err = etl.checkAnomalies(region, hour, agg); err != nil {
+			return err
+		}
+		if len(agg.data) == 0 {
+			continue
+		}
+		lastFile := fileNames[len(fileNames)-1]
+		var inRange []*SendData
+		for _, sd := range agg.flatten(region, hour, lastFile) {
+			date := time.Unix(sd.Date, 0)
+			if date.Before(from) || !date.Before(to) {
+				glog.Infof("Skipping data for date=%s outside of backfill range region=%s", date.UTC(), region)
+				continue
+			}
+			inRange = append(inRange, sd)
+		}
+		if len(inRange) == 0 {
+			continue
+		}
+		batchIDs := setBatchIDs(inRange, fileNames[0], lastFile)
+		var toAdd, toReplace []*SendData
+		if replacer == nil {
+			if toAdd, err = etl.filterCommitted(inRange); err != nil {
+				return err
+			}
+		} else {
+			for _, sd := range inRange {
+				key := bucketKey{sd.Granularity, sd.Date}
+				if !replaced[key] {
+					replaced[key] = true
+					toReplace = append(toReplace, sd)
+					continue
+				}
+				// bucket was deleted earlier in this backfill, so the batch
+				// has to be added even if it was applied before
+				sd.BatchID = ""
+				toAdd = append(toAdd, sd)
+			}
+		}
+		if len(toReplace) > 0 {
+			if err = replacer.Replace(toReplace); err != nil {
+				glog.Errorf("Error replacing data in sink region=%s hour=%s err=%v", region, hour, err)
+				return err
+			}
+		}
+		if len(toAdd) > 0 {
+			if err = etl.send(toAdd); err != nil {
+				glog.Errorf("Error sending data to sink region=%s hour=%s err=%v", region, hour, err)
+				return err
+			}
+		}
+		if err = etl.saveCheckpoint(siteHash, hour, lastFile, batchIDs); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (etl *Etl) siteHashByRegion(region string) string {
+	for siteHash, name := range etl.cfg.Names {
+		if name == region {
+			return siteHash
+		}
+	}
+	return ""
+}
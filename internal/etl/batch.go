@@ -0,0 +1,82 @@
+package etl
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strconv"
+
+	"github.com/golang/glog"
+	"github.com/livepeer/cdn-log-puller/internal/rollup"
+)
+
+const (
+	// ReplaySkip makes Etl drop batches that were already committed
+	ReplaySkip = "skip"
+	// ReplayResend makes Etl send committed batches again marked as
+	// replacement of the batch with the same ID
+	ReplayResend = "resend"
+)
+
+// batchID is derived from region, date, granularity and the range of files data was
+// computed from, so reprocessing of the same files always yields the same ID
+func batchID(region string, date int64, granularity, firstFile, lastFile string) string {
+	h := sha256.New()
+	parts := []string{region, strconv.FormatInt(date, 10), firstFile, lastFile}
+	if granularity != "" && granularity != rollup.Hourly.String() {
+		// hourly batches keep IDs they had before granularities were introduced
+		parts = append(parts, granularity)
+	}
+	for _, part := range parts {
+		h.Write([]byte(part))
+		h.Write([]byte{0})
+	}
+	return hex.EncodeToString(h.Sum(nil)[:16])
+}
+
+func setBatchIDs(data []*SendData, firstFile, lastFile string) []string {
+	ids := make([]string, 0, len(data))
+	for _, sd := range data {
+		sd.BatchID = batchID(sd.Region, sd.Date, sd.Granularity, firstFile, lastFile)
+		ids = append(ids, sd.BatchID)
+	}
+	return ids
+}
+
+// idempotencyKey identifies the set of batches sent in one request,
+// it is empty if any of them has no ID
+func idempotencyKey(data []*SendData) string {
+	h := sha256.New()
+	for _, sd := range data {
+		if sd.BatchID == "" {
+			return ""
+		}
+		h.Write([]byte(sd.BatchID))
+		h.Write([]byte{0})
+	}
+	return hex.EncodeToString(h.Sum(nil)[:16])
+}
+
+// filterCommitted removes batches already recorded in the checkpoint store
+// (or marks them as replacements if replay policy is to resend)
+func (etl *Etl) filterCommitted(data []*SendData) ([]*SendData, error) {
+	if etl.checkpoints == nil {
+		return data, nil
+	}
+	filtered := data[:0]
+	for _, sd := range data {
+		committed, err := etl.checkpoints.IsCommitted(sd.BatchID)
+		if err != nil {
+			return nil, err
+		}
+		if committed {
+			if etl.onReplay != ReplayResend {
+				glog.Infof("Skipping already committed batch=%s region=%s date=%d", sd.BatchID, sd.Region, sd.Date)
+				continue
+			}
+			glog.Infof("Resending already committed batch=%s region=%s date=%d", sd.BatchID, sd.Region, sd.Date)
+			sd.Replace = true
+		}
+		filtered = append(filtered, sd)
+	}
+	return filtered, nil
+}
@@ -0,0 +1,241 @@
+package etl
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	_ "github.com/lib/pq"
+)
+
+type (
+	// Checkpoint records the last fully processed file and hour of the site
+	Checkpoint struct {
+		SiteHash string    `json:"site_hash"`
+		Region   string    `json:"region"`
+		FileName string    `json:"file_name"`
+		Hour     time.Time `json:"hour"`
+		Updated  time.Time `json:"updated"`
+	}
+
+	// CheckpointStore keeps processing progress, so etl can be resumed
+	// without querying Livepeer API, and IDs of the batches sent to the sink
+	CheckpointStore interface {
+		// Get returns nil if there is no checkpoint for the site
+		Get(siteHash string) (*Checkpoint, error)
+		// Save stores checkpoint and marks batches as committed at once
+		Save(cp *Checkpoint, batchIDs []string) error
+		IsCommitted(batchID string) (bool, error)
+		Close() error
+	}
+
+	// fileCheckpointStore keeps checkpoints of all the sites in one JSON file
+	fileCheckpointStore struct {
+		mu   sync.Mutex
+		name string
+		data checkpointsFile
+	}
+
+	checkpointsFile struct {
+		Checkpoints map[string]*Checkpoint `json:"checkpoints"`
+		// maps batch ID to the time it was committed
+		Batches map[string]time.Time `json:"batches"`
+	}
+
+	pgCheckpointStore struct {
+		db *sql.DB
+	}
+)
+
+// committed batch IDs are kept in the file store for this long
+const batchesRetention = 30 * 24 * time.Hour
+
+// NewCheckpointStore creates PostgreSQL store if uri is postgres:// URL,
+// otherwise uri is treated as the name of JSON file
+func NewCheckpointStore(uri string) (CheckpointStore, error) {
+	if strings.HasPrefix(uri, "postgres://") || strings.HasPrefix(uri, "postgresql://") {
+		return NewPostgresCheckpointStore(uri)
+	}
+	return NewFileCheckpointStore(uri)
+}
+
+// NewFileCheckpointStore loads checkpoints from the file, file is
+// created on first save if it does not exist
+func NewFileCheckpointStore(fileName string) (CheckpointStore, error) {
+	fs := &fileCheckpointStore{name: fileName}
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	if err == nil {
+		if err = json.Unmarshal(data, &fs.data); err != nil {
+			return nil, err
+		}
+	}
+	if fs.data.Checkpoints == nil {
+		fs.data.Checkpoints = make(map[string]*Checkpoint)
+	}
+	if fs.data.Batches == nil {
+		fs.data.Batches = make(map[string]time.Time)
+	}
+	return fs, nil
+}
+
+func (fs *fileCheckpointStore) Get(siteHash string) (*Checkpoint, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if cp, ok := fs.data.Checkpoints[siteHash]; ok {
+		cpc := *cp
+		return &cpc, nil
+	}
+	return nil, nil
+}
+
+func (fs *fileCheckpointStore) IsCommitted(batchID string) (bool, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	_, ok := fs.data.Batches[batchID]
+	return ok, nil
+}
+
+// Save writes all the checkpoints into temporary file and renames it,
+// so file is never left half-written
+func (fs *fileCheckpointStore) Save(cp *Checkpoint, batchIDs []string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	now := time.Now().UTC()
+	cpc := *cp
+	cpc.Updated = now
+	fs.data.Checkpoints[cp.SiteHash] = &cpc
+	for id, committed := range fs.data.Batches {
+		if now.Sub(committed) > batchesRetention {
+			delete(fs.data.Batches, id)
+		}
+	}
+	for _, id := range batchIDs {
+		fs.data.Batches[id] = now
+	}
+	data, err := json.MarshalIndent(&fs.data, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(fs.name), filepath.Base(fs.name)+".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err = tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), fs.name)
+}
+
+func (fs *fileCheckpointStore) Close() error {
+	return nil
+}
+
+const (
+	pgCreateCheckpointsTable = `CREATE TABLE IF NOT EXISTS cdn_etl_checkpoints (
+		site_hash text PRIMARY KEY,
+		region text,
+		file_name text,
+		hour timestamptz,
+		updated_at timestamptz
+	);`
+
+	pgSelectCheckpoint = `SELECT region, file_name, hour, updated_at FROM cdn_etl_checkpoints WHERE site_hash = $1;`
+
+	pgUpsertCheckpoint = `INSERT INTO cdn_etl_checkpoints (site_hash, region, file_name, hour, updated_at)
+		VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (site_hash) DO UPDATE
+		SET region = EXCLUDED.region,
+			file_name = EXCLUDED.file_name,
+			hour = EXCLUDED.hour,
+			updated_at = EXCLUDED.updated_at;`
+
+	pgCreateBatchesTable = `CREATE TABLE IF NOT EXISTS cdn_etl_batches (
+		batch_id text PRIMARY KEY,
+		site_hash text,
+		committed_at timestamptz
+	);`
+
+	pgSelectBatch = `SELECT 1 FROM cdn_etl_batches WHERE batch_id = $1;`
+
+	pgInsertBatch = `INSERT INTO cdn_etl_batches (batch_id, site_hash, committed_at)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (batch_id) DO NOTHING;`
+)
+
+// NewPostgresCheckpointStore connects to the database and creates table if needed
+func NewPostgresCheckpointStore(dsn string) (CheckpointStore, error) {
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		return nil, err
+	}
+	if err = db.Ping(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	for _, query := range []string{pgCreateCheckpointsTable, pgCreateBatchesTable} {
+		if _, err = db.Exec(query); err != nil {
+			db.Close()
+			return nil, err
+		}
+	}
+	return &pgCheckpointStore{db: db}, nil
+}
+
+func (ps *pgCheckpointStore) Get(siteHash string) (*Checkpoint, error) {
+	cp := &Checkpoint{SiteHash: siteHash}
+	err := ps.db.QueryRow(pgSelectCheckpoint, siteHash).Scan(&cp.Region, &cp.FileName, &cp.Hour, &cp.Updated)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return cp, nil
+}
+
+func (ps *pgCheckpointStore) IsCommitted(batchID string) (bool, error) {
+	var one int
+	err := ps.db.QueryRow(pgSelectBatch, batchID).Scan(&one)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (ps *pgCheckpointStore) Save(cp *Checkpoint, batchIDs []string) error {
+	now := time.Now().UTC()
+	tx, err := ps.db.Begin()
+	if err != nil {
+		return err
+	}
+	if _, err = tx.Exec(pgUpsertCheckpoint, cp.SiteHash, cp.Region, cp.FileName, cp.Hour, now); err != nil {
+		tx.Rollback()
+		return err
+	}
+	for _, id := range batchIDs {
+		if _, err = tx.Exec(pgInsertBatch, id, cp.SiteHash, now); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (ps *pgCheckpointStore) Close() error {
+	return ps.db.Close()
+}
@@ -0,0 +1,170 @@
+package etl
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFileCheckpointStore(t *testing.T) {
+	assert := assert.New(t)
+	fileName := filepath.Join(t.TempDir(), "checkpoints.json")
+	store, err := NewCheckpointStore(fileName)
+	if !assert.NoError(err) {
+		return
+	}
+	cp, err := store.Get(testSiteHash)
+	assert.NoError(err)
+	assert.Nil(cp)
+
+	hour := time.Date(2021, 11, 17, 16, 0, 0, 0, time.UTC)
+	err = store.Save(&Checkpoint{SiteHash: testSiteHash, Region: "test-region", FileName: "file1", Hour: hour}, []string{"batch1"})
+	assert.NoError(err)
+
+	// reopen to check that checkpoint is persisted
+	store, err = NewCheckpointStore(fileName)
+	if !assert.NoError(err) {
+		return
+	}
+	cp, err = store.Get(testSiteHash)
+	assert.NoError(err)
+	if assert.NotNil(cp) {
+		assert.Equal("file1", cp.FileName)
+		assert.Equal("test-region", cp.Region)
+		assert.True(hour.Equal(cp.Hour))
+		assert.False(cp.Updated.IsZero())
+	}
+	committed, err := store.IsCommitted("batch1")
+	assert.NoError(err)
+	assert.True(committed)
+	committed, err = store.IsCommitted("batch2")
+	assert.NoError(err)
+	assert.False(committed)
+}
+
+func TestEtlUsesCheckpoints(t *testing.T) {
+	assert := assert.New(t)
+	dir := t.TempDir()
+	store, err := NewFileCheckpointStore(filepath.Join(dir, "checkpoints.json"))
+	if !assert.NoError(err) {
+		return
+	}
+	sink, err := NewFileSink(filepath.Join(dir, "out.jsonl"))
+	if !assert.NoError(err) {
+		return
+	}
+	defer sink.Close()
+	etli := newTestEtlWithSink(t, sink, Options{Staging: true, Checkpoints: store})
+
+	hour := time.Date(2021, 11, 17, 16, 0, 0, 0, time.UTC)
+	assert.NoError(etli.doEtlHour(testSiteHash, hour, ""))
+	cp, err := store.Get(testSiteHash)
+	assert.NoError(err)
+	if assert.NotNil(cp) {
+		assert.Equal(testSiteHash+"/cds/2021/11/17/cds_20211117-164716-27664444008dc2.log.gz", cp.FileName)
+	}
+
+	startHour, startFile, err := etli.getStartHour(testSiteHash, "test-region")
+	assert.NoError(err)
+	assert.Equal(cp.FileName, startFile)
+	assert.True(hour.Equal(startHour))
+}
+
+func TestFileSinkSkipsWrittenBatches(t *testing.T) {
+	assert := assert.New(t)
+	fileName := filepath.Join(t.TempDir(), "out.jsonl")
+	sink, err := NewFileSink(fileName)
+	if !assert.NoError(err) {
+		return
+	}
+	assert.NoError(sink.Send([]*SendData{{Region: "test-region", BatchID: "a"}}))
+	assert.NoError(sink.Close())
+
+	// as if the process died after sending but before saving the checkpoint
+	sink, err = NewFileSink(fileName)
+	if !assert.NoError(err) {
+		return
+	}
+	assert.NoError(sink.Send([]*SendData{{Region: "test-region", BatchID: "a"}, {Region: "test-region", BatchID: "b"}}))
+	assert.NoError(sink.Send([]*SendData{{Region: "test-region", BatchID: "b"}, {Region: "test-region", BatchID: "a", Replace: true}}))
+	assert.NoError(sink.Close())
+
+	data, err := ioutil.ReadFile(fileName)
+	if !assert.NoError(err) {
+		return
+	}
+	var ids []string
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		sd := &SendData{}
+		assert.NoError(json.Unmarshal([]byte(line), sd))
+		ids = append(ids, sd.BatchID)
+	}
+	assert.Equal([]string{"a", "b", "a"}, ids)
+}
+
+type failingWriter struct{}
+
+func (failingWriter) Write(p []byte) (int, error) {
+	return 0, errors.New("disk full")
+}
+
+func TestFileSinkRetriesFailedBatches(t *testing.T) {
+	assert := assert.New(t)
+	js := &jsonSink{w: bufio.NewWriter(failingWriter{}), batches: make(map[string]bool)}
+	data := []*SendData{{Region: "test-region", BatchID: "a"}, {Region: "test-region", BatchID: "a"}}
+	assert.Error(js.Send(data))
+	assert.Empty(js.batches)
+
+	var buf bytes.Buffer
+	js.w = bufio.NewWriter(&buf)
+	assert.NoError(js.Send(data))
+	assert.Equal(1, strings.Count(buf.String(), "\n"))
+	assert.True(js.batches["a"])
+}
+
+func TestEtlSkipsReplayedHour(t *testing.T) {
+	assert := assert.New(t)
+	dir := t.TempDir()
+	store, err := NewFileCheckpointStore(filepath.Join(dir, "checkpoints.json"))
+	if !assert.NoError(err) {
+		return
+	}
+	fileName := filepath.Join(dir, "out.jsonl")
+	sink, err := NewFileSink(fileName)
+	if !assert.NoError(err) {
+		return
+	}
+	etli := newTestEtlWithSink(t, sink, Options{Staging: true, Checkpoints: store})
+
+	hour := time.Date(2021, 11, 17, 16, 0, 0, 0, time.UTC)
+	assert.NoError(etli.doEtlHour(testSiteHash, hour, ""))
+	// same hour processed again, as if the process died before moving on
+	assert.NoError(etli.doEtlHour(testSiteHash, hour, ""))
+	etli.onReplay = ReplayResend
+	assert.NoError(etli.doEtlHour(testSiteHash, hour, ""))
+	assert.NoError(sink.Close())
+
+	data, err := ioutil.ReadFile(fileName)
+	if !assert.NoError(err) {
+		return
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if !assert.Len(lines, 4) {
+		return
+	}
+	var first, resent SendData
+	assert.NoError(json.Unmarshal([]byte(lines[0]), &first))
+	assert.NoError(json.Unmarshal([]byte(lines[2]), &resent))
+	assert.NotEmpty(first.BatchID)
+	assert.Equal(first.BatchID, resent.BatchID)
+	assert.False(first.Replace)
+	assert.True(resent.Replace)
+}
@@ -0,0 +1,66 @@
+package etl
+
+import (
+	"errors"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// ErrStopped is returned when processing is interrupted by Stop
+var ErrStopped = errors.New("etl stopped")
+
+// Stop makes etl return after the hour being processed is finished. Only if
+// the API honours idempotency keys, pending post to it is cancelled, as the
+// hour sent again on the next run is not counted twice then. Safe to call from
+// signal handler goroutine, more than once.
+func (etl *Etl) Stop() {
+	etl.stopOnce.Do(func() {
+		close(etl.stop)
+		if etl.api != nil && etl.api.opts.IdempotencyKeys {
+			etl.cancelSend()
+		}
+	})
+}
+
+func (etl *Etl) stopped() bool {
+	select {
+	case <-etl.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+// Daemon runs Do every interval until Stop is called. Passes never overlap,
+// if pass takes longer than interval the next one is started right after it.
+// Errors of the pass are logged and processing is retried on the next pass,
+// only ErrForbidden stops the daemon.
+func (etl *Etl) Daemon(interval time.Duration) error {
+	for pass := 1; ; pass++ {
+		start := time.Now()
+		glog.Infof("Starting etl pass=%d", pass)
+		err := etl.Do()
+		if errors.Is(err, ErrForbidden) {
+			return err
+		}
+		if err != nil && err != ErrStopped {
+			glog.Errorf("Error in etl pass=%d err=%v", pass, err)
+		}
+		if etl.stopped() {
+			glog.Infof("Etl daemon stopped after pass=%d", pass)
+			return nil
+		}
+		wait := interval - time.Since(start)
+		glog.Infof("Finished etl pass=%d in %s, next pass in %s", pass, time.Since(start), wait)
+		if wait <= 0 {
+			continue
+		}
+		select {
+		case <-etl.stop:
+			glog.Infof("Etl daemon stopped after pass=%d", pass)
+			return nil
+		case <-time.After(wait):
+		}
+	}
+}
@@ -0,0 +1,42 @@
+package etl
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/livepeer/cdn-log-puller/internal/anomaly"
+)
+
+// dryRunReport describes what would be sent to the sink for one processed hour
+type dryRunReport struct {
+	SiteHash     string      `json:"site_hash"`
+	Region       string      `json:"region"`
+	Hour         time.Time   `json:"hour"`
+	Files        int         `json:"files"`
+	FirstFile    string      `json:"first_file"`
+	LastFile     string      `json:"last_file"`
+	OtherTraffic int64       `json:"other_traffic"`
+	Data         []*SendData `json:"data"`
+	// Anomalies are found against the current baselines, which are left as is
+	Anomalies []*anomaly.Anomaly `json:"anomalies,omitempty"`
+}
+
+func (etl *Etl) writeDryRunReport(siteHash string, startHour time.Time, fileNames []string, agg *aggregator) error {
+	regionName := etl.cfg.Names[siteHash]
+	report := &dryRunReport{
+		SiteHash:     siteHash,
+		Region:       regionName,
+		Hour:         startHour,
+		Files:        len(fileNames),
+		FirstFile:    fileNames[0],
+		LastFile:     fileNames[len(fileNames)-1],
+		OtherTraffic: agg.otherTraffic,
+	}
+	if etl.anomalies != nil {
+		report.Anomalies = etl.anomalies.Evaluate(agg.anomalySamples(regionName, startHour))
+	}
+	if len(agg.data) > 0 {
+		report.Data = agg.flatten(regionName, startHour, report.LastFile)
+	}
+	return json.NewEncoder(etl.dryRun).Encode(report)
+}
@@ -7,19 +7,24 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"io/ioutil"
+	"io"
 	"net/http"
-	"net/url"
 	"path/filepath"
 	"strings"
+	"sync"
 	"time"
 
-	"cloud.google.com/go/storage"
 	"github.com/golang/glog"
+	"github.com/livepeer/cdn-log-puller/internal/anomaly"
 	"github.com/livepeer/cdn-log-puller/internal/common"
 	"github.com/livepeer/cdn-log-puller/internal/config"
-	"google.golang.org/api/iterator"
-	"google.golang.org/api/option"
+	"github.com/livepeer/cdn-log-puller/internal/geo"
+	"github.com/livepeer/cdn-log-puller/internal/metrics"
+	"github.com/livepeer/cdn-log-puller/internal/quarantine"
+	"github.com/livepeer/cdn-log-puller/internal/rollup"
+	"github.com/livepeer/cdn-log-puller/internal/session"
+	"github.com/livepeer/cdn-log-puller/internal/source"
+	"github.com/livepeer/cdn-log-puller/internal/utils"
 )
 
 var (
@@ -27,64 +32,188 @@ var (
 )
 
 const (
+	// files are processed hour by hour, data is bucketed by Options.Granularities
 	aggregationDuration = time.Hour
 	numParralelReaders  = 10
+
+	// StatusCodesCollapse counts all responses in the totals of the stream only
+	StatusCodesCollapse = "collapse"
+	// StatusCodesClass adds breakdown by status class (2xx, 3xx, 4xx, 5xx)
+	StatusCodesClass = "class"
+	// StatusCodesExact adds breakdown by status code
+	StatusCodesExact = "code"
 )
 
 type (
-	// Etl loads CDN usage data from files from GS bucket,
-	// aggregates them by hour and sends to Livepeer API
+	// Etl loads CDN usage data from files from the logs source (GS bucket by default),
+	// aggregates them by hour (or other granularities) and sends to the sink (Livepeer API by default)
 	// to be put into database
 	Etl struct {
-		ctx            context.Context
-		cfg            *config.Config
-		gsClient       *storage.Client
-		bucket         string
-		staging        bool
-		livepeerAPIKey string
-		livepeerAPIUrl string
+		ctx         context.Context
+		cfg         *config.Config
+		src         source.Source
+		sink        Sink
+		checkpoints CheckpointStore
+		onReplay    string
+		dryRun      io.Writer
+		staging     bool
+		api         *APIClient
+		lateness    time.Duration
+		quarantine  *quarantine.Quarantine
+		sketches    bool
+		renditions  bool
+		classes     bool
+		watchPerIP  bool
+		statusCodes string
+		cache       bool
+		latency     bool
+		geo         geo.Locator
+		geoFields   []string
+		userAgents  bool
+		excludeBots bool
+		topReferers int
+		anomalies   *anomaly.Detector
+		rollups     []rollup.Granularity
+		sessions    *session.Sessionizer
+		// passMu guarantees that passes over the regions never overlap
+		passMu   sync.Mutex
+		stop     chan struct{}
+		stopOnce sync.Once
+		// sendCtx is cancelled by Stop if it is safe, so hung sending to the sink is interrupted
+		sendCtx    context.Context
+		cancelSend context.CancelFunc
+	}
+
+	Options struct {
+		// Staging selects regions with `-monster` suffix
+		Staging bool
+		// API is used to get the last processed file from the Livepeer API.
+		// Can be nil if sink is not the API, in that case processing starts
+		// from the first file in the source.
+		API *APIClient
+		// Checkpoints, if set, stores last processed file of each site
+		Checkpoints CheckpointStore
+		// OnReplay tells what to do with batches found to be already committed
+		// in the checkpoint store: ReplaySkip (default) or ReplayResend
+		OnReplay string
+		// Lateness is how long to wait after the end of the hour before processing
+		// it, so logs delivered late by the CDN make it into the hour
+		Lateness time.Duration
+		// Quarantine, if set, records lines rejected by the parser
+		Quarantine *quarantine.Quarantine
+		// Sketches adds sketches of client IPs to the data, so unique users
+		// can be counted over any period by merging them
+		Sketches bool
+		// Renditions adds breakdown by rendition to the data of each stream
+		Renditions bool
+		// RequestClasses adds breakdown by the kind of requested file
+		// (manifest, segment, init, vod) to the data of each stream
+		RequestClasses bool
+		// WatchTimePerIP counts each segment in watch time once per client IP,
+		// so retried and repeated requests don't add to it
+		WatchTimePerIP bool
+		// Cache adds cache hit ratio and bytes fetched from the origin to the
+		// data of each stream, region and edge server
+		Cache bool
+		// Latency adds quantiles of time taken to serve requests to the data
+		// of each stream, region and edge server
+		Latency bool
+		// Geo, if set, adds breakdown by location of the clients to the data
+		// of each stream, grouped by GeoFields (country if empty)
+		Geo       geo.Locator
+		GeoFields []string
+		// UserAgents adds breakdown by device class, OS, player and bot flag
+		UserAgents bool
+		// ExcludeBots keeps requests of bots out of unique users, counts and
+		// watch time of the streams, bytes are still counted
+		ExcludeBots bool
+		// TopReferers adds that many referer hosts with most requests to the
+		// data of each stream, 0 to leave them out
+		TopReferers int
+		// Anomalies, if set, checks traffic of the streams in each processed
+		// hour for spikes, heavy clients and error surges
+		Anomalies *anomaly.Detector
+		// StatusCodes tells if totals are broken down by response status:
+		// StatusCodesCollapse (default), StatusCodesClass or StatusCodesExact.
+		// Totals always include responses of all statuses.
+		StatusCodes string
+		// Granularities are the sizes of the buckets data is aggregated into,
+		// all of them are computed in one pass. Hourly only if empty.
+		Granularities []rollup.Granularity
+		// Sessions, if set, groups requests into playback sessions, separately
+		// for each region. Sessions ended by the end of each processed hour are
+		// written after the hour is sent, the ones still going on are carried
+		// over to the next hour of the region.
+		// Nothing is written in dry run.
+		Sessions *session.Sessionizer
+		// DryRun, if set, makes Etl write computed data and files counts
+		// for each hour to the writer instead of sending it to the sink
+		DryRun io.Writer
 	}
 )
 
 var (
 	errEmpty = errors.New("empty")
+	// ErrGranularityNotSupported is returned if buckets other than hourly
+	// are requested with the Livepeer API sink
+	ErrGranularityNotSupported = errors.New("livepeer API accepts only hourly data")
 )
 
-func NewEtl(ctx context.Context, cfg *config.Config, bucket, credentials string, staging bool,
-	livepeerAPIKey string, livepeerAPIUrl *url.URL) (*Etl, error) {
-
-	var opts []option.ClientOption
-	if credentials != "" {
-		opts = append(opts, option.WithCredentialsFile(credentials))
-	} else {
-		opts = append(opts, option.WithoutAuthentication())
+func NewEtl(ctx context.Context, cfg *config.Config, src source.Source, sink Sink, opts Options) (*Etl, error) {
+	switch opts.StatusCodes {
+	case "", StatusCodesCollapse, StatusCodesClass, StatusCodesExact:
+	default:
+		return nil, fmt.Errorf("invalid status codes breakdown %q", opts.StatusCodes)
 	}
-	client, err := storage.NewClient(ctx, opts...)
-	if err != nil {
-		return nil, fmt.Errorf("storage.NewClient: %v", err)
+	if opts.Geo != nil && len(opts.GeoFields) == 0 {
+		opts.GeoFields = []string{geo.FieldCountry}
+	}
+	if _, ok := sink.(*apiSink); ok && opts.DryRun == nil {
+		for _, g := range opts.Granularities {
+			if g != rollup.Hourly {
+				return nil, ErrGranularityNotSupported
+			}
+		}
 	}
-	// defer client.Close()
 
-	// Check GS access rights
+	// Check source access rights
 	rctx, cancel := context.WithTimeout(ctx, time.Second*5)
 	defer cancel()
 
-	it := client.Bucket(bucket).Objects(rctx, nil)
-	if _, err = it.Next(); err != nil {
+	it := src.List(rctx, nil)
+	if _, err := it.Next(); err != nil {
 		return nil, err
 	}
-	livepeerAPIUrl.Path = ""
-	lau := livepeerAPIUrl.String()
-
 	etl := &Etl{
-		ctx:            ctx,
-		bucket:         bucket,
-		gsClient:       client,
-		cfg:            cfg,
-		staging:        staging,
-		livepeerAPIKey: livepeerAPIKey,
-		livepeerAPIUrl: lau,
-	}
+		ctx:         ctx,
+		src:         src,
+		sink:        sink,
+		checkpoints: opts.Checkpoints,
+		onReplay:    opts.OnReplay,
+		dryRun:      opts.DryRun,
+		cfg:         cfg,
+		staging:     opts.Staging,
+		api:         opts.API,
+		lateness:    opts.Lateness,
+		quarantine:  opts.Quarantine,
+		sketches:    opts.Sketches,
+		renditions:  opts.Renditions,
+		classes:     opts.RequestClasses,
+		watchPerIP:  opts.WatchTimePerIP,
+		statusCodes: opts.StatusCodes,
+		cache:       opts.Cache,
+		latency:     opts.Latency,
+		geo:         opts.Geo,
+		geoFields:   opts.GeoFields,
+		userAgents:  opts.UserAgents,
+		excludeBots: opts.ExcludeBots,
+		topReferers: opts.TopReferers,
+		anomalies:   opts.Anomalies,
+		rollups:     opts.Granularities,
+		sessions:    opts.Sessions,
+		stop:        make(chan struct{}),
+	}
+	etl.sendCtx, etl.cancelSend = context.WithCancel(ctx)
 	return etl, nil
 }
 
@@ -93,9 +222,9 @@ func (etl *Etl) printFile(file string) {
 	fmt.Printf("Printing file %s\n", file)
 	ctx, cancel := context.WithTimeout(context.Background(), time.Second*600)
 	defer cancel()
-	rc, err := etl.gsClient.Bucket(etl.bucket).Object(file).NewReader(ctx)
+	rc, err := etl.src.Open(ctx, file)
 	if err != nil {
-		panic(fmt.Errorf("Object(%q).NewReader: %v", file, err))
+		panic(err)
 	}
 	defer rc.Close()
 
@@ -113,17 +242,19 @@ func (etl *Etl) printFile(file string) {
 }
 
 func (etl *Etl) Do() error {
+	etl.passMu.Lock()
+	defer etl.passMu.Unlock()
 	// list top-level dirs. Each dir corresponds to StackPath's 'site'
-	topDirs, _, err := etl.getGSDirs("/", "")
+	topDirs, _, err := etl.listDirs("/", "")
 	if err != nil {
 		return err
 	}
-	glog.V(common.VVERBOSE).Infof("Got top dirs in GS: %+v", topDirs)
+	glog.V(common.VVERBOSE).Infof("Got top dirs in %s: %+v", etl.src, topDirs)
 	/*
 		glog.Infof("\n%s", strings.Join(topDirs, "\n"))
-		// tempDirs, tempFiles, err := etl.getGSDirs("/", "k3c3y8z2/")
-		// tempDirs, tempFiles, err := etl.getGSDirs("/", "k3c3y8z2/cds/2021/10/24/")
-		tempDirs, tempFiles, err := etl.getGSDirs("/", "t8a6c4p8/cds/2021/10/24/")
+		// tempDirs, tempFiles, err := etl.listDirs("/", "k3c3y8z2/")
+		// tempDirs, tempFiles, err := etl.listDirs("/", "k3c3y8z2/cds/2021/10/24/")
+		tempDirs, tempFiles, err := etl.listDirs("/", "t8a6c4p8/cds/2021/10/24/")
 		glog.Infof("Got temp dirs: %+v", tempDirs)
 		glog.Infof("Got temp files: %+v", tempFiles)
 		if len(tempFiles) > 0 {
@@ -136,6 +267,9 @@ func (etl *Etl) Do() error {
 	*/
 
 	for _, siteHash := range topDirs {
+		if etl.stopped() {
+			return ErrStopped
+		}
 		cleanSiteHash := cleanLastSlash(siteHash)
 		if regionName, ok := etl.cfg.Names[cleanSiteHash]; ok {
 			isStagingRegion := strings.HasSuffix(regionName, "-monster")
@@ -145,10 +279,10 @@ func (etl *Etl) Do() error {
 				continue
 			}
 			glog.Infof("For hash %q found region %q", cleanSiteHash, regionName)
-			// etl.getGSDirs("", siteHash+"cds/")
+			// etl.listDirs("", siteHash+"cds/")
 			startHour, fullFileName, err := etl.getStartHour(cleanSiteHash, regionName)
 			glog.V(common.INSANE).Infof("--> start hour %s startFile=%s", startHour, fullFileName)
-			if err == ErrForbidden {
+			if errors.Is(err, ErrForbidden) {
 				return err
 			}
 
@@ -171,15 +305,22 @@ func (etl *Etl) Do() error {
 }
 
 // doEtl reads logs files that corresponds to startHour, aggregates it and
-// pushes aggreagated data to Livepeer API
+// pushes aggreagated data to the sink
 func (etl *Etl) doEtl(siteHash string, startHour time.Time, startFile string) error {
 	for {
+		if etl.stopped() {
+			return ErrStopped
+		}
 		endHour := startHour.Add(aggregationDuration)
-		if endHour.After(time.Now()) {
+		if endHour.Add(etl.lateness).After(time.Now()) {
 			break
 		}
 		err := etl.doEtlHour(siteHash, startHour, startFile)
-		if err != nil && err != errEmpty {
+		if err == errEmpty {
+			// sessions still open at the end of the previous hour have ended
+			err = etl.sessions.FlushRegion(etl.cfg.Names[siteHash], endHour)
+		}
+		if err != nil {
 			return err
 		}
 		startFile = ""
@@ -190,12 +331,122 @@ func (etl *Etl) doEtl(siteHash string, startHour time.Time, startFile string) er
 }
 
 func (etl *Etl) doEtlHour(siteHash string, startHour time.Time, startFile string) error {
+	regionName := etl.cfg.Names[siteHash]
+	agg, fileNames, err := etl.extractHour(siteHash, startHour, startFile)
+	if err != nil {
+		return err
+	}
+	if etl.dryRun != nil {
+		return etl.writeDryRunReport(siteHash, startHour, fileNames, agg)
+	}
+	lastFile := fileNames[len(fileNames)-1]
+	var batchIDs []string
+	if len(agg.data) > 0 {
+		export := agg.flatten(regionName, startHour, lastFile)
+		batchIDs = setBatchIDs(export, fileNames[0], lastFile)
+		if export, err = etl.filterCommitted(export); err != nil {
+			return err
+		}
+		if len(export) > 0 {
+			if err = etl.send(export); err != nil {
+				glog.Errorf("Error sending data to sink region=%s hour=%s err=%v", regionName, startHour, err)
+				return err
+			}
+		}
+	}
+	// pg and file sinks skip batches they already have, stdout and API sinks
+	// get the hour again if the process dies before the checkpoint is saved
+	if err = etl.saveCheckpoint(siteHash, startHour, lastFile, batchIDs); err != nil {
+		return err
+	}
+	if err = etl.checkAnomalies(regionName, startHour, agg); err != nil {
+		return err
+	}
+	if err = etl.sessions.FlushRegion(regionName, startHour.Add(aggregationDuration)); err != nil {
+		return err
+	}
+	metrics.HourProcessed(regionName, startHour.Add(aggregationDuration))
+	return nil
+}
+
+// send passes data to the sink, with the context cancelled by Stop if the sink supports it
+func (etl *Etl) send(data []*SendData) error {
+	if cs, ok := etl.sink.(ContextSender); ok {
+		return cs.SendContext(etl.sendCtx, data)
+	}
+	return etl.sink.Send(data)
+}
+
+// saveCheckpoint commits batches and moves checkpoint to the lastFile,
+// checkpoint already ahead of it (as on backfill) is kept
+func (etl *Etl) saveCheckpoint(siteHash string, hour time.Time, lastFile string, batchIDs []string) error {
+	if etl.checkpoints == nil {
+		return nil
+	}
+	cp := &Checkpoint{
+		SiteHash: siteHash,
+		Region:   etl.cfg.Names[siteHash],
+		FileName: lastFile,
+		Hour:     hour,
+	}
+	prev, err := etl.checkpoints.Get(siteHash)
+	if err != nil {
+		return err
+	}
+	if prev != nil && prev.FileName > lastFile {
+		cp.FileName, cp.Hour = prev.FileName, prev.Hour
+	}
+	if err := etl.checkpoints.Save(cp, batchIDs); err != nil {
+		glog.Errorf("Error saving checkpoint region=%s hour=%s file=%s err=%v", cp.Region, hour, lastFile, err)
+		return err
+	}
+	return nil
+}
+
+// extractHour reads and aggregates logs files of the hour starting from startHour.
+// If startFile is not empty, files up to and including startFile are skipped.
+func (etl *Etl) extractHour(siteHash string, startHour time.Time, startFile string) (*aggregator, []string, error) {
+	agg := newAggregator(etl.ctx, etl.src)
+	agg.quarantine = etl.quarantine
+	agg.withSketches = etl.sketches
+	agg.withRenditions = etl.renditions
+	agg.withClasses = etl.classes
+	agg.watchTimePerIP = etl.watchPerIP
+	agg.withCache = etl.cache
+	agg.withLatency = etl.latency
+	agg.geo = etl.geo
+	agg.geoFields = etl.geoFields
+	agg.withUserAgents = etl.userAgents
+	agg.excludeBots = etl.excludeBots
+	agg.topReferers = etl.topReferers
+	if etl.statusCodes != StatusCodesCollapse {
+		agg.statusCodes = etl.statusCodes
+	}
+	if etl.dryRun == nil {
+		agg.sessions, agg.region = etl.sessions, etl.cfg.Names[siteHash]
+	}
+	if etl.anomalies != nil {
+		agg.anomalies = make(map[string]*anomalyData)
+	}
+	if len(etl.rollups) > 0 {
+		agg.granularities = etl.rollups
+	}
+	fileNames, err := etl.extractInto(agg, siteHash, startHour, startFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	return agg, fileNames, nil
+}
+
+// extractInto reads logs files of the hour into the aggregator
+func (etl *Etl) extractInto(agg *aggregator, siteHash string, startHour time.Time, startFile string) ([]string, error) {
 	regionName := etl.cfg.Names[siteHash]
 	endHour := startHour.Add(aggregationDuration)
 	started := time.Now()
 	glog.Infof("Start processing data for hash=%s region=%s startHour=%s endHour=%s startFile=%s", siteHash, regionName, startHour, endHour, startFile)
 	// get list of all files that needs to be processed
-	query := storage.Query{
+	query := source.Query{
+		Prefix:    siteHash + "/cds/",
 		EndOffset: constructFileNameFromTime(siteHash, endHour),
 	}
 	if startFile != "" {
@@ -204,9 +455,9 @@ func (etl *Etl) doEtlHour(siteHash string, startHour time.Time, startFile string
 		query.StartOffset = constructFileNameFromTime(siteHash, startHour)
 	}
 	glog.V(common.INSANE).Infof("Query %+v", query)
-	_, fileNames, err := etl.getGSDirsWithQuery(&query, -1)
+	_, fileNames, err := etl.listDirsWithQuery(&query, -1)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	if startFile != "" {
 		if len(fileNames) > 0 && fileNames[0] == startFile {
@@ -216,17 +467,17 @@ func (etl *Etl) doEtlHour(siteHash string, startHour time.Time, startFile string
 	}
 	if len(fileNames) == 0 {
 		glog.Errorf("no logs files found for hash=%s region=%s startHour=%s", siteHash, regionName, startHour)
-		return errEmpty
+		return nil, errEmpty
 	}
 	glog.V(common.INSANE).Infof("Got files=%+v", fileNames)
 	// now check that there is logs files exists in the next hour
 	// (to make sure that all the files for startHour made their was to GS)
 	/*
-		query = storage.Query{
+		query = source.Query{
 			StartOffset: constructFileNameFromTime(siteHash, endHour),
 		}
 		glog.V(common.INSANE).Infof("Query %+v", query)
-		_, endHourFileNames, err := etl.getGSDirsWithQuery(&query, 1)
+		_, endHourFileNames, err := etl.listDirsWithQuery(&query, 1)
 		if err != nil {
 			return err
 		}
@@ -234,8 +485,6 @@ func (etl *Etl) doEtlHour(siteHash string, startHour time.Time, startFile string
 			return fmt.Errorf("no logs files found for hour=%s", endHour)
 		}
 	*/
-	agg := newAggregator(etl.ctx, etl.gsClient, etl.bucket, etl.livepeerAPIKey, etl.livepeerAPIUrl)
-
 	datac := make(chan VideoStat)
 	filesChan := make(chan string, 32)
 	doneChan := make(chan struct{})
@@ -254,19 +503,16 @@ func (etl *Etl) doEtlHour(siteHash string, startHour time.Time, startFile string
 	close(datac)
 	<-doneChan
 	// data processing complete
-	glog.Infof("Extract and transform of bucket=%s region=%s hour=%s complete in %s other traffic=%d bytes.",
-		etl.bucket, regionName, startHour, time.Since(started), agg.otherTraffic)
+	metrics.BytesSent.WithLabelValues(regionName).Add(float64(agg.videoTraffic))
+	metrics.OtherTraffic.WithLabelValues(regionName).Add(float64(agg.otherTraffic))
+	metrics.CacheRequests.WithLabelValues(regionName, string(utils.CacheHit)).Add(float64(agg.cacheTotal.Hits))
+	metrics.CacheRequests.WithLabelValues(regionName, string(utils.CacheMiss)).Add(float64(agg.cacheTotal.Misses))
+	metrics.OriginBytes.WithLabelValues(regionName).Add(float64(agg.cacheTotal.OriginBytes))
+	glog.Infof("Extract and transform of source=%s region=%s hour=%s complete in %s other traffic=%d bytes.",
+		etl.src, regionName, startHour, time.Since(started), agg.otherTraffic)
 	// agg.aggregate(regionName)
 	glog.V(common.DEBUG).Infof("Parsed %d days (%+v)", len(agg.data), agg.data)
-	if len(agg.data) == 0 {
-		return nil
-	}
-	export := agg.flatten(regionName, startHour, fileNames[len(fileNames)-1])
-	if err = agg.postToAPI(export); err != nil {
-		glog.Errorf("Error posting data to api region=%s hour=%s err=%v", regionName, startHour, err)
-	}
-
-	return err
+	return fileNames, nil
 }
 
 func constructFileNameFromTime(siteHash string, tm time.Time) string {
@@ -279,33 +525,14 @@ type regionResp struct {
 }
 
 func (etl *Etl) getFileFromAPI(region string) (string, error) {
-	uri := fmt.Sprintf("%s/api/cdn-data/region/%s", etl.livepeerAPIUrl, region)
-
-	req, err := http.NewRequest("GET", uri, nil)
-	if err != nil {
-		return "", err
-	}
-	req.Header.Add("Authorization", "Bearer "+etl.livepeerAPIKey)
-	req.Header.Add("Content-Type", "application/json")
-	resp, err := defaultHTTPClient.Do(req)
-	if err != nil {
-		return "", err
-	}
-	defer resp.Body.Close()
-	bin, err := ioutil.ReadAll(resp.Body)
+	status, bin, err := etl.api.Do(etl.ctx, "GET", "/api/cdn-data/region/"+region, nil)
 	if err != nil {
 		return "", err
 	}
 	glog.Infof("Get region get response=%s", string(bin))
-	if resp.StatusCode == http.StatusNoContent {
+	if status == http.StatusNoContent {
 		return "", nil
 	}
-	if resp.StatusCode != http.StatusOK {
-		if resp.StatusCode == http.StatusForbidden {
-			return "", ErrForbidden
-		}
-		panic("stop")
-	}
 	rr := &regionResp{}
 	if err = json.Unmarshal(bin, rr); err != nil {
 		return "", err
@@ -313,16 +540,38 @@ func (etl *Etl) getFileFromAPI(region string) (string, error) {
 	return rr.FileName, nil
 }
 
+// getStartHour returns hour and file to resume processing from. Local checkpoint
+// and the file stored in the API are used, whichever is further. If there is
+// none, processing starts from the first file of the site.
 func (etl *Etl) getStartHour(siteHash, regionName string) (time.Time, string, error) {
-	fullFileName, err := etl.getFileFromAPI(regionName)
-	if err != nil {
-		glog.Errorf("Error contacting API err=%v", err)
-		var tz time.Time
-		return tz, "", err
+	var tz time.Time
+	var fullFileName string
+	if etl.checkpoints != nil {
+		cp, err := etl.checkpoints.Get(siteHash)
+		if err != nil {
+			glog.Errorf("Error reading checkpoint for hash=%s err=%v", siteHash, err)
+			return tz, "", err
+		}
+		if cp != nil {
+			glog.V(common.DEBUG).Infof("Got checkpoint for region=%s fileName=%s hour=%s", regionName, cp.FileName, cp.Hour)
+			fullFileName = cp.FileName
+		}
+	}
+	if etl.api != nil {
+		apiFileName, err := etl.getFileFromAPI(regionName)
+		if err != nil && (fullFileName == "" || errors.Is(err, ErrForbidden)) {
+			glog.Errorf("Error contacting API err=%v", err)
+			return tz, "", err
+		}
+		if err != nil {
+			glog.Errorf("Error contacting API, resuming from local checkpoint err=%v", err)
+		} else if apiFileName > fullFileName {
+			fullFileName = apiFileName
+		}
 	}
 	if fullFileName != "" {
 		tm, fileName, err := getTimeFromFullFileName(fullFileName, regionName)
-		glog.V(common.DEBUG).Infof("Got from API for region=%s fileName=%s time=%s", regionName, fileName, tm)
+		glog.V(common.DEBUG).Infof("Resuming region=%s from fileName=%s time=%s", regionName, fileName, tm)
 		// if err != nil {
 		return tm.Truncate(aggregationDuration), fullFileName, err
 		// }
@@ -351,7 +600,7 @@ func getTimeFromFullFileName(fullFileName, siteHash string) (time.Time, string,
 }
 
 func (etl *Etl) getTimestampFromFirstFile(siteHash string) (time.Time, string, error) {
-	_, fns, err := etl.getGSDirsWithLimit("", siteHash+"/cds/", 1)
+	_, fns, err := etl.listDirsWithLimit("", siteHash+"/cds/", 1)
 	rt := time.Now()
 	if err != nil {
 		return rt, "", err
@@ -373,29 +622,29 @@ func (etl *Etl) getTimestampFromFirstFile(siteHash string) (time.Time, string, e
 	return tm, fullFileName, nil
 }
 
-func (etl *Etl) getGSDirs(delimiter, prefix string) ([]string, []string, error) {
-	return etl.getGSDirsWithLimit(delimiter, prefix, -1)
+func (etl *Etl) listDirs(delimiter, prefix string) ([]string, []string, error) {
+	return etl.listDirsWithLimit(delimiter, prefix, -1)
 }
 
-func (etl *Etl) getGSDirsWithLimit(delimiter, prefix string, limit int) ([]string, []string, error) {
-	query := storage.Query{
+func (etl *Etl) listDirsWithLimit(delimiter, prefix string, limit int) ([]string, []string, error) {
+	query := source.Query{
 		Delimiter: delimiter,
 		Prefix:    prefix,
 	}
-	return etl.getGSDirsWithQuery(&query, limit)
+	return etl.listDirsWithQuery(&query, limit)
 }
 
-func (etl *Etl) getGSDirsWithQuery(query *storage.Query, limit int) ([]string, []string, error) {
+func (etl *Etl) listDirsWithQuery(query *source.Query, limit int) ([]string, []string, error) {
 	ctx, cancel := context.WithTimeout(etl.ctx, time.Second*15)
 	// ctx, cancel := context.WithCancel(etl.ctx)
 	defer cancel()
-	it := etl.gsClient.Bucket(etl.bucket).Objects(ctx, query)
+	it := etl.src.List(ctx, query)
 	var dirNames, filesNames []string
 	var count int
 	for {
 		fi, err := it.Next()
 		if err != nil {
-			if err == iterator.Done {
+			if err == source.Done {
 				break
 			}
 			glog.Errorf("Returning err=%v", err)
@@ -0,0 +1,521 @@
+package etl
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/livepeer/cdn-log-puller/internal/anomaly"
+	"github.com/livepeer/cdn-log-puller/internal/config"
+	"github.com/livepeer/cdn-log-puller/internal/quarantine"
+	"github.com/livepeer/cdn-log-puller/internal/rollup"
+	"github.com/livepeer/cdn-log-puller/internal/session"
+	"github.com/livepeer/cdn-log-puller/internal/source"
+	"github.com/livepeer/cdn-log-puller/internal/utils"
+	"github.com/stretchr/testify/assert"
+)
+
+const testSiteHash = "fsdf98f23"
+
+// writeTestLogs puts testLines into gzipped file inside local bucket-like tree
+func writeTestLogs(t *testing.T, root, fileName, lines string) {
+	fullName := filepath.Join(root, filepath.FromSlash(fileName))
+	if err := os.MkdirAll(filepath.Dir(fullName), 0755); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	zw.Write([]byte(lines))
+	zw.Close()
+	if err := ioutil.WriteFile(fullName, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func newTestSource(t *testing.T) source.Source {
+	root := t.TempDir()
+	writeTestLogs(t, root, testSiteHash+"/cds/2021/11/17/cds_20211117-164716-27664444008dc2.log.gz", testLines)
+	writeTestLogs(t, root, testSiteHash+"/cds/2021/11/17/cds_20211117-204356-27664444008dc2.log.gz", testLines)
+	src, err := source.NewLocal(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return src
+}
+
+func newTestEtlWithSink(t *testing.T, sink Sink, opts Options) *Etl {
+	cfg := &config.Config{Names: map[string]string{testSiteHash: "test-region"}}
+	etli, err := NewEtl(context.Background(), cfg, newTestSource(t), sink, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return etli
+}
+
+func newTestEtl(t *testing.T, apiHandler http.HandlerFunc) (*Etl, func()) {
+	ts := httptest.NewServer(apiHandler)
+	apiUrl, _ := url.Parse(ts.URL)
+	api := NewAPIClient("key", apiUrl, APIClientOptions{})
+	opts := Options{Staging: true, API: api}
+	return newTestEtlWithSink(t, NewAPISink(api), opts), ts.Close
+}
+
+func TestEtlHourFromLocalSource(t *testing.T) {
+	assert := assert.New(t)
+	var posted []*SendData
+	etli, stop := newTestEtl(t, func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal("/api/cdn-data", r.URL.Path)
+		assert.Equal("Bearer key", r.Header.Get("Authorization"))
+		body, _ := ioutil.ReadAll(r.Body)
+		assert.NoError(json.Unmarshal(body, &posted))
+	})
+	defer stop()
+
+	startHour := time.Date(2021, 11, 17, 16, 0, 0, 0, time.UTC)
+	err := etli.doEtlHour(testSiteHash, startHour, "")
+	assert.NoError(err)
+	// file contains lines from two different hours
+	assert.Len(posted, 2)
+	for _, sd := range posted {
+		assert.Equal("test-region", sd.Region)
+		assert.Equal(testSiteHash+"/cds/2021/11/17/cds_20211117-164716-27664444008dc2.log.gz", sd.FileName)
+	}
+
+	err = etli.doEtlHour(testSiteHash, startHour.Add(time.Hour), "")
+	assert.Equal(errEmpty, err)
+}
+
+func TestEtlStopFinishesSend(t *testing.T) {
+	assert := assert.New(t)
+	posting, stopped := make(chan struct{}), make(chan struct{})
+	etli, stop := newTestEtl(t, func(w http.ResponseWriter, r *http.Request) {
+		ioutil.ReadAll(r.Body)
+		close(posting)
+		<-stopped
+		w.Write([]byte("ok"))
+	})
+	defer stop()
+	go func() {
+		<-posting
+		etli.Stop()
+		close(stopped)
+	}()
+	// post could be applied twice if it was cancelled
+	startHour := time.Date(2021, 11, 17, 16, 0, 0, 0, time.UTC)
+	assert.NoError(etli.doEtlHour(testSiteHash, startHour, ""))
+}
+
+func TestEtlStopCancelsIdempotentSend(t *testing.T) {
+	assert := assert.New(t)
+	posting := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.NotEmpty(r.Header.Get("Idempotency-Key"))
+		ioutil.ReadAll(r.Body)
+		close(posting)
+		// API hangs until the request is cancelled
+		<-r.Context().Done()
+	}))
+	defer ts.Close()
+	apiUrl, _ := url.Parse(ts.URL)
+	api := NewAPIClient("key", apiUrl, APIClientOptions{IdempotencyKeys: true})
+	etli := newTestEtlWithSink(t, NewAPISink(api), Options{Staging: true, API: api})
+	go func() {
+		<-posting
+		etli.Stop()
+	}()
+	startHour := time.Date(2021, 11, 17, 16, 0, 0, 0, time.UTC)
+	err := etli.doEtlHour(testSiteHash, startHour, "")
+	assert.True(errors.Is(err, context.Canceled), err)
+}
+
+func TestEtlGranularitiesWithAPISink(t *testing.T) {
+	cfg := &config.Config{Names: map[string]string{testSiteHash: "test-region"}}
+	sink := NewAPISink(NewAPIClient("key", nil, APIClientOptions{}))
+	opts := Options{Staging: true, Granularities: []rollup.Granularity{rollup.Hourly, rollup.Daily}}
+	_, err := NewEtl(context.Background(), cfg, newTestSource(t), sink, opts)
+	assert.Equal(t, ErrGranularityNotSupported, err)
+}
+
+func TestEtlInvalidStatusCodes(t *testing.T) {
+	cfg := &config.Config{Names: map[string]string{testSiteHash: "test-region"}}
+	_, err := NewEtl(context.Background(), cfg, newTestSource(t), nil, Options{Staging: true, StatusCodes: "all"})
+	assert.Error(t, err)
+}
+
+func TestEtlHourToFileSink(t *testing.T) {
+	assert := assert.New(t)
+	fileName := filepath.Join(t.TempDir(), "out.jsonl")
+	sink, err := NewFileSink(fileName)
+	if !assert.NoError(err) {
+		return
+	}
+	etli := newTestEtlWithSink(t, sink, Options{Staging: true, Sketches: true})
+
+	startHour := time.Date(2021, 11, 17, 20, 0, 0, 0, time.UTC)
+	assert.NoError(etli.doEtlHour(testSiteHash, startHour, ""))
+	assert.NoError(sink.Close())
+
+	data, err := ioutil.ReadFile(fileName)
+	if !assert.NoError(err) {
+		return
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	assert.Len(lines, 2)
+	sd := &SendData{}
+	assert.NoError(json.Unmarshal([]byte(lines[1]), sd))
+	assert.Equal(int64(1637179200), sd.Date)
+	assert.Equal("test-region", sd.Region)
+	assert.Len(sd.Data, 1)
+	assert.Equal(2, sd.Data[0].Count)
+	assert.NotEmpty(sd.Data[0].UsersSketch)
+}
+
+// memSink keeps all the data sent to it
+type memSink struct {
+	data []*SendData
+}
+
+func (ms *memSink) Send(data []*SendData) error {
+	ms.data = append(ms.data, data...)
+	return nil
+}
+
+func (ms *memSink) Close() error {
+	return nil
+}
+
+func TestSpansHours(t *testing.T) {
+	assert := assert.New(t)
+	assert.False(spansHours(&SendData{}))
+	assert.False(spansHours(&SendData{Granularity: "1h"}))
+	assert.True(spansHours(&SendData{Granularity: "1d"}))
+	assert.True(spansHours(&SendData{Granularity: "1mo"}))
+}
+
+func TestEtlRollupUniqueUsers(t *testing.T) {
+	assert := assert.New(t)
+	line := func(tm, ip string) string {
+		return strings.Join([]string{tm[:10], tm[11:], "GET", ip, "https", "-", "VLC/3.0.16", "72756", "736", "74134",
+			"151.139.34.203", "0.542", "200", "msn=516&dur=2000", "/hls/video+9e70xehvtu637q6p/5/chunk_1031999.ts", "HIT", "-"}, "\t") + "\n"
+	}
+	root := t.TempDir()
+	writeTestLogs(t, root, testSiteHash+"/cds/2021/11/17/cds_20211117-160000-27664444008dc2.log.gz",
+		line("2021-11-17 16:10:00", "1.1.1.1")+line("2021-11-17 16:20:00", "2.2.2.2"))
+	writeTestLogs(t, root, testSiteHash+"/cds/2021/11/17/cds_20211117-170000-27664444008dc2.log.gz",
+		line("2021-11-17 17:10:00", "2.2.2.2")+line("2021-11-17 17:20:00", "3.3.3.3"))
+	src, err := source.NewLocal(root)
+	if !assert.NoError(err) {
+		return
+	}
+	sink := &memSink{}
+	cfg := &config.Config{Names: map[string]string{testSiteHash: "test-region"}}
+	opts := Options{Staging: true, Granularities: []rollup.Granularity{rollup.Hourly, rollup.Daily}}
+	etli, err := NewEtl(context.Background(), cfg, src, sink, opts)
+	if !assert.NoError(err) {
+		return
+	}
+	startHour := time.Date(2021, 11, 17, 16, 0, 0, 0, time.UTC)
+	assert.NoError(etli.doEtlHour(testSiteHash, startHour, ""))
+	assert.NoError(etli.doEtlHour(testSiteHash, startHour.Add(time.Hour), ""))
+
+	// each hour sends its part of the day, merged the way postgres sink does it
+	var stored string
+	var uniques, parts int
+	for _, sd := range sink.data {
+		if sd.Granularity != rollup.Daily.String() {
+			assert.Empty(sd.Data[0].UsersSketch)
+			continue
+		}
+		parts++
+		assert.Equal(2, sd.Data[0].UniqueUsers)
+		stored, uniques, err = mergeUsersSketch(stored, sd.Data[0].UsersSketch)
+		assert.NoError(err)
+	}
+	assert.Equal(2, parts)
+	assert.Equal(3, uniques)
+}
+
+func TestEtlHourDryRun(t *testing.T) {
+	assert := assert.New(t)
+	var out bytes.Buffer
+	etli := newTestEtlWithSink(t, nil, Options{Staging: true, DryRun: &out})
+
+	startHour := time.Date(2021, 11, 17, 16, 0, 0, 0, time.UTC)
+	assert.NoError(etli.doEtlHour(testSiteHash, startHour, ""))
+
+	report := &dryRunReport{}
+	if !assert.NoError(json.Unmarshal(out.Bytes(), report)) {
+		return
+	}
+	assert.Equal("test-region", report.Region)
+	assert.Equal(1, report.Files)
+	assert.True(startHour.Equal(report.Hour))
+	assert.Equal(testSiteHash+"/cds/2021/11/17/cds_20211117-164716-27664444008dc2.log.gz", report.LastFile)
+	assert.Len(report.Data, 2)
+}
+
+func TestEtlSessions(t *testing.T) {
+	assert := assert.New(t)
+	var out bytes.Buffer
+	sessions := session.NewWriter(&out, time.Minute)
+	startHour := time.Date(2021, 11, 17, 16, 0, 0, 0, time.UTC)
+	// dry run has no side effects
+	etli := newTestEtlWithSink(t, nil, Options{Staging: true, Sessions: sessions, DryRun: ioutil.Discard})
+	assert.NoError(etli.doEtlHour(testSiteHash, startHour, ""))
+	assert.NoError(sessions.Flush(startHour.Add(48 * time.Hour)))
+	assert.Empty(out.String())
+
+	etli = newTestEtlWithSink(t, &memSink{}, Options{Staging: true, Sessions: sessions})
+	assert.NoError(etli.doEtlHour(testSiteHash, startHour, ""))
+	// sessions of 20:00 found in the file are not ended yet
+	sess := &session.Session{}
+	assert.NoError(json.Unmarshal(out.Bytes(), sess))
+	assert.Equal("test-region", sess.Region)
+	assert.Equal("9e70xehvtu637q6p", sess.PlaybackID)
+	assert.Equal("104.28.131.0", sess.IP)
+	assert.Equal(3, sess.Segments)
+	assert.Equal(int64(74134+83205), sess.Bytes)
+	assert.Equal([]string{"5"}, sess.Renditions)
+
+	out.Reset()
+	assert.NoError(sessions.Close())
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if assert.Len(lines, 2) {
+		assert.Contains(lines[1], `"session_id":"3405774711"`)
+	}
+}
+
+func TestEtlAnomalies(t *testing.T) {
+	assert := assert.New(t)
+	var out bytes.Buffer
+	detector := anomaly.NewWriter(&out, anomaly.Options{MinRequests: 1, MinClients: 1, ClientShare: 0.5})
+	startHour := time.Date(2021, 11, 17, 16, 0, 0, 0, time.UTC)
+	// dry run only lists anomalies in its report
+	var dry bytes.Buffer
+	etli := newTestEtlWithSink(t, nil, Options{Staging: true, Anomalies: detector, DryRun: &dry})
+	assert.NoError(etli.doEtlHour(testSiteHash, startHour, ""))
+	report := &dryRunReport{}
+	assert.NoError(json.Unmarshal(dry.Bytes(), report))
+	assert.Len(report.Anomalies, 2)
+	assert.Empty(out.String())
+
+	etli = newTestEtlWithSink(t, &memSink{}, Options{Staging: true, Anomalies: detector})
+	assert.NoError(etli.doEtlHour(testSiteHash, startHour, ""))
+	// one of the five requests got 4xx response, and most of the bytes went to one client
+	var found []*anomaly.Anomaly
+	for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+		a := &anomaly.Anomaly{}
+		assert.NoError(json.Unmarshal([]byte(line), a))
+		found = append(found, a)
+	}
+	if !assert.Len(found, 2) {
+		return
+	}
+	assert.Equal(anomaly.KindErrorSurge, found[0].Kind)
+	assert.Equal(anomaly.Metric4xx, found[0].Metric)
+	assert.Equal(0.2, found[0].Value)
+	assert.Equal(anomaly.KindClientShare, found[1].Kind)
+	assert.Equal("test-region", found[1].Region)
+	assert.True(startHour.Equal(found[1].Hour))
+	assert.Equal("9e70xehvtu637q6p", found[1].PlaybackID)
+	assert.Equal("104.28.131.0", found[1].ClientIP)
+	assert.InDelta(float64(74134+83205)/189297, found[1].Value, 0.001)
+}
+
+func TestBackfill(t *testing.T) {
+	assert := assert.New(t)
+	fileName := filepath.Join(t.TempDir(), "out.jsonl")
+	sink, err := NewFileSink(fileName)
+	if !assert.NoError(err) {
+		return
+	}
+	etli := newTestEtlWithSink(t, sink, Options{Staging: true})
+
+	from := time.Date(2021, 11, 17, 16, 30, 0, 0, time.UTC)
+	assert.Error(etli.Backfill("no-such-region", from, from.Add(time.Hour), true))
+	assert.Error(etli.Backfill("test-region", from, from.Add(-time.Hour), true))
+	assert.NoError(etli.Backfill("test-region", from, from.Add(time.Hour), true))
+	assert.NoError(sink.Close())
+
+	data, err := ioutil.ReadFile(fileName)
+	if !assert.NoError(err) {
+		return
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	// data for 20:00 found in 16:00 file is outside of the range
+	assert.Len(lines, 1)
+	sd := &SendData{}
+	assert.NoError(json.Unmarshal([]byte(lines[0]), sd))
+	assert.Equal(int64(1637164800), sd.Date)
+	assert.True(sd.Replace)
+
+	etli = newTestEtlWithSink(t, NewAPISink(NewAPIClient("key", nil, APIClientOptions{})), Options{Staging: true})
+	assert.Equal(ErrReplaceNotSupported, etli.Backfill("test-region", from, from.Add(time.Hour), true))
+	assert.Equal(ErrBackfillNotSupported, etli.Backfill("test-region", from, from.Add(time.Hour), false))
+
+	etli = newTestEtlWithSink(t, sink, Options{Staging: true, Granularities: []rollup.Granularity{rollup.Hourly, rollup.Daily}})
+	assert.Equal(ErrReplaceLongBuckets, etli.Backfill("test-region", from, from.Add(time.Hour), true))
+}
+
+func TestBackfillSkipsCommitted(t *testing.T) {
+	assert := assert.New(t)
+	dir := t.TempDir()
+	store, err := NewFileCheckpointStore(filepath.Join(dir, "checkpoints.json"))
+	if !assert.NoError(err) {
+		return
+	}
+	fileName := filepath.Join(dir, "out.jsonl")
+	sink, err := NewFileSink(fileName)
+	if !assert.NoError(err) {
+		return
+	}
+	etli := newTestEtlWithSink(t, sink, Options{Staging: true, Checkpoints: store})
+	ahead := &Checkpoint{SiteHash: testSiteHash, FileName: testSiteHash + "/cds/2021/11/18/cds_20211118-000000.log.gz"}
+	assert.NoError(store.Save(ahead, nil))
+
+	from := time.Date(2021, 11, 17, 16, 0, 0, 0, time.UTC)
+	assert.NoError(etli.Backfill("test-region", from, from.Add(time.Hour), false))
+	assert.NoError(etli.Backfill("test-region", from, from.Add(time.Hour), false))
+	assert.NoError(sink.Close())
+
+	data, err := ioutil.ReadFile(fileName)
+	if !assert.NoError(err) {
+		return
+	}
+	assert.Len(strings.Split(strings.TrimSpace(string(data)), "\n"), 1)
+	cp, err := store.Get(testSiteHash)
+	assert.NoError(err)
+	if assert.NotNil(cp) {
+		assert.Equal(ahead.FileName, cp.FileName)
+	}
+}
+
+func TestEtlStopAndLateness(t *testing.T) {
+	assert := assert.New(t)
+	fileName := filepath.Join(t.TempDir(), "out.jsonl")
+	sink, err := NewFileSink(fileName)
+	if !assert.NoError(err) {
+		return
+	}
+	defer sink.Close()
+	etli := newTestEtlWithSink(t, sink, Options{Staging: true, Lateness: 100 * 365 * 24 * time.Hour})
+
+	// hour is not settled yet, so nothing is sent
+	startHour := time.Date(2021, 11, 17, 16, 0, 0, 0, time.UTC)
+	assert.NoError(etli.doEtl(testSiteHash, startHour, ""))
+	data, err := ioutil.ReadFile(fileName)
+	assert.NoError(err)
+	assert.Empty(data)
+
+	done := make(chan error)
+	go func() {
+		done <- etli.Daemon(time.Hour)
+	}()
+	etli.Stop()
+	etli.Stop()
+	select {
+	case err = <-done:
+		assert.NoError(err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("daemon did not stop")
+	}
+	assert.Equal(ErrStopped, etli.doEtl(testSiteHash, startHour, ""))
+}
+
+func TestEtlQuarantine(t *testing.T) {
+	assert := assert.New(t)
+	var out bytes.Buffer
+	q := quarantine.NewWriter(&out)
+	root := t.TempDir()
+	lines := "#Version: 1.0\nbroken line\n" + strings.Replace(strings.TrimSpace(testLines), "\t72756\t", "\tx\t", 1) + "\n"
+	other := "2021-11-17\t16:50:00\tGET\t1.1.1.1\thttps\t-\t-\t400\t700\t500\t151.139.34.203\t0.010\t200\t-\t%s\t-\t-\n"
+	// request of something else than playback is not rejected, unlike malformed one
+	lines += fmt.Sprintf(other, "/favicon.ico") + fmt.Sprintf(other, "garbage")
+	writeTestLogs(t, root, testSiteHash+"/cds/2021/11/17/cds_20211117-164716-27664444008dc2.log.gz", lines)
+	src, err := source.NewLocal(root)
+	if !assert.NoError(err) {
+		return
+	}
+	cfg := &config.Config{Names: map[string]string{testSiteHash: "test-region"}}
+	etli, err := NewEtl(context.Background(), cfg, src, nil, Options{Staging: true, Quarantine: q})
+	if !assert.NoError(err) {
+		return
+	}
+	startHour := time.Date(2021, 11, 17, 16, 0, 0, 0, time.UTC)
+	agg, _, err := etli.extractHour(testSiteHash, startHour, "")
+	if !assert.NoError(err) {
+		return
+	}
+	// line with bad filesize is still counted
+	assert.Equal(3, agg.flatten("test-region", startHour, "")[0].Data[0].Count)
+	assert.Equal(int64(1000), agg.otherTraffic)
+	assert.Equal(map[string]int64{"invalid_line": 1, "bad_int": 1, "bad_url": 1}, q.Summary().ByReason)
+	recs := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if assert.Len(recs, 3) {
+		rec := &quarantine.Record{}
+		assert.NoError(json.Unmarshal([]byte(recs[0]), rec))
+		assert.Equal(2, rec.Line)
+		assert.Equal("invalid_line", rec.Reason)
+		assert.Equal("broken line", rec.Text)
+	}
+}
+
+func TestTop(t *testing.T) {
+	assert := assert.New(t)
+	etli := newTestEtlWithSink(t, nil, Options{DryRun: ioutil.Discard})
+	from := time.Date(2021, 11, 17, 16, 0, 0, 0, time.UTC)
+	var buf bytes.Buffer
+	assert.Error(etli.Top("no-such-region", from, from.Add(time.Hour), TopOptions{N: 1}, &buf))
+	assert.Error(etli.Top("", from, from.Add(time.Hour), TopOptions{N: 1, Dimension: "country"}, &buf))
+	// hours without logs are skipped
+	assert.NoError(etli.Top("", from, from.Add(2*time.Hour), TopOptions{N: 1}, &buf))
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if !assert.Len(lines, 1) {
+		return
+	}
+	report := &TopReport{}
+	assert.NoError(json.Unmarshal([]byte(lines[0]), report))
+	assert.Equal(&TopReport{
+		Region:        "test-region",
+		Hour:          from,
+		Dimension:     TopByStream,
+		TotalScBytes:  189297,
+		TotalRequests: 5,
+		ByBytes:       []*TopEntry{{PlaybackID: "9e70xehvtu637q6p", Value: 189297, Share: 1}},
+		ByRequests:    []*TopEntry{{PlaybackID: "9e70xehvtu637q6p", Value: 5, Share: 1}},
+		ByUniques:     []*TopEntry{{PlaybackID: "9e70xehvtu637q6p", Value: 2}},
+	}, report)
+
+	buf.Reset()
+	assert.NoError(etli.Top("test-region", from, from.Add(time.Hour), TopOptions{N: 1, Dimension: TopByEdge}, &buf))
+	report = &TopReport{}
+	assert.NoError(json.Unmarshal(buf.Bytes(), report))
+	assert.Equal([]*TopEntry{{Key: "151.139.34.203", Value: 2, Share: 0.4}}, report.ByRequests)
+}
+
+func TestHeavyHittersUniquesError(t *testing.T) {
+	assert := assert.New(t)
+	h := newHeavyHitters(TopByStream, 1)
+	for _, vs := range []*VideoStat{
+		{itemType: utils.IDTypeManifestID, streamId: "a", IP: "1.1.1.1"},
+		{itemType: utils.IDTypeManifestID, streamId: "b", IP: "2.2.2.2"},
+		{itemType: utils.IDTypeManifestID, streamId: "a", IP: "3.3.3.3"},
+	} {
+		h.add(vs)
+	}
+	// a was evicted by b and tracked again, so its first client was not seen
+	report := h.report("test-region", time.Time{}, 1)
+	assert.Equal([]*TopEntry{{PlaybackID: "a", Value: 1, Error: 2}}, report.ByUniques)
+}
@@ -0,0 +1,145 @@
+package etl
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/golang/glog"
+)
+
+var ErrReplaceNotSupported = errors.New("sink does not support replacing data")
+
+type (
+	// Sink receives data aggregated by the Etl. Send is called
+	// once per processed hour with data for all the dates found in
+	// the log files of that hour.
+	Sink interface {
+		Send(data []*SendData) error
+		Close() error
+	}
+
+	// ContextSender is implemented by sinks that can stop sending
+	// when the context is cancelled
+	ContextSender interface {
+		SendContext(ctx context.Context, data []*SendData) error
+	}
+
+	// Replacer is implemented by sinks that can overwrite data previously
+	// sent for the same region and date instead of adding to it
+	Replacer interface {
+		Replace(data []*SendData) error
+	}
+
+	// jsonSink writes each SendData as one line of JSON (ndjson)
+	jsonSink struct {
+		mu     sync.Mutex
+		w      *bufio.Writer
+		closer io.Closer
+		// batches already written to the file, nil for stdout
+		batches map[string]bool
+	}
+)
+
+// NewFileSink creates sink appending newline-delimited JSON into the file.
+// Batches already found in the file are not written again, so data sent
+// right before a crash is not duplicated when the hour is reprocessed.
+func NewFileSink(fileName string) (Sink, error) {
+	batches, err := readBatchIDs(fileName)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(fileName, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &jsonSink{w: bufio.NewWriter(f), closer: f, batches: batches}, nil
+}
+
+func readBatchIDs(fileName string) (map[string]bool, error) {
+	batches := make(map[string]bool)
+	f, err := os.Open(fileName)
+	if os.IsNotExist(err) {
+		return batches, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	dec := json.NewDecoder(f)
+	for {
+		var rec struct {
+			BatchID string `json:"batch_id"`
+		}
+		if err = dec.Decode(&rec); err == io.EOF {
+			break
+		} else if err != nil {
+			glog.Warningf("Error reading batch IDs from file=%s, stopping at offset=%d err=%v", fileName, dec.InputOffset(), err)
+			break
+		}
+		if rec.BatchID != "" {
+			batches[rec.BatchID] = true
+		}
+	}
+	return batches, nil
+}
+
+// NewStdoutSink creates sink printing newline-delimited JSON to the console
+func NewStdoutSink() Sink {
+	return &jsonSink{w: bufio.NewWriter(os.Stdout)}
+}
+
+func (js *jsonSink) Send(data []*SendData) error {
+	js.mu.Lock()
+	defer js.mu.Unlock()
+	enc := json.NewEncoder(js.w)
+	// batches are recorded as written only once flushed, so they are not skipped on retry
+	written := make(map[string]bool)
+	for _, sd := range data {
+		if js.batches != nil && sd.BatchID != "" && !sd.Replace {
+			if js.batches[sd.BatchID] || written[sd.BatchID] {
+				glog.Infof("Skipping batch=%s already written region=%s date=%d", sd.BatchID, sd.Region, sd.Date)
+				continue
+			}
+			written[sd.BatchID] = true
+		}
+		if err := enc.Encode(sd); err != nil {
+			return err
+		}
+	}
+	if err := js.w.Flush(); err != nil {
+		return err
+	}
+	for id := range written {
+		js.batches[id] = true
+	}
+	return nil
+}
+
+// Replace writes data marked with `replace` flag, so consumers
+// of the file should drop previously read data for the same region and date
+func (js *jsonSink) Replace(data []*SendData) error {
+	toWrite := make([]*SendData, 0, len(data))
+	for _, sd := range data {
+		rsd := *sd
+		rsd.Replace = true
+		toWrite = append(toWrite, &rsd)
+	}
+	return js.Send(toWrite)
+}
+
+func (js *jsonSink) Close() error {
+	js.mu.Lock()
+	defer js.mu.Unlock()
+	err := js.w.Flush()
+	if js.closer != nil {
+		if cerr := js.closer.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
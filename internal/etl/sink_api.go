@@ -0,0 +1,65 @@
+package etl
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/livepeer/cdn-log-puller/internal/common"
+)
+
+const httpTimeout = 64 * time.Second
+
+var defaultHTTPClient = &http.Client{
+	// Transport: &http2.Transport{TLSClientConfig: tlsConfig},
+	// Transport: &http2.Transport{AllowHTTP: true},
+	Timeout: httpTimeout,
+}
+
+// apiSink posts data to Livepeer API's /api/cdn-data endpoint
+type apiSink struct {
+	api *APIClient
+}
+
+// NewAPISink creates sink sending data to Livepeer API
+func NewAPISink(api *APIClient) Sink {
+	return &apiSink{api: api}
+}
+
+func (as *apiSink) Send(data []*SendData) error {
+	return as.SendContext(context.Background(), data)
+}
+
+func (as *apiSink) SendContext(ctx context.Context, data []*SendData) error {
+	bin, err := json.Marshal(data)
+	if err != nil {
+		glog.Errorf("Error mashalling SendData err=%v", err)
+		return err
+	}
+	glog.V(common.INSANE2).Infof("Posting dataLen=%d data=%s", len(bin), string(bin))
+
+	_, resp, err := as.api.Post(ctx, "/api/cdn-data", bin, idempotencyKey(data))
+	if err != nil {
+		glog.Errorf("Error sending data to the API /cdn-data err=%v", err)
+		return err
+	}
+	glog.Infof("SendData post response=%s", string(resp))
+	return nil
+}
+
+func (as *apiSink) Close() error {
+	return nil
+}
+
+// apiBaseUrl strips path from the API url
+func apiBaseUrl(livepeerAPIUrl *url.URL) string {
+	if livepeerAPIUrl == nil {
+		return ""
+	}
+	u := *livepeerAPIUrl
+	u.Path = ""
+	return u.String()
+}
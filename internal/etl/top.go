@@ -0,0 +1,236 @@
+package etl
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/livepeer/cdn-log-puller/internal/sketch"
+	"github.com/livepeer/cdn-log-puller/internal/utils"
+)
+
+// dimensions heavy hitters can be found in
+const (
+	TopByStream = "stream"
+	TopByIP     = "ip"
+	TopByEdge   = "edge"
+)
+
+// DefaultTopCapacity is the number of keys tracked by heavy hitters sketches
+const DefaultTopCapacity = 1000
+
+type (
+	// TopOptions tell what heavy hitters to report
+	TopOptions struct {
+		// Dimension is TopByStream (default), TopByIP or TopByEdge
+		Dimension string
+		// N is the number of keys listed in each report
+		N int
+		// Capacity is the number of keys tracked, DefaultTopCapacity if 0. Keys
+		// with more than 1/Capacity of the total are guaranteed to be found.
+		Capacity int
+	}
+
+	// TopReport lists heavy hitters of the region in the hour log files are for
+	TopReport struct {
+		Region        string      `json:"region"`
+		Hour          time.Time   `json:"hour"`
+		Dimension     string      `json:"dimension"`
+		TotalScBytes  int64       `json:"total_sc_bytes"`
+		TotalRequests int64       `json:"total_requests"`
+		ByBytes       []*TopEntry `json:"by_bytes"`
+		ByRequests    []*TopEntry `json:"by_requests"`
+		// ByUniques lists keys by distinct client IPs, or by distinct streams
+		// for IP dimension. Only keys tracked by requests are considered, and
+		// their clients are counted since they are (last) tracked, so values
+		// are lower bounds: they are undercounted by at most their Error, the
+		// requests the key had before that.
+		ByUniques []*TopEntry `json:"by_uniques"`
+	}
+
+	// TopEntry is stream, client IP or edge server with its value
+	TopEntry struct {
+		StreamID   string `json:"stream_id,omitempty"`
+		PlaybackID string `json:"playback_id,omitempty"`
+		// Key is client IP or edge server
+		Key   string `json:"key,omitempty"`
+		Value int64  `json:"value"`
+		// Error is the most the value can be overestimated by
+		// (underestimated by, in ByUniques)
+		Error int64 `json:"error,omitempty"`
+		// Share is the fraction of the total bytes or requests
+		Share float64 `json:"share,omitempty"`
+	}
+
+	// heavyHitters finds keys of the dimension with most bytes and requests,
+	// and counts distinct clients of the keys with most requests
+	heavyHitters struct {
+		dimension     string
+		bytes         *sketch.TopK
+		requests      *sketch.TopK
+		uniques       map[string]*sketch.Uniques // only keys tracked in requests
+		totalBytes    int64
+		totalRequests int64
+	}
+)
+
+func newHeavyHitters(dimension string, capacity int) *heavyHitters {
+	if capacity <= 0 {
+		capacity = DefaultTopCapacity
+	}
+	return &heavyHitters{
+		dimension: dimension,
+		bytes:     sketch.NewTopK(capacity),
+		requests:  sketch.NewTopK(capacity),
+		uniques:   make(map[string]*sketch.Uniques),
+	}
+}
+
+// streamKey identifies stream of any ID type in the sketches
+func streamKey(vs *VideoStat) string {
+	return string(vs.itemType) + "/" + vs.streamId
+}
+
+// splitStreamKey returns stream or playback ID of the key, depending on its type
+func splitStreamKey(key string) (streamID, playbackID string) {
+	i := strings.Index(key, "/")
+	if i < 0 {
+		return "", ""
+	}
+	if utils.IDType(key[:i]) == utils.IDTypeStreamID {
+		return key[i+1:], ""
+	}
+	return "", key[i+1:]
+}
+
+func (h *heavyHitters) add(vs *VideoStat) {
+	var key, client string
+	switch h.dimension {
+	case TopByIP:
+		key, client = vs.IP, streamKey(vs)
+	case TopByEdge:
+		key, client = vs.edge, vs.IP
+	default:
+		key, client = streamKey(vs), vs.IP
+	}
+	h.totalBytes += vs.ScBytes
+	h.totalRequests++
+	h.bytes.Add(key, vs.ScBytes)
+	if evicted, ok := h.requests.Add(key, 1); ok {
+		delete(h.uniques, evicted)
+	}
+	u := h.uniques[key]
+	if u == nil {
+		u = sketch.New()
+		h.uniques[key] = u
+	}
+	u.Add(client)
+}
+
+func (h *heavyHitters) report(region string, hour time.Time, n int) *TopReport {
+	res := &TopReport{
+		Region:        region,
+		Hour:          hour.UTC(),
+		Dimension:     h.dimension,
+		TotalScBytes:  h.totalBytes,
+		TotalRequests: h.totalRequests,
+		ByBytes:       h.entries(h.bytes.Top(n), h.totalBytes),
+		ByRequests:    h.entries(h.requests.Top(n), h.totalRequests),
+	}
+	uniques := make([]sketch.TopItem, 0, len(h.uniques))
+	for key, u := range h.uniques {
+		// clients of the requests taken over from evicted keys were not seen
+		item, _ := h.requests.Get(key)
+		uniques = append(uniques, sketch.TopItem{Key: key, Count: int64(u.Count()), Error: item.Error})
+	}
+	sort.Slice(uniques, func(i, j int) bool {
+		if uniques[i].Count != uniques[j].Count {
+			return uniques[i].Count > uniques[j].Count
+		}
+		return uniques[i].Key < uniques[j].Key
+	})
+	if len(uniques) > n {
+		uniques = uniques[:n]
+	}
+	res.ByUniques = h.entries(uniques, 0)
+	return res
+}
+
+func (h *heavyHitters) entries(items []sketch.TopItem, total int64) []*TopEntry {
+	res := make([]*TopEntry, 0, len(items))
+	for _, item := range items {
+		entry := &TopEntry{Value: item.Count, Error: item.Error}
+		if h.dimension == TopByIP || h.dimension == TopByEdge {
+			entry.Key = item.Key
+		} else {
+			entry.StreamID, entry.PlaybackID = splitStreamKey(item.Key)
+		}
+		if total > 0 {
+			entry.Share = float64(item.Count) / float64(total)
+		}
+		res = append(res, entry)
+	}
+	return res
+}
+
+// Top writes heavy hitters of the region (of all the regions if empty) for
+// each hour in [from, to) range to w, as JSON lines
+func (etl *Etl) Top(region string, from, to time.Time, opts TopOptions, w io.Writer) error {
+	switch opts.Dimension {
+	case "":
+		opts.Dimension = TopByStream
+	case TopByStream, TopByIP, TopByEdge:
+	default:
+		return fmt.Errorf("invalid dimension %q, valid dimensions are stream, ip and edge", opts.Dimension)
+	}
+	if opts.N <= 0 {
+		return fmt.Errorf("invalid number of keys to report %d", opts.N)
+	}
+	var siteHashes []string
+	if region != "" {
+		siteHash := etl.siteHashByRegion(region)
+		if siteHash == "" {
+			return fmt.Errorf("region %s is invalid", region)
+		}
+		siteHashes = append(siteHashes, siteHash)
+	} else {
+		for siteHash, name := range etl.cfg.Names {
+			if strings.HasSuffix(name, "-monster") == etl.staging {
+				siteHashes = append(siteHashes, siteHash)
+			}
+		}
+		sort.Strings(siteHashes)
+	}
+	from = from.Truncate(aggregationDuration)
+	if !from.Before(to) {
+		return fmt.Errorf("invalid time range from=%s to=%s", from, to)
+	}
+	enc := json.NewEncoder(w)
+	for _, siteHash := range siteHashes {
+		regionName := etl.cfg.Names[siteHash]
+		for hour := from; hour.Before(to); hour = hour.Add(aggregationDuration) {
+			if etl.stopped() {
+				return ErrStopped
+			}
+			agg := newAggregator(etl.ctx, etl.src)
+			agg.quarantine = etl.quarantine
+			agg.top = newHeavyHitters(opts.Dimension, opts.Capacity)
+			_, err := etl.extractInto(agg, siteHash, hour, "")
+			if err == errEmpty {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			if err = enc.Encode(agg.top.report(regionName, hour, opts.N)); err != nil {
+				return err
+			}
+			glog.Infof("Found heavy hitters of region=%s hour=%s requests=%d", regionName, hour, agg.top.totalRequests)
+		}
+	}
+	return nil
+}
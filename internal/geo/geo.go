@@ -0,0 +1,172 @@
+// Package geo looks up country, city and ASN of client IPs in local
+// MaxMind-format (mmdb) databases, such as GeoLite2-City and GeoLite2-ASN.
+package geo
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/golang/glog"
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// fields locations can be grouped by
+const (
+	FieldCountry = "country"
+	FieldCity    = "city"
+	FieldASN     = "asn"
+)
+
+// lookups are cached until there are that many IPs in the cache
+const maxCached = 100000
+
+type (
+	// Location of the client IP, fields not found in the databases are empty
+	Location struct {
+		Country string // ISO code
+		City    string // English name
+		ASN     uint
+		ASOrg   string
+	}
+
+	// Locator finds location of the IP
+	Locator interface {
+		Locate(ip string) Location
+	}
+
+	// Database is implemented by *maxminddb.Reader
+	Database interface {
+		Lookup(ip net.IP, result interface{}) error
+	}
+
+	// record has fields of GeoIP2/GeoLite2 City, Country and ASN databases
+	record struct {
+		Country struct {
+			ISOCode string `maxminddb:"iso_code"`
+		} `maxminddb:"country"`
+		City struct {
+			Names map[string]string `maxminddb:"names"`
+		} `maxminddb:"city"`
+		ASN   uint   `maxminddb:"autonomous_system_number"`
+		ASOrg string `maxminddb:"autonomous_system_organization"`
+	}
+
+	// Resolver looks IPs up in all of its databases, so location and ASN can
+	// come from different files. It is safe for concurrent use.
+	Resolver struct {
+		dbs     []Database
+		readers []*maxminddb.Reader
+		mu      sync.Mutex
+		cache   map[string]Location
+	}
+)
+
+// Open opens mmdb files, comma-separated
+func Open(fileNames string) (*Resolver, error) {
+	var readers []*maxminddb.Reader
+	var dbs []Database
+	for _, fileName := range strings.Split(fileNames, ",") {
+		if fileName = strings.TrimSpace(fileName); fileName == "" {
+			continue
+		}
+		reader, err := maxminddb.Open(fileName)
+		if err != nil {
+			for _, r := range readers {
+				r.Close()
+			}
+			return nil, fmt.Errorf("error opening %s: %w", fileName, err)
+		}
+		glog.Infof("Opened geo database file=%s type=%s", fileName, reader.Metadata.DatabaseType)
+		readers = append(readers, reader)
+		dbs = append(dbs, reader)
+	}
+	r := New(dbs...)
+	r.readers = readers
+	return r, nil
+}
+
+// New creates resolver looking IPs up in dbs
+func New(dbs ...Database) *Resolver {
+	return &Resolver{dbs: dbs, cache: make(map[string]Location)}
+}
+
+// Locate returns empty location if IP is invalid or not found
+func (r *Resolver) Locate(ip string) Location {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if loc, ok := r.cache[ip]; ok {
+		return loc
+	}
+	var loc Location
+	if parsed := net.ParseIP(ip); parsed != nil {
+		for _, db := range r.dbs {
+			var rec record
+			if err := db.Lookup(parsed, &rec); err != nil {
+				glog.Warningf("Error looking up ip=%s err=%v", ip, err)
+				continue
+			}
+			if loc.Country == "" {
+				loc.Country = rec.Country.ISOCode
+			}
+			if loc.City == "" {
+				loc.City = rec.City.Names["en"]
+			}
+			if loc.ASN == 0 {
+				loc.ASN, loc.ASOrg = rec.ASN, rec.ASOrg
+			}
+		}
+	}
+	if len(r.cache) >= maxCached {
+		r.cache = make(map[string]Location)
+	}
+	r.cache[ip] = loc
+	return loc
+}
+
+func (r *Resolver) Close() error {
+	var err error
+	for _, reader := range r.readers {
+		if cerr := reader.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// ParseFields parses comma-separated list of fields to group by
+func ParseFields(s string) ([]string, error) {
+	var res []string
+	for _, field := range strings.Split(s, ",") {
+		switch field = strings.TrimSpace(field); field {
+		case "":
+			continue
+		case FieldCountry, FieldCity, FieldASN:
+			res = append(res, field)
+		default:
+			return nil, fmt.Errorf("invalid geo field %q, valid fields are country, city and asn", field)
+		}
+	}
+	if len(res) == 0 {
+		return nil, fmt.Errorf("no geo fields in %q", s)
+	}
+	return res, nil
+}
+
+// Only returns location with only the fields set, to be used as key of the breakdown.
+// City is kept together with the country, as city names are not unique.
+func (l Location) Only(fields []string) Location {
+	var res Location
+	for _, field := range fields {
+		switch field {
+		case FieldCountry:
+			res.Country = l.Country
+		case FieldCity:
+			res.Country, res.City = l.Country, l.City
+		case FieldASN:
+			res.ASN, res.ASOrg = l.ASN, l.ASOrg
+		}
+	}
+	return res
+}
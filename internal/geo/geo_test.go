@@ -0,0 +1,59 @@
+package geo
+
+import (
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeDB fills records as City or ASN database would
+type fakeDB struct {
+	country, city string
+	asn           uint
+	lookups       int
+}
+
+func (db *fakeDB) Lookup(ip net.IP, result interface{}) error {
+	db.lookups++
+	if ip.Equal(net.ParseIP("10.0.0.1")) {
+		return errors.New("broken")
+	}
+	rec := result.(*record)
+	rec.Country.ISOCode = db.country
+	if db.city != "" {
+		rec.City.Names = map[string]string{"en": db.city, "de": "x"}
+	}
+	rec.ASN = db.asn
+	if db.asn != 0 {
+		rec.ASOrg = "CLOUDFLARENET"
+	}
+	return nil
+}
+
+func TestResolver(t *testing.T) {
+	assert := assert.New(t)
+	city := &fakeDB{country: "US", city: "Chicago"}
+	asn := &fakeDB{asn: 13335}
+	r := New(city, asn)
+	expected := Location{Country: "US", City: "Chicago", ASN: 13335, ASOrg: "CLOUDFLARENET"}
+	assert.Equal(expected, r.Locate("104.28.131.0"))
+	assert.Equal(expected, r.Locate("104.28.131.0"))
+	assert.Equal(1, city.lookups)
+	assert.Equal(Location{}, r.Locate("not an ip"))
+	assert.Equal(Location{}, r.Locate("10.0.0.1"))
+
+	assert.Equal(Location{Country: "US"}, expected.Only([]string{FieldCountry}))
+	assert.Equal(Location{Country: "US", City: "Chicago"}, expected.Only([]string{FieldCity}))
+	assert.Equal(Location{Country: "US", ASN: 13335, ASOrg: "CLOUDFLARENET"}, expected.Only([]string{FieldCountry, FieldASN}))
+
+	fields, err := ParseFields("country, asn")
+	assert.NoError(err)
+	assert.Equal([]string{FieldCountry, FieldASN}, fields)
+	_, err = ParseFields("region")
+	assert.Error(err)
+
+	_, err = Open("no-such-file.mmdb")
+	assert.Error(err)
+}
@@ -0,0 +1,118 @@
+// Package metrics keeps Prometheus metrics of etl and analyze runs. They are
+// served over HTTP in daemon mode or dumped in textfile collector format
+// after one-shot runs.
+package metrics
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// reasons for the line to be rejected by the parser
+const (
+	ReasonInvalidLine = "invalid_line"
+	ReasonBadURL      = "bad_url"
+	ReasonBadInt      = "bad_int"
+)
+
+var (
+	FilesRead = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "cdn_log_files_read_total",
+		Help: "Number of log files read",
+	})
+	LinesParsed = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "cdn_log_lines_parsed_total",
+		Help: "Number of log lines parsed, including rejected ones",
+	})
+	LinesRejected = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "cdn_log_lines_rejected_total",
+		Help: "Number of log lines that failed to parse, by reason",
+	}, []string{"reason"})
+	BytesSent = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "cdn_video_bytes_total",
+		Help: "Bytes sent by CDN to clients for video streams",
+	}, []string{"region"})
+	OtherTraffic = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "cdn_other_traffic_bytes_total",
+		Help: "Bytes sent by CDN to clients not related to video streaming",
+	}, []string{"region"})
+	CacheRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "cdn_cache_requests_total",
+		Help: "Video requests served by CDN by cache status (hit or miss), requests without cache status are not counted",
+	}, []string{"region", "cache_status"})
+	OriginBytes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "cdn_origin_bytes_total",
+		Help: "Bytes of video files CDN fetched from the origin on cache misses",
+	}, []string{"region"})
+	Anomalies = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "cdn_stream_anomalies_total",
+		Help: "Anomalies found in the hourly traffic of the streams, by kind and metric",
+	}, []string{"kind", "metric"})
+	APIDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "livepeer_api_request_duration_seconds",
+		Help:    "Duration of Livepeer API requests (each attempt separately)",
+		Buckets: prometheus.ExponentialBuckets(0.05, 2, 12),
+	}, []string{"method", "code"})
+	APIErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "livepeer_api_errors_total",
+		Help: "Number of failed Livepeer API calls, after all the retries",
+	}, []string{"method"})
+
+	lag = &lagCollector{
+		desc: prometheus.NewDesc("cdn_etl_lag_seconds",
+			"Time passed since the end of the last processed hour", []string{"region"}, nil),
+		hours: make(map[string]time.Time),
+	}
+)
+
+func init() {
+	prometheus.MustRegister(lag)
+}
+
+// lagCollector computes lag at the time of scraping, so it keeps growing
+// if etl gets stuck
+type lagCollector struct {
+	mu    sync.Mutex
+	desc  *prometheus.Desc
+	hours map[string]time.Time
+}
+
+func (lc *lagCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- lc.desc
+}
+
+func (lc *lagCollector) Collect(ch chan<- prometheus.Metric) {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+	for region, hourEnd := range lc.hours {
+		ch <- prometheus.MustNewConstMetric(lc.desc, prometheus.GaugeValue, time.Since(hourEnd).Seconds(), region)
+	}
+}
+
+// HourProcessed records hour that ends at hourEnd as processed for the region
+func HourProcessed(region string, hourEnd time.Time) {
+	lag.mu.Lock()
+	defer lag.mu.Unlock()
+	if hourEnd.After(lag.hours[region]) {
+		lag.hours[region] = hourEnd
+	}
+}
+
+// Serve exposes /metrics endpoint on addr, it does not return
+func Serve(addr string) error {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	glog.Infof("Serving metrics on %s/metrics", addr)
+	return http.ListenAndServe(addr, mux)
+}
+
+// WriteTextfile dumps metrics in the format of node_exporter's textfile collector
+func WriteTextfile(fileName string) error {
+	return prometheus.WriteToTextfile(fileName, prometheus.DefaultGatherer)
+}
@@ -0,0 +1,34 @@
+package metrics
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWriteTextfile(t *testing.T) {
+	assert := assert.New(t)
+	LinesRejected.WithLabelValues(ReasonBadURL).Inc()
+	HourProcessed("test-region", time.Now().Add(-2*time.Hour))
+	HourProcessed("test-region", time.Now().Add(-3*time.Hour))
+
+	fileName := filepath.Join(t.TempDir(), "cdn.prom")
+	assert.NoError(WriteTextfile(fileName))
+	data, err := ioutil.ReadFile(fileName)
+	if !assert.NoError(err) {
+		return
+	}
+	text := string(data)
+	assert.Contains(text, `cdn_log_lines_rejected_total{reason="bad_url"} 1`)
+	for _, line := range strings.Split(text, "\n") {
+		if strings.HasPrefix(line, `cdn_etl_lag_seconds{region="test-region"}`) {
+			// older hour does not move lag back
+			assert.True(strings.HasPrefix(line, `cdn_etl_lag_seconds{region="test-region"} 720`), line)
+		}
+	}
+	assert.Contains(text, `cdn_etl_lag_seconds{region="test-region"}`)
+}
@@ -0,0 +1,163 @@
+// Package quarantine records log lines rejected by the parsers, so it can be
+// audited how much traffic is lost and why.
+package quarantine
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+type (
+	// Record describes one rejected line
+	Record struct {
+		File   string `json:"file"`
+		Line   int    `json:"line"` // 1-based line number in uncompressed file
+		Reason string `json:"reason"`
+		Text   string `json:"text"`
+	}
+
+	// Summary of the rejected lines of one run
+	Summary struct {
+		Started  time.Time        `json:"started"`
+		Finished time.Time        `json:"finished"`
+		Total    int64            `json:"total"`
+		ByReason map[string]int64 `json:"by_reason"`
+		// files with the most rejected lines
+		ByFile map[string]int64 `json:"by_file"`
+	}
+
+	// Quarantine writes rejected lines as JSON lines. Methods of nil
+	// *Quarantine do nothing, so it can be used without checks.
+	Quarantine struct {
+		mu          sync.Mutex
+		enc         *json.Encoder
+		zw          *gzip.Writer
+		fh          *os.File
+		summaryName string
+		summary     Summary
+		err         error
+	}
+)
+
+// only this many files are kept in the summary
+const maxSummaryFiles = 20
+
+// New creates quarantine writing gzipped JSON lines to the file, summary of
+// the run is written next to it on Close. If fileName is "-" lines are written
+// uncompressed to stdout and summary is only logged.
+func New(fileName string) (*Quarantine, error) {
+	if fileName == "-" {
+		return NewWriter(os.Stdout), nil
+	}
+	fh, err := os.Create(fileName)
+	if err != nil {
+		return nil, err
+	}
+	zw := gzip.NewWriter(fh)
+	q := NewWriter(zw)
+	q.zw = zw
+	q.fh = fh
+	q.summaryName = fileName + ".summary.json"
+	return q, nil
+}
+
+// NewWriter creates quarantine writing JSON lines to w
+func NewWriter(w io.Writer) *Quarantine {
+	return &Quarantine{
+		enc: json.NewEncoder(w),
+		summary: Summary{
+			Started:  time.Now().UTC(),
+			ByReason: make(map[string]int64),
+			ByFile:   make(map[string]int64),
+		},
+	}
+}
+
+// Reject records the line. Write errors are reported by Close.
+func (q *Quarantine) Reject(file string, line int, reason, text string) {
+	if q == nil {
+		return
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.summary.Total++
+	q.summary.ByReason[reason]++
+	q.summary.ByFile[file]++
+	if q.err != nil {
+		return
+	}
+	if q.err = q.enc.Encode(&Record{File: file, Line: line, Reason: reason, Text: text}); q.err != nil {
+		glog.Errorf("Error writing to quarantine err=%v", q.err)
+	}
+}
+
+// Summary returns counts of the lines rejected so far
+func (q *Quarantine) Summary() Summary {
+	if q == nil {
+		return Summary{}
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	s := q.summary
+	s.ByReason = make(map[string]int64, len(q.summary.ByReason))
+	for reason, count := range q.summary.ByReason {
+		s.ByReason[reason] = count
+	}
+	files := make([]string, 0, len(q.summary.ByFile))
+	for file := range q.summary.ByFile {
+		files = append(files, file)
+	}
+	sort.Slice(files, func(i, j int) bool {
+		ci, cj := q.summary.ByFile[files[i]], q.summary.ByFile[files[j]]
+		return ci > cj || (ci == cj && files[i] < files[j])
+	})
+	if len(files) > maxSummaryFiles {
+		files = files[:maxSummaryFiles]
+	}
+	s.ByFile = make(map[string]int64, len(files))
+	for _, file := range files {
+		s.ByFile[file] = q.summary.ByFile[file]
+	}
+	return s
+}
+
+// Close flushes the file and writes the summary of the run
+func (q *Quarantine) Close() error {
+	if q == nil {
+		return nil
+	}
+	s := q.Summary()
+	s.Finished = time.Now().UTC()
+	glog.Infof("Quarantined %d lines, by reason: %v", s.Total, s.ByReason)
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	err := q.err
+	if q.zw != nil {
+		if zerr := q.zw.Close(); err == nil {
+			err = zerr
+		}
+	}
+	if q.fh != nil {
+		if ferr := q.fh.Close(); err == nil {
+			err = ferr
+		}
+	}
+	if q.summaryName != "" {
+		data, jerr := json.MarshalIndent(&s, "", "  ")
+		if jerr == nil {
+			jerr = ioutil.WriteFile(q.summaryName, data, 0644)
+		}
+		if err == nil {
+			err = jerr
+		}
+	}
+	return err
+}
@@ -0,0 +1,61 @@
+package quarantine
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestQuarantine(t *testing.T) {
+	assert := assert.New(t)
+	fileName := filepath.Join(t.TempDir(), "rejected.jsonl.gz")
+	q, err := New(fileName)
+	if !assert.NoError(err) {
+		return
+	}
+	q.Reject("a.log.gz", 3, "bad_url", "line 3")
+	q.Reject("a.log.gz", 7, "bad_int", "line 7")
+	q.Reject("b.log.gz", 1, "bad_url", "line 1")
+	s := q.Summary()
+	assert.Equal(int64(3), s.Total)
+	assert.Equal(map[string]int64{"bad_url": 2, "bad_int": 1}, s.ByReason)
+	assert.Equal(map[string]int64{"a.log.gz": 2, "b.log.gz": 1}, s.ByFile)
+	assert.NoError(q.Close())
+
+	fh, err := os.Open(fileName)
+	if !assert.NoError(err) {
+		return
+	}
+	defer fh.Close()
+	zr, err := gzip.NewReader(fh)
+	if !assert.NoError(err) {
+		return
+	}
+	data, err := ioutil.ReadAll(zr)
+	assert.NoError(err)
+	lines := bytes.Split(bytes.TrimSpace(data), []byte("\n"))
+	if assert.Len(lines, 3) {
+		rec := &Record{}
+		assert.NoError(json.Unmarshal(lines[1], rec))
+		assert.Equal(Record{File: "a.log.gz", Line: 7, Reason: "bad_int", Text: "line 7"}, *rec)
+	}
+
+	data, err = ioutil.ReadFile(fileName + ".summary.json")
+	if assert.NoError(err) {
+		summary := &Summary{}
+		assert.NoError(json.Unmarshal(data, summary))
+		assert.Equal(int64(3), summary.Total)
+		assert.False(summary.Finished.Before(summary.Started))
+	}
+
+	// nil quarantine is a no-op
+	var nq *Quarantine
+	nq.Reject("a.log.gz", 1, "bad_url", "line")
+	assert.NoError(nq.Close())
+}
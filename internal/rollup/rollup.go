@@ -0,0 +1,109 @@
+// Package rollup defines time buckets data is aggregated into. Several
+// granularities can be computed in one pass over the logs, each output
+// row is tagged with the granularity of its bucket.
+package rollup
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Granularity is the size of the time bucket. Buckets shorter than a day
+// must divide the day evenly, so they are aligned to midnight UTC.
+type Granularity struct {
+	name string
+	d    time.Duration // zero for calendar month
+}
+
+var (
+	Hourly  = Granularity{name: "1h", d: time.Hour}
+	Daily   = Granularity{name: "1d", d: 24 * time.Hour}
+	Monthly = Granularity{name: "1mo"}
+)
+
+// Parse accepts Go durations (5m, 15m, 1h, 6h), 1d and 1mo
+func Parse(s string) (Granularity, error) {
+	switch s {
+	case Daily.name:
+		return Daily, nil
+	case Monthly.name:
+		return Monthly, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return Granularity{}, fmt.Errorf("invalid granularity %q, expected duration, 1d or 1mo", s)
+	}
+	if d < time.Minute || d%time.Minute != 0 || Daily.d%d != 0 {
+		return Granularity{}, fmt.Errorf("invalid granularity %q, must be whole minutes dividing the day", s)
+	}
+	if d == Daily.d {
+		return Daily, nil
+	}
+	return Granularity{name: formatDuration(d), d: d}, nil
+}
+
+// ParseList parses comma-separated granularities, duplicates are dropped
+func ParseList(s string) ([]Granularity, error) {
+	var res []Granularity
+	seen := make(map[Granularity]bool)
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		g, err := Parse(part)
+		if err != nil {
+			return nil, err
+		}
+		if !seen[g] {
+			seen[g] = true
+			res = append(res, g)
+		}
+	}
+	if len(res) == 0 {
+		return nil, fmt.Errorf("no granularities in %q", s)
+	}
+	return res, nil
+}
+
+// formatDuration gives canonical name, so 60m and 1h are the same granularity
+func formatDuration(d time.Duration) string {
+	if d%time.Hour == 0 {
+		return fmt.Sprintf("%dh", d/time.Hour)
+	}
+	return fmt.Sprintf("%dm", d/time.Minute)
+}
+
+func (g Granularity) String() string {
+	return g.name
+}
+
+// Exceeds reports if buckets are longer than d, calendar month is longer than any duration
+func (g Granularity) Exceeds(d time.Duration) bool {
+	return g.d == 0 || g.d > d
+}
+
+// Start returns start of the bucket tm belongs to
+func (g Granularity) Start(tm time.Time) time.Time {
+	tm = tm.UTC()
+	if g.d == 0 {
+		return time.Date(tm.Year(), tm.Month(), 1, 0, 0, 0, 0, time.UTC)
+	}
+	return tm.Truncate(g.d)
+}
+
+// Format returns start of the bucket tm belongs to as date string,
+// as precise as the granularity requires
+func (g Granularity) Format(tm time.Time) string {
+	start := g.Start(tm)
+	switch {
+	case g.d == 0:
+		return start.Format("2006-01")
+	case g.d%Daily.d == 0:
+		return start.Format("2006-01-02")
+	case g.d%time.Hour == 0:
+		return start.Format("2006-01-02T15")
+	}
+	return start.Format("2006-01-02T15:04")
+}
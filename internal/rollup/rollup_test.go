@@ -0,0 +1,38 @@
+package rollup
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParse(t *testing.T) {
+	assert := assert.New(t)
+	grans, err := ParseList("5m, 60m,1h,24h,1mo")
+	if assert.NoError(err) {
+		assert.Equal([]Granularity{{name: "5m", d: 5 * time.Minute}, Hourly, Daily, Monthly}, grans)
+	}
+	for _, bad := range []string{"7m", "30s", "2d", "1w", ""} {
+		_, err = ParseList(bad)
+		assert.Error(err, bad)
+	}
+}
+
+func TestBuckets(t *testing.T) {
+	assert := assert.New(t)
+	tm := time.Date(2021, 11, 17, 16, 47, 16, 0, time.UTC)
+	five, _ := Parse("5m")
+	six, _ := Parse("6h")
+	assert.Equal(time.Date(2021, 11, 17, 16, 45, 0, 0, time.UTC), five.Start(tm))
+	assert.Equal("2021-11-17T16:45", five.Format(tm))
+	assert.Equal("2021-11-17T16", Hourly.Format(tm))
+	assert.Equal("2021-11-17T12", six.Format(tm))
+	assert.Equal("2021-11-17", Daily.Format(tm))
+	assert.Equal("2021-11", Monthly.Format(tm))
+	assert.Equal(time.Date(2021, 11, 1, 0, 0, 0, 0, time.UTC), Monthly.Start(tm))
+	assert.False(five.Exceeds(time.Hour))
+	assert.False(Hourly.Exceeds(time.Hour))
+	assert.True(six.Exceeds(time.Hour))
+	assert.True(Monthly.Exceeds(time.Hour))
+}
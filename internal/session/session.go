@@ -0,0 +1,243 @@
+// Package session groups CDN requests into playback sessions: requests of the
+// same stream by the same client, without pauses longer than the inactivity timeout.
+package session
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/livepeer/cdn-log-puller/internal/utils"
+)
+
+// DefaultTimeout is the inactivity after which the session is considered ended
+const DefaultTimeout = 2 * time.Minute
+
+type (
+	// Request is one request of the stream to the CDN
+	Request struct {
+		Time      time.Time
+		Region    string // keeps sessions of the regions apart, see FlushRegion
+		ID        string
+		IDType    utils.IDType
+		IP        string
+		UserAgent string
+		// SessionID is `sessId` query parameter, if player sets it
+		SessionID string
+		Rendition string
+		Kind      utils.SegmentKind
+		Bytes     int64 // sent to the client
+	}
+
+	// Session is the playback of the stream by one client
+	Session struct {
+		Region     string `json:"region,omitempty"`
+		StreamID   string `json:"stream_id,omitempty"`
+		PlaybackID string `json:"playback_id,omitempty"`
+		IP         string `json:"client_ip"`
+		UserAgent  string `json:"user_agent,omitempty"`
+		SessionID  string `json:"session_id,omitempty"`
+		// Start and End are times of the first and the last request
+		Start    time.Time `json:"start"`
+		End      time.Time `json:"end"`
+		Requests int       `json:"requests"`
+		Segments int       `json:"segments"`
+		Bytes    int64     `json:"bytes"`
+		// Renditions are listed in the order they were first played
+		Renditions        []string `json:"renditions,omitempty"`
+		RenditionSwitches int      `json:"rendition_switches"`
+	}
+
+	// client is identified by session ID if player sets it, otherwise by user agent
+	key struct {
+		region    string
+		id        string
+		idType    utils.IDType
+		ip        string
+		userAgent string
+		sessionID string
+	}
+
+	// Sessionizer collects requests and writes sessions as JSON lines once they
+	// end. Requests can be added in any order, sessions still open are kept
+	// until the next Flush. Methods of nil *Sessionizer do nothing.
+	Sessionizer struct {
+		mu      sync.Mutex
+		timeout time.Duration
+		enc     *json.Encoder
+		fh      *os.File
+		pending map[key][]Request
+		written int64
+		err     error
+	}
+)
+
+// New creates sessionizer writing sessions to the file, "-" for stdout
+func New(fileName string, timeout time.Duration) (*Sessionizer, error) {
+	if fileName == "-" {
+		return NewWriter(os.Stdout, timeout), nil
+	}
+	fh, err := os.Create(fileName)
+	if err != nil {
+		return nil, err
+	}
+	s := NewWriter(fh, timeout)
+	s.fh = fh
+	return s, nil
+}
+
+// NewWriter creates sessionizer writing sessions to w. Zero timeout means DefaultTimeout.
+func NewWriter(w io.Writer, timeout time.Duration) *Sessionizer {
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+	return &Sessionizer{
+		timeout: timeout,
+		enc:     json.NewEncoder(w),
+		pending: make(map[key][]Request),
+	}
+}
+
+// Add records the request, it is safe to call concurrently
+func (s *Sessionizer) Add(r Request) {
+	if s == nil {
+		return
+	}
+	k := key{region: r.Region, id: r.ID, idType: r.IDType, ip: r.IP}
+	if r.SessionID != "" {
+		k.sessionID = r.SessionID
+	} else {
+		k.userAgent = r.UserAgent
+	}
+	s.mu.Lock()
+	s.pending[k] = append(s.pending[k], r)
+	s.mu.Unlock()
+}
+
+// Flush writes sessions inactive for the timeout as of now, which is
+// the end of the processed logs rather than wall clock time
+func (s *Sessionizer) Flush(now time.Time) error {
+	if s == nil {
+		return nil
+	}
+	return s.flush(func(_ key, end time.Time) bool {
+		return !end.Add(s.timeout).After(now)
+	})
+}
+
+// FlushRegion is Flush for the sessions of the region only, for regions
+// processed one after another, each up to its own time
+func (s *Sessionizer) FlushRegion(region string, now time.Time) error {
+	if s == nil {
+		return nil
+	}
+	return s.flush(func(k key, end time.Time) bool {
+		return k.region == region && !end.Add(s.timeout).After(now)
+	})
+}
+
+// Close writes all the sessions, including ones that may still be going on
+func (s *Sessionizer) Close() error {
+	if s == nil {
+		return nil
+	}
+	err := s.flush(func(key, time.Time) bool { return true })
+	glog.Infof("Wrote %d sessions", s.written)
+	if s.fh != nil {
+		if ferr := s.fh.Close(); err == nil {
+			err = ferr
+		}
+	}
+	return err
+}
+
+func (s *Sessionizer) flush(ended func(k key, end time.Time) bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var done []*Session
+	for k, reqs := range s.pending {
+		sort.SliceStable(reqs, func(i, j int) bool {
+			return reqs[i].Time.Before(reqs[j].Time)
+		})
+		start := 0
+		for i := 1; i <= len(reqs); i++ {
+			if i < len(reqs) && reqs[i].Time.Sub(reqs[i-1].Time) <= s.timeout {
+				continue
+			}
+			if i == len(reqs) && !ended(k, reqs[i-1].Time) {
+				break
+			}
+			done = append(done, newSession(k, reqs[start:i]))
+			start = i
+		}
+		if start == len(reqs) {
+			delete(s.pending, k)
+		} else {
+			// copied, so requests of written sessions can be freed
+			s.pending[k] = append([]Request(nil), reqs[start:]...)
+		}
+	}
+	sort.Slice(done, func(i, j int) bool {
+		a, b := done[i], done[j]
+		if !a.Start.Equal(b.Start) {
+			return a.Start.Before(b.Start)
+		}
+		if a.StreamID+a.PlaybackID != b.StreamID+b.PlaybackID {
+			return a.StreamID+a.PlaybackID < b.StreamID+b.PlaybackID
+		}
+		return a.IP < b.IP
+	})
+	for _, sess := range done {
+		if s.err != nil {
+			break
+		}
+		if s.err = s.enc.Encode(sess); s.err != nil {
+			glog.Errorf("Error writing sessions err=%v", s.err)
+			break
+		}
+		s.written++
+	}
+	return s.err
+}
+
+// newSession summarizes requests sorted by time
+func newSession(k key, reqs []Request) *Session {
+	sess := &Session{
+		Region:    k.region,
+		IP:        k.ip,
+		UserAgent: reqs[0].UserAgent,
+		SessionID: k.sessionID,
+		Start:     reqs[0].Time,
+		End:       reqs[len(reqs)-1].Time,
+		Requests:  len(reqs),
+	}
+	switch k.idType {
+	case utils.IDTypeStreamID:
+		sess.StreamID = k.id
+	default:
+		sess.PlaybackID = k.id
+	}
+	var current string
+	for _, r := range reqs {
+		sess.Bytes += r.Bytes
+		if r.Kind != utils.SegmentKindSegment {
+			continue
+		}
+		sess.Segments++
+		if r.Rendition == "" || r.Rendition == current {
+			continue
+		}
+		if current != "" {
+			sess.RenditionSwitches++
+		}
+		current = r.Rendition
+		if !utils.Includes(sess.Renditions, r.Rendition) {
+			sess.Renditions = append(sess.Renditions, r.Rendition)
+		}
+	}
+	return sess
+}
@@ -0,0 +1,123 @@
+package session
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/livepeer/cdn-log-puller/internal/utils"
+	"github.com/stretchr/testify/assert"
+)
+
+func readSessions(t *testing.T, out *bytes.Buffer) []*Session {
+	var res []*Session
+	for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+		if line == "" {
+			continue
+		}
+		sess := &Session{}
+		assert.NoError(t, json.Unmarshal([]byte(line), sess))
+		res = append(res, sess)
+	}
+	out.Reset()
+	return res
+}
+
+func TestSessionizer(t *testing.T) {
+	assert := assert.New(t)
+	var out bytes.Buffer
+	s := NewWriter(&out, time.Minute)
+	start := time.Date(2021, 11, 17, 16, 0, 0, 0, time.UTC)
+	seg := func(sec int, rendition string) Request {
+		return Request{
+			Time:      start.Add(time.Duration(sec) * time.Second),
+			ID:        "9e70xehvtu637q6p",
+			IDType:    utils.IDTypeManifestID,
+			IP:        "1.2.3.4",
+			UserAgent: "player",
+			Rendition: rendition,
+			Kind:      utils.SegmentKindSegment,
+			Bytes:     100,
+		}
+	}
+	// added out of order, as files are read in parallel
+	s.Add(seg(4, "5"))
+	s.Add(Request{Time: start, ID: "9e70xehvtu637q6p", IDType: utils.IDTypeManifestID, IP: "1.2.3.4", UserAgent: "player", Kind: utils.SegmentKindManifest, Bytes: 10})
+	s.Add(seg(2, "0"))
+	s.Add(seg(6, "0"))
+	// pause longer than the timeout starts new session
+	s.Add(seg(300, "0"))
+	// other client
+	other := seg(3, "0")
+	other.UserAgent = "other player"
+	s.Add(other)
+
+	// only the session followed by the pause is known to be ended
+	assert.NoError(s.Flush(start.Add(30 * time.Second)))
+	sessions := readSessions(t, &out)
+	if assert.Len(sessions, 1) {
+		assert.Equal(&Session{
+			PlaybackID:        "9e70xehvtu637q6p",
+			IP:                "1.2.3.4",
+			UserAgent:         "player",
+			Start:             start,
+			End:               start.Add(6 * time.Second),
+			Requests:          4,
+			Segments:          3,
+			Bytes:             310,
+			Renditions:        []string{"0", "5"},
+			RenditionSwitches: 2,
+		}, sessions[0])
+	}
+
+	assert.NoError(s.Flush(start.Add(2 * time.Minute)))
+	sessions = readSessions(t, &out)
+	if assert.Len(sessions, 1) {
+		assert.Equal("other player", sessions[0].UserAgent)
+		assert.Equal(1, sessions[0].Requests)
+	}
+
+	// requests with session ID are grouped by it
+	s.Add(Request{Time: start.Add(301 * time.Second), ID: "9e70xehvtu637q6p", IDType: utils.IDTypeManifestID, IP: "1.2.3.4", SessionID: "42"})
+	assert.NoError(s.Close())
+	sessions = readSessions(t, &out)
+	if assert.Len(sessions, 2) {
+		assert.Equal(start.Add(300*time.Second), sessions[0].Start)
+		assert.Equal(1, sessions[0].Segments)
+		assert.Equal("42", sessions[1].SessionID)
+	}
+
+	var nilSessionizer *Sessionizer
+	nilSessionizer.Add(seg(0, "0"))
+	assert.NoError(nilSessionizer.Flush(start))
+	assert.NoError(nilSessionizer.FlushRegion("fra", start))
+	assert.NoError(nilSessionizer.Close())
+}
+
+func TestSessionizerFlushRegion(t *testing.T) {
+	assert := assert.New(t)
+	var out bytes.Buffer
+	s := NewWriter(&out, time.Minute)
+	start := time.Date(2021, 11, 17, 16, 0, 0, 0, time.UTC)
+	req := func(region string, tm time.Time) Request {
+		return Request{Time: tm, Region: region, ID: "9e70xehvtu637q6p", IDType: utils.IDTypeManifestID, IP: "1.2.3.4"}
+	}
+	// fra is processed up to 17:00, lax only up to 16:00 and continues in the next hour
+	s.Add(req("fra", start.Add(30*time.Minute)))
+	s.Add(req("lax", start.Add(-30*time.Second)))
+	assert.NoError(s.FlushRegion("fra", start.Add(time.Hour)))
+	sessions := readSessions(t, &out)
+	if assert.Len(sessions, 1) {
+		assert.Equal("fra", sessions[0].Region)
+	}
+
+	s.Add(req("lax", start.Add(10*time.Second)))
+	assert.NoError(s.FlushRegion("lax", start.Add(time.Hour)))
+	sessions = readSessions(t, &out)
+	if assert.Len(sessions, 1) {
+		assert.Equal("lax", sessions[0].Region)
+		assert.Equal(2, sessions[0].Requests)
+	}
+}
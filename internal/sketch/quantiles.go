@@ -0,0 +1,151 @@
+package sketch
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"math"
+	"sort"
+)
+
+// relative accuracy of the quantiles
+const quantilesAccuracy = 0.01
+
+var (
+	quantilesGamma    = (1 + quantilesAccuracy) / (1 - quantilesAccuracy)
+	quantilesLogGamma = math.Log(quantilesGamma)
+
+	errBadQuantiles = errors.New("invalid quantiles sketch")
+)
+
+// Quantiles estimates quantiles of non-negative values (DDSketch): values are
+// counted in logarithmic buckets, so any quantile is off by at most 1% of its
+// value. Sketches are merged exactly, by adding bucket counts.
+type Quantiles struct {
+	buckets map[int32]uint64
+	zeros   uint64 // values too small for the buckets
+	count   uint64
+}
+
+// values below this are counted as zeros
+const quantilesMinValue = 1e-6
+
+func NewQuantiles() *Quantiles {
+	return &Quantiles{buckets: make(map[int32]uint64)}
+}
+
+// Add counts the value, negative values are ignored
+func (q *Quantiles) Add(value float64) {
+	if value < 0 || math.IsNaN(value) || math.IsInf(value, 0) {
+		return
+	}
+	q.count++
+	if value < quantilesMinValue {
+		q.zeros++
+		return
+	}
+	q.buckets[int32(math.Ceil(math.Log(value)/quantilesLogGamma))]++
+}
+
+func (q *Quantiles) Count() uint64 {
+	return q.count
+}
+
+// Quantile returns estimated value at rank p (0.5 for median), 0 if sketch is empty
+func (q *Quantiles) Quantile(p float64) float64 {
+	if q.count == 0 {
+		return 0
+	}
+	rank := uint64(p * float64(q.count-1))
+	if rank < q.zeros {
+		return 0
+	}
+	seen := q.zeros
+	keys := q.sortedKeys()
+	for _, key := range keys {
+		seen += q.buckets[key]
+		if seen > rank {
+			return 2 * math.Pow(quantilesGamma, float64(key)) / (quantilesGamma + 1)
+		}
+	}
+	return 2 * math.Pow(quantilesGamma, float64(keys[len(keys)-1])) / (quantilesGamma + 1)
+}
+
+func (q *Quantiles) sortedKeys() []int32 {
+	keys := make([]int32, 0, len(q.buckets))
+	for key := range q.buckets {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i] < keys[j]
+	})
+	return keys
+}
+
+// Merge adds all the values of other sketch to q
+func (q *Quantiles) Merge(other *Quantiles) {
+	for key, count := range other.buckets {
+		q.buckets[key] += count
+	}
+	q.zeros += other.zeros
+	q.count += other.count
+}
+
+// MarshalBinary encodes zeros count and then bucket keys and counts as varints
+func (q *Quantiles) MarshalBinary() ([]byte, error) {
+	buf := make([]byte, binary.MaxVarintLen64*(1+2*len(q.buckets)))
+	n := binary.PutUvarint(buf, q.zeros)
+	for _, key := range q.sortedKeys() {
+		n += binary.PutVarint(buf[n:], int64(key))
+		n += binary.PutUvarint(buf[n:], q.buckets[key])
+	}
+	return buf[:n], nil
+}
+
+func (q *Quantiles) UnmarshalBinary(data []byte) error {
+	res := NewQuantiles()
+	zeros, n := binary.Uvarint(data)
+	if n <= 0 {
+		return errBadQuantiles
+	}
+	data = data[n:]
+	res.zeros, res.count = zeros, zeros
+	for len(data) > 0 {
+		key, n := binary.Varint(data)
+		if n <= 0 || key < math.MinInt32 || key > math.MaxInt32 {
+			return errBadQuantiles
+		}
+		data = data[n:]
+		count, n := binary.Uvarint(data)
+		if n <= 0 {
+			return errBadQuantiles
+		}
+		data = data[n:]
+		res.buckets[int32(key)] += count
+		res.count += count
+	}
+	*q = *res
+	return nil
+}
+
+// Encode returns base64 of the binary form, for JSON and CSV outputs
+func (q *Quantiles) Encode() (string, error) {
+	data, err := q.MarshalBinary()
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(data), nil
+}
+
+// DecodeQuantiles restores sketch returned by Encode
+func DecodeQuantiles(encoded string) (*Quantiles, error) {
+	data, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, err
+	}
+	q := NewQuantiles()
+	if err = q.UnmarshalBinary(data); err != nil {
+		return nil, err
+	}
+	return q, nil
+}
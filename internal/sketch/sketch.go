@@ -0,0 +1,69 @@
+// Package sketch counts unique viewers with HyperLogLog++ sketches,
+// estimates latency quantiles and finds heavy hitters in bounded space.
+// Uniques and quantiles built for different hours, regions or files can be
+// merged, so they can be computed over any period.
+package sketch
+
+import (
+	"encoding/base64"
+
+	"github.com/axiomhq/hyperloglog"
+)
+
+// Uniques estimates number of distinct values added to it. Error is about 0.8%,
+// small sets (up to hundreds of values) are counted almost exactly.
+type Uniques struct {
+	hll *hyperloglog.Sketch
+}
+
+func New() *Uniques {
+	return &Uniques{hll: hyperloglog.New14()}
+}
+
+func (u *Uniques) Add(value string) {
+	u.hll.Insert([]byte(value))
+}
+
+func (u *Uniques) Count() int {
+	return int(u.hll.Estimate())
+}
+
+// Merge adds all the values of other sketch to u
+func (u *Uniques) Merge(other *Uniques) error {
+	return u.hll.Merge(other.hll)
+}
+
+func (u *Uniques) MarshalBinary() ([]byte, error) {
+	return u.hll.MarshalBinary()
+}
+
+func (u *Uniques) UnmarshalBinary(data []byte) error {
+	hll := hyperloglog.New14()
+	if err := hll.UnmarshalBinary(data); err != nil {
+		return err
+	}
+	u.hll = hll
+	return nil
+}
+
+// Encode returns base64 of the binary form, for JSON and CSV outputs
+func (u *Uniques) Encode() (string, error) {
+	data, err := u.MarshalBinary()
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(data), nil
+}
+
+// Decode restores sketch returned by Encode
+func Decode(encoded string) (*Uniques, error) {
+	data, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, err
+	}
+	u := &Uniques{}
+	if err = u.UnmarshalBinary(data); err != nil {
+		return nil, err
+	}
+	return u, nil
+}
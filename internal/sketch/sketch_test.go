@@ -0,0 +1,107 @@
+package sketch
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUniques(t *testing.T) {
+	assert := assert.New(t)
+	u := New()
+	for i := 0; i < 3; i++ {
+		u.Add("104.28.131.0")
+		u.Add("104.28.106.0")
+	}
+	assert.Equal(2, u.Count())
+
+	hour1, hour2 := New(), New()
+	for i := 0; i < 100000; i++ {
+		hour1.Add(fmt.Sprintf("10.0.%d.%d", i/256, i%256))
+		hour2.Add(fmt.Sprintf("10.0.%d.%d", (i+50000)/256, (i+50000)%256))
+	}
+	assert.NoError(hour1.Merge(hour2))
+	assert.InEpsilon(150000, hour1.Count(), 0.02)
+
+	data, err := hour1.MarshalBinary()
+	assert.NoError(err)
+	restored := &Uniques{}
+	assert.NoError(restored.UnmarshalBinary(data))
+	assert.Equal(hour1.Count(), restored.Count())
+
+	encoded, err := u.Encode()
+	assert.NoError(err)
+	decoded, err := Decode(encoded)
+	if assert.NoError(err) {
+		assert.Equal(2, decoded.Count())
+	}
+	_, err = Decode("not a sketch")
+	assert.Error(err)
+}
+
+func TestQuantiles(t *testing.T) {
+	assert := assert.New(t)
+	q := NewQuantiles()
+	assert.Equal(0.0, q.Quantile(0.5))
+	for i := 1; i <= 1000; i++ {
+		q.Add(float64(i))
+	}
+	q.Add(-1)
+	assert.Equal(uint64(1000), q.Count())
+	assert.InEpsilon(500, q.Quantile(0.5), 0.01)
+	assert.InEpsilon(900, q.Quantile(0.9), 0.01)
+	assert.InEpsilon(990, q.Quantile(0.99), 0.01)
+
+	// merged sketch is the same as the sketch of all the values
+	other := NewQuantiles()
+	for i := 0; i < 1000; i++ {
+		other.Add(0)
+	}
+	q.Merge(other)
+	assert.Equal(0.0, q.Quantile(0.25))
+	assert.InEpsilon(500, q.Quantile(0.75), 0.01)
+
+	encoded, err := q.Encode()
+	assert.NoError(err)
+	restored, err := DecodeQuantiles(encoded)
+	assert.NoError(err)
+	assert.Equal(q, restored)
+	_, err = DecodeQuantiles("AQI=")
+	assert.Error(err)
+}
+
+func TestTopK(t *testing.T) {
+	assert := assert.New(t)
+	topk := NewTopK(3)
+	// heavy keys among many light ones
+	for i := 0; i < 1000; i++ {
+		topk.Add("heavy", 10)
+		if i%2 == 0 {
+			topk.Add("medium", 5)
+		}
+		topk.Add(fmt.Sprintf("light%d", i), 1)
+	}
+	assert.Equal(3, topk.Len())
+	top := topk.Top(2)
+	if assert.Len(top, 2) {
+		assert.Equal(TopItem{Key: "heavy", Count: 10000}, top[0])
+		assert.Equal("medium", top[1].Key)
+		assert.True(top[1].Count-top[1].Error <= 2500 && top[1].Count >= 2500)
+	}
+	assert.True(topk.Contains("heavy"))
+	assert.False(topk.Contains("light0"))
+
+	topk = NewTopK(2)
+	topk.Add("a", 5)
+	topk.Add("b", 3)
+	evicted, ok := topk.Add("c", 1)
+	assert.True(ok)
+	assert.Equal("b", evicted)
+	assert.Equal([]TopItem{{Key: "a", Count: 5}, {Key: "c", Count: 4, Error: 3}}, topk.Top(10))
+	item, ok := topk.Get("c")
+	assert.True(ok)
+	assert.Equal(int64(3), item.Error)
+	_, ok = topk.Get("b")
+	assert.False(ok)
+}
@@ -0,0 +1,117 @@
+package sketch
+
+import (
+	"container/heap"
+	"sort"
+)
+
+// TopItem is the key tracked by TopK. Count may be overestimated by up to
+// Error, so the true count is between Count-Error and Count.
+type TopItem struct {
+	Key   string
+	Count int64
+	Error int64
+}
+
+// TopK finds heavy hitters in the stream of weighted keys with the
+// Space-Saving algorithm, keeping at most capacity keys. Every key with more
+// than 1/capacity of the total weight is guaranteed to be kept.
+type TopK struct {
+	capacity int
+	items    topHeap
+	index    map[string]int // position of the key in items
+}
+
+func NewTopK(capacity int) *TopK {
+	if capacity < 1 {
+		capacity = 1
+	}
+	t := &TopK{capacity: capacity, index: make(map[string]int, capacity)}
+	t.items.index = t.index
+	return t
+}
+
+// Add adds weight to the key. If there is no room for the new key, the key
+// with the smallest count is replaced, it is returned as evicted.
+func (t *TopK) Add(key string, weight int64) (evicted string, ok bool) {
+	if i, found := t.index[key]; found {
+		t.items.items[i].Count += weight
+		heap.Fix(&t.items, i)
+		return "", false
+	}
+	if len(t.items.items) < t.capacity {
+		heap.Push(&t.items, TopItem{Key: key, Count: weight})
+		return "", false
+	}
+	// new key takes over the count of the smallest one, which is its error
+	min := &t.items.items[0]
+	evicted = min.Key
+	delete(t.index, evicted)
+	*min = TopItem{Key: key, Count: min.Count + weight, Error: min.Count}
+	t.index[key] = 0
+	heap.Fix(&t.items, 0)
+	return evicted, true
+}
+
+func (t *TopK) Len() int {
+	return len(t.items.items)
+}
+
+// Contains tells if the key is tracked
+func (t *TopK) Contains(key string) bool {
+	_, ok := t.index[key]
+	return ok
+}
+
+// Get returns count of the key and its error, if the key is tracked
+func (t *TopK) Get(key string) (TopItem, bool) {
+	i, ok := t.index[key]
+	if !ok {
+		return TopItem{}, false
+	}
+	return t.items.items[i], true
+}
+
+// Top returns n keys with the largest counts, sorted by count
+func (t *TopK) Top(n int) []TopItem {
+	res := make([]TopItem, len(t.items.items))
+	copy(res, t.items.items)
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].Count != res[j].Count {
+			return res[i].Count > res[j].Count
+		}
+		return res[i].Key < res[j].Key
+	})
+	if len(res) > n {
+		res = res[:n]
+	}
+	return res
+}
+
+// topHeap is min-heap of the items by count, keeping index up to date
+type topHeap struct {
+	items []TopItem
+	index map[string]int
+}
+
+func (h *topHeap) Len() int           { return len(h.items) }
+func (h *topHeap) Less(i, j int) bool { return h.items[i].Count < h.items[j].Count }
+
+func (h *topHeap) Swap(i, j int) {
+	h.items[i], h.items[j] = h.items[j], h.items[i]
+	h.index[h.items[i].Key] = i
+	h.index[h.items[j].Key] = j
+}
+
+func (h *topHeap) Push(x interface{}) {
+	item := x.(TopItem)
+	h.index[item.Key] = len(h.items)
+	h.items = append(h.items, item)
+}
+
+func (h *topHeap) Pop() interface{} {
+	item := h.items[len(h.items)-1]
+	h.items = h.items[:len(h.items)-1]
+	delete(h.index, item.Key)
+	return item
+}
@@ -0,0 +1,102 @@
+package source
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/iterator"
+	"google.golang.org/api/option"
+)
+
+type (
+	gcsSource struct {
+		client *storage.Client
+		bucket string
+	}
+
+	gcsIterator struct {
+		it *storage.ObjectIterator
+	}
+)
+
+// NewGCS creates source reading from Google Cloud Storage bucket.
+// If credentials file name is empty, unauthenticated access is used.
+func NewGCS(ctx context.Context, bucket, credentials string) (Source, error) {
+	var opts []option.ClientOption
+	if credentials != "" {
+		opts = append(opts, option.WithCredentialsFile(credentials))
+	} else {
+		opts = append(opts, option.WithoutAuthentication())
+	}
+	client, err := storage.NewClient(ctx, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("storage.NewClient: %v", err)
+	}
+	return &gcsSource{client: client, bucket: bucket}, nil
+}
+
+func (gs *gcsSource) List(ctx context.Context, query *Query) ObjectIterator {
+	var sq *storage.Query
+	if query != nil {
+		sq = &storage.Query{
+			Delimiter:   query.Delimiter,
+			Prefix:      query.Prefix,
+			StartOffset: query.StartOffset,
+			EndOffset:   query.EndOffset,
+		}
+	}
+	return &gcsIterator{it: gs.client.Bucket(gs.bucket).Objects(ctx, sq)}
+}
+
+func (gs *gcsSource) Open(ctx context.Context, name string) (io.ReadCloser, error) {
+	rc, err := gs.client.Bucket(gs.bucket).Object(name).NewReader(ctx)
+	if errors.Is(err, storage.ErrObjectNotExist) {
+		return nil, ErrNotExist
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Object(%q).NewReader: %v", name, err)
+	}
+	return rc, nil
+}
+
+func (gs *gcsSource) Stat(ctx context.Context, name string) (*ObjectAttrs, error) {
+	attrs, err := gs.client.Bucket(gs.bucket).Object(name).Attrs(ctx)
+	if errors.Is(err, storage.ErrObjectNotExist) {
+		return nil, ErrNotExist
+	}
+	if err != nil {
+		return nil, err
+	}
+	return fromGCSAttrs(attrs), nil
+}
+
+func (gs *gcsSource) Close() error {
+	return gs.client.Close()
+}
+
+func (gs *gcsSource) String() string {
+	return "gs://" + gs.bucket
+}
+
+func (gi *gcsIterator) Next() (*ObjectAttrs, error) {
+	attrs, err := gi.it.Next()
+	if err == iterator.Done {
+		return nil, Done
+	}
+	if err != nil {
+		return nil, err
+	}
+	return fromGCSAttrs(attrs), nil
+}
+
+func fromGCSAttrs(attrs *storage.ObjectAttrs) *ObjectAttrs {
+	return &ObjectAttrs{
+		Name:    attrs.Name,
+		Prefix:  attrs.Prefix,
+		Size:    attrs.Size,
+		Updated: attrs.Updated,
+	}
+}
@@ -0,0 +1,198 @@
+package source
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const httpTimeout = 64 * time.Second
+
+var hrefRe = regexp.MustCompile(`(?i)href="([^"]+)"`)
+
+type (
+	// httpSource reads logs from HTTP server that serves directory listings
+	// (like nginx's autoindex). Directories are recognised by trailing slash in links.
+	httpSource struct {
+		base   *url.URL
+		client *http.Client
+	}
+
+	httpError struct {
+		uri        string
+		statusCode int
+	}
+)
+
+// NewHTTP creates source reading from the HTTP server, base should point to the
+// directory containing site hash directories
+func NewHTTP(base string) (Source, error) {
+	u, err := url.Parse(base)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasSuffix(u.Path, "/") {
+		u.Path += "/"
+	}
+	return &httpSource{
+		base:   u,
+		client: &http.Client{Timeout: httpTimeout},
+	}, nil
+}
+
+func (hs *httpSource) List(ctx context.Context, query *Query) ObjectIterator {
+	var q Query
+	if query != nil {
+		q = *query
+	}
+	if q.Delimiter != "" && q.Delimiter != "/" {
+		return newSliceIterator(nil, fmt.Errorf("unsupported delimiter %q", q.Delimiter))
+	}
+	dir := path.Dir(q.Prefix + "x")
+	if dir == "." {
+		dir = ""
+	} else {
+		dir += "/"
+	}
+	var objects []*ObjectAttrs
+	err := hs.walk(ctx, dir, &q, &objects)
+	return newSliceIterator(objects, err)
+}
+
+// walk lists directory dir (relative to base, with trailing slash) and
+// descends into subdirectories unless delimiter is set
+func (hs *httpSource) walk(ctx context.Context, dir string, q *Query, objects *[]*ObjectAttrs) error {
+	entries, err := hs.readDir(ctx, dir)
+	if err != nil {
+		if he, ok := err.(*httpError); ok && he.statusCode == http.StatusNotFound {
+			return nil
+		}
+		return err
+	}
+	for _, entry := range entries {
+		name := dir + entry
+		if strings.HasSuffix(entry, "/") {
+			if !q.mayContain(name) {
+				continue
+			}
+			if q.Delimiter != "" && strings.HasPrefix(name, q.Prefix) {
+				if q.matches(name) {
+					*objects = append(*objects, &ObjectAttrs{Prefix: name})
+				}
+				continue
+			}
+			if err = hs.walk(ctx, name, q, objects); err != nil {
+				return err
+			}
+			continue
+		}
+		if q.matches(name) {
+			*objects = append(*objects, &ObjectAttrs{Name: name})
+		}
+	}
+	return nil
+}
+
+// readDir returns names of the entries in the directory listing,
+// subdirectories have trailing slash
+func (hs *httpSource) readDir(ctx context.Context, dir string) ([]string, error) {
+	resp, err := hs.do(ctx, "GET", dir)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	var entries []string
+	seen := make(map[string]bool)
+	for _, m := range hrefRe.FindAllStringSubmatch(string(body), -1) {
+		href, err := url.PathUnescape(m[1])
+		if err != nil || href == "" {
+			continue
+		}
+		// skip parent links, sorting links and absolute links
+		if strings.HasPrefix(href, ".") || strings.HasPrefix(href, "?") || strings.HasPrefix(href, "/") || strings.Contains(href, "://") {
+			continue
+		}
+		entry := strings.TrimSuffix(href, "/")
+		if strings.Contains(entry, "/") || strings.HasPrefix(entry, ".") {
+			continue
+		}
+		if strings.HasSuffix(href, "/") {
+			entry += "/"
+		}
+		if !seen[entry] {
+			seen[entry] = true
+			entries = append(entries, entry)
+		}
+	}
+	return entries, nil
+}
+
+func (hs *httpSource) Open(ctx context.Context, name string) (io.ReadCloser, error) {
+	resp, err := hs.do(ctx, "GET", name)
+	if err != nil {
+		if he, ok := err.(*httpError); ok && he.statusCode == http.StatusNotFound {
+			return nil, ErrNotExist
+		}
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+func (hs *httpSource) Stat(ctx context.Context, name string) (*ObjectAttrs, error) {
+	resp, err := hs.do(ctx, "HEAD", name)
+	if err != nil {
+		if he, ok := err.(*httpError); ok && he.statusCode == http.StatusNotFound {
+			return nil, ErrNotExist
+		}
+		return nil, err
+	}
+	resp.Body.Close()
+	oa := &ObjectAttrs{
+		Name: name,
+		Size: resp.ContentLength,
+	}
+	if lm, err := http.ParseTime(resp.Header.Get("Last-Modified")); err == nil {
+		oa.Updated = lm
+	}
+	return oa, nil
+}
+
+func (hs *httpSource) do(ctx context.Context, method, name string) (*http.Response, error) {
+	uri := hs.base.ResolveReference(&url.URL{Path: name}).String()
+	req, err := http.NewRequestWithContext(ctx, method, uri, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := hs.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, &httpError{uri: uri, statusCode: resp.StatusCode}
+	}
+	return resp, nil
+}
+
+func (hs *httpSource) Close() error {
+	return nil
+}
+
+func (hs *httpSource) String() string {
+	return hs.base.String()
+}
+
+func (he *httpError) Error() string {
+	return fmt.Sprintf("error fetching %s status=%d", he.uri, he.statusCode)
+}
@@ -0,0 +1,131 @@
+package source
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// localSource reads logs from the local directory tree that
+// mirrors bucket layout, for example `example-logs` folder
+type localSource struct {
+	root string
+}
+
+// NewLocal creates source reading from the directory root
+func NewLocal(root string) (Source, error) {
+	fi, err := os.Stat(root)
+	if err != nil {
+		return nil, err
+	}
+	if !fi.IsDir() {
+		return nil, fmt.Errorf("%s is not a directory", root)
+	}
+	return &localSource{root: root}, nil
+}
+
+func (ls *localSource) List(ctx context.Context, query *Query) ObjectIterator {
+	var q Query
+	if query != nil {
+		q = *query
+	}
+	if q.Delimiter != "" && q.Delimiter != "/" {
+		return newSliceIterator(nil, fmt.Errorf("unsupported delimiter %q", q.Delimiter))
+	}
+	// only walk directory that can contain objects with the prefix
+	dir := path.Dir(q.Prefix + "x")
+	var objects []*ObjectAttrs
+	err := filepath.WalkDir(ls.fullPath(dir), func(fullPath string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if err = ctx.Err(); err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(ls.root, fullPath)
+		if err != nil {
+			return err
+		}
+		name := filepath.ToSlash(rel)
+		if name == "." {
+			return nil
+		}
+		if strings.HasPrefix(d.Name(), ".") {
+			// skip hidden files like .DS_Store
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if d.IsDir() {
+			if !q.mayContain(name + "/") {
+				return filepath.SkipDir
+			}
+			if q.Delimiter != "" && strings.HasPrefix(name+"/", q.Prefix) && name+"/" != q.Prefix {
+				if q.matches(name + "/") {
+					objects = append(objects, &ObjectAttrs{Prefix: name + "/"})
+				}
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !q.matches(name) {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		objects = append(objects, &ObjectAttrs{
+			Name:    name,
+			Size:    info.Size(),
+			Updated: info.ModTime(),
+		})
+		return nil
+	})
+	return newSliceIterator(objects, err)
+}
+
+func (ls *localSource) Open(ctx context.Context, name string) (io.ReadCloser, error) {
+	f, err := os.Open(ls.fullPath(name))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, ErrNotExist
+	}
+	return f, err
+}
+
+func (ls *localSource) Stat(ctx context.Context, name string) (*ObjectAttrs, error) {
+	fi, err := os.Stat(ls.fullPath(name))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, ErrNotExist
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &ObjectAttrs{
+		Name:    name,
+		Size:    fi.Size(),
+		Updated: fi.ModTime(),
+	}, nil
+}
+
+func (ls *localSource) Close() error {
+	return nil
+}
+
+func (ls *localSource) String() string {
+	return "file://" + ls.root
+}
+
+func (ls *localSource) fullPath(name string) string {
+	return filepath.Join(ls.root, filepath.FromSlash(name))
+}
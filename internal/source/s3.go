@@ -0,0 +1,173 @@
+package source
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+const defaultS3Region = "us-east-1"
+
+type (
+	s3Source struct {
+		client *s3.S3
+		bucket string
+	}
+
+	// s3Iterator fetches listing page by page, filtering out
+	// objects outside of query's offsets
+	s3Iterator struct {
+		ctx      context.Context
+		src      *s3Source
+		query    Query
+		input    *s3.ListObjectsV2Input
+		page     []*ObjectAttrs
+		finished bool
+	}
+)
+
+// NewS3 creates source reading from S3 bucket. Endpoint can point to
+// any S3-compatible store, in which case path-style addressing is used.
+// Credentials are taken from the standard AWS environment variables or shared config.
+func NewS3(ctx context.Context, bucket, endpoint, region string) (Source, error) {
+	if region == "" {
+		region = defaultS3Region
+	}
+	cfg := aws.NewConfig().WithRegion(region)
+	if endpoint != "" {
+		cfg = cfg.WithEndpoint(endpoint).WithS3ForcePathStyle(true)
+	}
+	sess, err := session.NewSessionWithOptions(session.Options{
+		Config:            *cfg,
+		SharedConfigState: session.SharedConfigEnable,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("s3 session: %v", err)
+	}
+	return &s3Source{client: s3.New(sess), bucket: bucket}, nil
+}
+
+func (ss *s3Source) List(ctx context.Context, query *Query) ObjectIterator {
+	var q Query
+	if query != nil {
+		q = *query
+	}
+	input := &s3.ListObjectsV2Input{
+		Bucket: aws.String(ss.bucket),
+		Prefix: aws.String(q.Prefix),
+	}
+	if q.Delimiter != "" {
+		input.Delimiter = aws.String(q.Delimiter)
+	}
+	if len(q.StartOffset) > 0 {
+		// StartAfter is exclusive, so start from the shorter name
+		// and filter out names less than StartOffset
+		input.StartAfter = aws.String(q.StartOffset[:len(q.StartOffset)-1])
+	}
+	return &s3Iterator{ctx: ctx, src: ss, query: q, input: input}
+}
+
+func (ss *s3Source) Open(ctx context.Context, name string) (io.ReadCloser, error) {
+	out, err := ss.client.GetObjectWithContext(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(ss.bucket),
+		Key:    aws.String(name),
+	})
+	if err != nil {
+		return nil, convertS3Error(name, err)
+	}
+	return out.Body, nil
+}
+
+func (ss *s3Source) Stat(ctx context.Context, name string) (*ObjectAttrs, error) {
+	out, err := ss.client.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(ss.bucket),
+		Key:    aws.String(name),
+	})
+	if err != nil {
+		return nil, convertS3Error(name, err)
+	}
+	return &ObjectAttrs{
+		Name:    name,
+		Size:    aws.Int64Value(out.ContentLength),
+		Updated: aws.TimeValue(out.LastModified),
+	}, nil
+}
+
+func (ss *s3Source) Close() error {
+	return nil
+}
+
+func (ss *s3Source) String() string {
+	return "s3://" + ss.bucket
+}
+
+func (si *s3Iterator) Next() (*ObjectAttrs, error) {
+	for {
+		if len(si.page) > 0 {
+			oa := si.page[0]
+			si.page = si.page[1:]
+			name := oa.Name + oa.Prefix
+			if si.query.EndOffset != "" && name >= si.query.EndOffset {
+				si.finished = true
+				si.page = nil
+				return nil, Done
+			}
+			if !si.query.matches(name) {
+				continue
+			}
+			return oa, nil
+		}
+		if si.finished {
+			return nil, Done
+		}
+		if err := si.fetch(); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (si *s3Iterator) fetch() error {
+	out, err := si.src.client.ListObjectsV2WithContext(si.ctx, si.input)
+	if err != nil {
+		return fmt.Errorf("Bucket(%q).ListObjectsV2: %v", si.src.bucket, err)
+	}
+	var page []*ObjectAttrs
+	for _, obj := range out.Contents {
+		page = append(page, &ObjectAttrs{
+			Name:    aws.StringValue(obj.Key),
+			Size:    aws.Int64Value(obj.Size),
+			Updated: aws.TimeValue(obj.LastModified),
+		})
+	}
+	for _, cp := range out.CommonPrefixes {
+		page = append(page, &ObjectAttrs{Prefix: aws.StringValue(cp.Prefix)})
+	}
+	sort.Slice(page, func(i, j int) bool {
+		return page[i].Name+page[i].Prefix < page[j].Name+page[j].Prefix
+	})
+	si.page = page
+	if aws.BoolValue(out.IsTruncated) {
+		si.input.ContinuationToken = out.NextContinuationToken
+	} else {
+		si.finished = true
+	}
+	return nil
+}
+
+func convertS3Error(name string, err error) error {
+	var aerr awserr.Error
+	if errors.As(err, &aerr) {
+		switch aerr.Code() {
+		case s3.ErrCodeNoSuchKey, "NotFound":
+			return ErrNotExist
+		}
+	}
+	return fmt.Errorf("Object(%q): %v", name, err)
+}
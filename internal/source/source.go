@@ -0,0 +1,172 @@
+package source
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+var (
+	// Done is returned by ObjectIterator.Next when there are no more objects
+	Done = errors.New("no more items in iterator")
+	// ErrNotExist is returned by Stat and Open when object does not exist
+	ErrNotExist = errors.New("object does not exist")
+)
+
+type (
+	// Query selects objects returned by Source.List. It follows semantic of
+	// storage.Query from GCS SDK: names are compared lexicographically,
+	// StartOffset is inclusive and EndOffset is exclusive.
+	Query struct {
+		Delimiter   string
+		Prefix      string
+		StartOffset string
+		EndOffset   string
+	}
+
+	// ObjectAttrs describes object in the source. If Delimiter was set in the query
+	// synthetic 'directory' entries are returned with only Prefix set.
+	ObjectAttrs struct {
+		Name    string
+		Prefix  string
+		Size    int64
+		Updated time.Time
+	}
+
+	ObjectIterator interface {
+		// Next returns next object or Done if there are no more objects
+		Next() (*ObjectAttrs, error)
+	}
+
+	// Source is a place CDN logs are read from. Object names are slash-separated
+	// and follow StackPath layout: <siteHash>/cds/YYYY/MM/DD/cds_YYYYMMDD-HHMMSS-XXX.log.gz
+	Source interface {
+		List(ctx context.Context, query *Query) ObjectIterator
+		Open(ctx context.Context, name string) (io.ReadCloser, error)
+		Stat(ctx context.Context, name string) (*ObjectAttrs, error)
+		Close() error
+		String() string
+	}
+)
+
+// New creates source from the uri. Supported forms are:
+//
+//	gs://bucket or just bucket - Google Cloud Storage bucket
+//	s3://bucket?endpoint=https://host&region=us-east-1 - S3 or S3-compatible store
+//	file:///path/to/dir, /path/to/dir or ./dir - local directory
+//	http://host/path/ or https://host/path/ - HTTP server with directory listings
+func New(ctx context.Context, uri, credentials string) (Source, error) {
+	if uri == "" {
+		return nil, errors.New("empty source")
+	}
+	if isLocalPath(uri) {
+		return NewLocal(uri)
+	}
+	if !strings.Contains(uri, "://") {
+		return NewGCS(ctx, uri, credentials)
+	}
+	u, err := url.Parse(uri)
+	if err != nil {
+		return nil, fmt.Errorf("invalid source %q: %w", uri, err)
+	}
+	switch u.Scheme {
+	case "gs":
+		return NewGCS(ctx, u.Host, credentials)
+	case "s3":
+		return NewS3(ctx, u.Host, u.Query().Get("endpoint"), u.Query().Get("region"))
+	case "file":
+		return NewLocal(u.Path)
+	case "http", "https":
+		return NewHTTP(uri)
+	}
+	return nil, fmt.Errorf("unsupported source scheme %q", u.Scheme)
+}
+
+// Validate checks that uri can be used by New without contacting the source
+func Validate(uri string) error {
+	if uri == "" {
+		return errors.New("empty source")
+	}
+	if isLocalPath(uri) || !strings.Contains(uri, "://") {
+		return nil
+	}
+	u, err := url.Parse(uri)
+	if err != nil {
+		return fmt.Errorf("invalid source %q: %w", uri, err)
+	}
+	switch u.Scheme {
+	case "gs", "s3":
+		if u.Host == "" {
+			return fmt.Errorf("bucket name is missing in %q", uri)
+		}
+	case "file", "http", "https":
+	default:
+		return fmt.Errorf("unsupported source scheme %q", u.Scheme)
+	}
+	return nil
+}
+
+func isLocalPath(uri string) bool {
+	return strings.HasPrefix(uri, "/") || strings.HasPrefix(uri, "./") || strings.HasPrefix(uri, "../") || uri == "."
+}
+
+// matches reports if name satisfies query's prefix and offsets
+func (q *Query) matches(name string) bool {
+	if !strings.HasPrefix(name, q.Prefix) {
+		return false
+	}
+	if q.StartOffset != "" && name < q.StartOffset {
+		return false
+	}
+	if q.EndOffset != "" && name >= q.EndOffset {
+		return false
+	}
+	return true
+}
+
+// mayContain reports if directory dir (with trailing slash) can hold objects
+// matching the query, so listing of other directories can be skipped
+func (q *Query) mayContain(dir string) bool {
+	if !strings.HasPrefix(dir, q.Prefix) && !strings.HasPrefix(q.Prefix, dir) {
+		return false
+	}
+	// all names in the directory start with dir, so they are not less than it
+	if q.EndOffset != "" && dir >= q.EndOffset {
+		return false
+	}
+	// and they are all less than StartOffset if dir differs from it before its end
+	if q.StartOffset != "" && dir < q.StartOffset && !strings.HasPrefix(q.StartOffset, dir) {
+		return false
+	}
+	return true
+}
+
+// sliceIterator iterates over already fetched objects
+type sliceIterator struct {
+	objects []*ObjectAttrs
+	err     error
+}
+
+func newSliceIterator(objects []*ObjectAttrs, err error) *sliceIterator {
+	sort.Slice(objects, func(i, j int) bool {
+		return objects[i].Name+objects[i].Prefix < objects[j].Name+objects[j].Prefix
+	})
+	return &sliceIterator{objects: objects, err: err}
+}
+
+func (si *sliceIterator) Next() (*ObjectAttrs, error) {
+	if si.err != nil {
+		return nil, si.err
+	}
+	if len(si.objects) == 0 {
+		return nil, Done
+	}
+	oa := si.objects[0]
+	si.objects = si.objects[1:]
+	return oa, nil
+}
@@ -0,0 +1,172 @@
+package source
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var testFiles = []string{
+	"fsdf98f23/cds/2021/04/17/cds_20210417-001855-3247996011ch4.log.gz",
+	"fsdf98f23/cds/2021/04/17/cds_20210417-013400-3319235011ch4.log.gz",
+	"fsdf98f23/cds/2021/04/17/cds_20210417-020536-54134032001dc2.log.gz",
+	"fsdf98f23/cds/2021/04/18/cds_20210418-000005-27664444008dc2.log.gz",
+	"fsdf98f23/cds/2021/04/17/.DS_Store",
+	"idd4ds5hu/cds/2021/04/17/cds_20210417-001855-3247996011ch4.log.gz",
+}
+
+func makeTestTree(t *testing.T) string {
+	root := t.TempDir()
+	for _, fn := range testFiles {
+		fullName := filepath.Join(root, filepath.FromSlash(fn))
+		if err := os.MkdirAll(filepath.Dir(fullName), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(fullName, []byte(fn), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return root
+}
+
+func listAll(t *testing.T, src Source, query *Query) ([]string, []string) {
+	var dirs, files []string
+	it := src.List(context.Background(), query)
+	for {
+		oa, err := it.Next()
+		if err == Done {
+			break
+		}
+		if !assert.NoError(t, err) {
+			break
+		}
+		if oa.Prefix != "" {
+			dirs = append(dirs, oa.Prefix)
+		} else {
+			files = append(files, oa.Name)
+		}
+	}
+	return dirs, files
+}
+
+func testSource(t *testing.T, src Source) {
+	assert := assert.New(t)
+	dirs, files := listAll(t, src, &Query{Delimiter: "/"})
+	assert.Equal([]string{"fsdf98f23/", "idd4ds5hu/"}, dirs)
+	assert.Empty(files)
+
+	dirs, files = listAll(t, src, &Query{Delimiter: "/", Prefix: "fsdf98f23/cds/2021/04/"})
+	assert.Equal([]string{"fsdf98f23/cds/2021/04/17/", "fsdf98f23/cds/2021/04/18/"}, dirs)
+	assert.Empty(files)
+
+	dirs, files = listAll(t, src, &Query{Prefix: "fsdf98f23/cds/"})
+	assert.Empty(dirs)
+	assert.Equal([]string{testFiles[0], testFiles[1], testFiles[2], testFiles[3]}, files)
+
+	_, files = listAll(t, src, &Query{
+		StartOffset: "fsdf98f23/cds/2021/04/17/cds_20210417-013400",
+		EndOffset:   "fsdf98f23/cds/2021/04/18/cds_20210418-000000",
+	})
+	assert.Equal([]string{testFiles[1], testFiles[2]}, files)
+
+	_, files = listAll(t, src, nil)
+	assert.Len(files, 5)
+
+	rc, err := src.Open(context.Background(), testFiles[2])
+	if assert.NoError(err) {
+		data, err := ioutil.ReadAll(rc)
+		assert.NoError(err)
+		assert.Equal(testFiles[2], string(data))
+		rc.Close()
+	}
+	_, err = src.Open(context.Background(), "fsdf98f23/cds/2021/04/17/missing.log.gz")
+	assert.Equal(ErrNotExist, err)
+
+	oa, err := src.Stat(context.Background(), testFiles[2])
+	if assert.NoError(err) {
+		assert.Equal(int64(len(testFiles[2])), oa.Size)
+	}
+	_, err = src.Stat(context.Background(), "missing.log.gz")
+	assert.Equal(ErrNotExist, err)
+}
+
+func TestLocalSource(t *testing.T) {
+	root := makeTestTree(t)
+	src, err := New(context.Background(), "file://"+root, "")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer src.Close()
+	testSource(t, src)
+}
+
+func TestHTTPSource(t *testing.T) {
+	root := makeTestTree(t)
+	ts := httptest.NewServer(http.FileServer(http.Dir(root)))
+	defer ts.Close()
+	src, err := New(context.Background(), ts.URL, "")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer src.Close()
+	testSource(t, src)
+}
+
+func TestHTTPSourceSkipsDirs(t *testing.T) {
+	assert := assert.New(t)
+	root := makeTestTree(t)
+	var listed []string
+	fs := http.FileServer(http.Dir(root))
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		listed = append(listed, r.URL.Path)
+		fs.ServeHTTP(w, r)
+	}))
+	defer ts.Close()
+	src, err := New(context.Background(), ts.URL, "")
+	if !assert.NoError(err) {
+		return
+	}
+	defer src.Close()
+
+	_, files := listAll(t, src, &Query{
+		Prefix:      "fsdf98f23/cds/",
+		StartOffset: "fsdf98f23/cds/2021/04/18/cds_20210418-000000",
+		EndOffset:   "fsdf98f23/cds/2021/04/18/cds_20210418-010000",
+	})
+	assert.Equal([]string{testFiles[3]}, files)
+	assert.Equal([]string{"/fsdf98f23/cds/", "/fsdf98f23/cds/2021/", "/fsdf98f23/cds/2021/04/", "/fsdf98f23/cds/2021/04/18/"}, listed)
+}
+
+func TestQueryMayContain(t *testing.T) {
+	assert := assert.New(t)
+	q := &Query{
+		Prefix:      "fsdf98f23/cds/",
+		StartOffset: "fsdf98f23/cds/2021/04/17/cds_20210417-013400",
+		EndOffset:   "fsdf98f23/cds/2021/04/18/cds_20210418-000000",
+	}
+	assert.True(q.mayContain("fsdf98f23/"))
+	assert.True(q.mayContain("fsdf98f23/cds/2021/"))
+	assert.True(q.mayContain("fsdf98f23/cds/2021/04/17/"))
+	assert.True(q.mayContain("fsdf98f23/cds/2021/04/18/"))
+	assert.False(q.mayContain("idd4ds5hu/"))
+	assert.False(q.mayContain("fsdf98f23/cds/2021/04/16/"))
+	assert.False(q.mayContain("fsdf98f23/cds/2021/04/19/"))
+	assert.False(q.mayContain("fsdf98f23/cds/2020/"))
+}
+
+func TestValidate(t *testing.T) {
+	assert := assert.New(t)
+	assert.NoError(Validate("lp-cdn-logs-e9u3qf432"))
+	assert.NoError(Validate("gs://lp-cdn-logs-e9u3qf432"))
+	assert.NoError(Validate("s3://logs?endpoint=https://s3.example.com"))
+	assert.NoError(Validate("./example-logs"))
+	assert.Error(Validate(""))
+	assert.Error(Validate("s3://"))
+	assert.Error(Validate("ftp://host/logs"))
+}
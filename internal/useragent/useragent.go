@@ -0,0 +1,129 @@
+// Package useragent sorts user agents of the requests into device class, OS,
+// browser or player and tells bots apart from viewers.
+package useragent
+
+import "strings"
+
+// device classes
+const (
+	DeviceDesktop = "desktop"
+	DeviceMobile  = "mobile"
+	DeviceTablet  = "tablet"
+	DeviceTV      = "tv"
+	DeviceBot     = "bot"
+	DeviceOther   = "other"
+)
+
+// Other is OS or player that is not recognized
+const Other = "other"
+
+// Info is the class of the user agent
+type Info struct {
+	Device string
+	OS     string
+	// Player is native player (avplayer, exoplayer, vlc...) or the browser.
+	// Players running in the browser, like hls.js, show up as the browser.
+	Player string
+	Bot    bool
+}
+
+// rule maps user agents containing any of the (lowercase) tokens to the name
+type rule struct {
+	name   string
+	tokens []string
+}
+
+var (
+	botTokens = []string{
+		"bot/", "bot;", "bot ", "bot)", "bot-", "-bot", "crawler", "spider", "slurp",
+		"facebookexternalhit", "whatsapp", "curl/", "wget/", "python-", "go-http-client",
+		"headlesschrome", "phantomjs", "scrapy", "libwww", "httpclient", "java/",
+	}
+	// first matching rule wins, so more specific ones go first
+	osRules = []rule{
+		{"tvos", []string{"apple tv", "appletv", "tvos"}},
+		{"ios", []string{"iphone", "ipad", "ipod"}},
+		{"android", []string{"android"}},
+		{"windows", []string{"windows"}},
+		{"chromeos", []string{"cros"}},
+		{"macos", []string{"macintosh", "mac os x"}},
+		{"linux", []string{"linux", "x11"}},
+	}
+	playerRules = []rule{
+		{"avplayer", []string{"applecoremedia"}},
+		{"exoplayer", []string{"exoplayer"}},
+		{"vlc", []string{"vlc"}},
+		{"ffmpeg", []string{"lavf"}},
+		{"stagefright", []string{"stagefright"}},
+		{"roku", []string{"roku"}},
+		{"edge", []string{"edg/", "edga/", "edgios/"}},
+		{"opera", []string{"opr/", "opera"}},
+		{"firefox", []string{"firefox/", "fxios/"}},
+		{"chrome", []string{"chrome/", "crios/"}},
+		{"safari", []string{"safari/"}},
+	}
+	tvTokens = []string{
+		"apple tv", "appletv", "smarttv", "smart-tv", "tizen", "web0s", "webos", "roku",
+		"aftb", "afts", "aftm", "aftt", "bravia", "googletv", "android tv", "crkey",
+	}
+	browsers = []string{"edge", "opera", "firefox", "chrome", "safari"}
+)
+
+// Classify returns class of the user agent, "other" for the parts not recognized
+func Classify(ua string) Info {
+	lower := strings.ToLower(ua)
+	info := Info{
+		OS:     match(lower, osRules),
+		Player: match(lower, playerRules),
+		Bot:    containsAny(lower, botTokens),
+	}
+	switch {
+	case info.Bot:
+		info.Device = DeviceBot
+	case containsAny(lower, tvTokens):
+		info.Device = DeviceTV
+	case strings.Contains(lower, "ipad") || strings.Contains(lower, "tablet"):
+		info.Device = DeviceTablet
+	case info.OS == "android":
+		// Android browsers tell phones by "Mobile", apps rarely say anything
+		if strings.Contains(lower, "mobile") || !isBrowser(info.Player) {
+			info.Device = DeviceMobile
+		} else {
+			info.Device = DeviceTablet
+		}
+	case info.OS == "ios":
+		info.Device = DeviceMobile
+	case info.OS == "windows" || info.OS == "macos" || info.OS == "linux" || info.OS == "chromeos":
+		info.Device = DeviceDesktop
+	default:
+		info.Device = DeviceOther
+	}
+	return info
+}
+
+func match(lower string, rules []rule) string {
+	for _, r := range rules {
+		if containsAny(lower, r.tokens) {
+			return r.name
+		}
+	}
+	return Other
+}
+
+func containsAny(s string, tokens []string) bool {
+	for _, token := range tokens {
+		if strings.Contains(s, token) {
+			return true
+		}
+	}
+	return false
+}
+
+func isBrowser(player string) bool {
+	for _, b := range browsers {
+		if player == b {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,40 @@
+package useragent
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClassify(t *testing.T) {
+	assert := assert.New(t)
+	cases := []struct {
+		ua       string
+		expected Info
+	}{
+		{"Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/15.1 Safari/605.1.15",
+			Info{Device: DeviceDesktop, OS: "macos", Player: "safari"}},
+		{"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/96.0.4664.45 Safari/537.36 Edg/96.0.1054.29",
+			Info{Device: DeviceDesktop, OS: "windows", Player: "edge"}},
+		{"Mozilla/5.0 (Linux; Android 11; Pixel 5) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/96.0.4664.45 Mobile Safari/537.36",
+			Info{Device: DeviceMobile, OS: "android", Player: "chrome"}},
+		{"Mozilla/5.0 (Linux; Android 11; SM-T870) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/96.0.4664.45 Safari/537.36",
+			Info{Device: DeviceTablet, OS: "android", Player: "chrome"}},
+		{"AppleCoreMedia/1.0.0.19B74 (iPhone; U; CPU OS 15_1 like Mac OS X; en_us)",
+			Info{Device: DeviceMobile, OS: "ios", Player: "avplayer"}},
+		{"AppleCoreMedia/1.0.0.19J346 (Apple TV; U; CPU OS 15_0 like Mac OS X; en_us)",
+			Info{Device: DeviceTV, OS: "tvos", Player: "avplayer"}},
+		{"MyApp/1.2 (Linux;Android 12) ExoPlayerLib/2.15.1",
+			Info{Device: DeviceMobile, OS: "android", Player: "exoplayer"}},
+		{"VLC/3.0.16 LibVLC/3.0.16",
+			Info{Device: DeviceOther, OS: Other, Player: "vlc"}},
+		{"Mozilla/5.0 (compatible; Googlebot/2.1; +http://www.google.com/bot.html)",
+			Info{Device: DeviceBot, OS: Other, Player: Other, Bot: true}},
+		{"curl/7.79.1",
+			Info{Device: DeviceBot, OS: Other, Player: Other, Bot: true}},
+		{"-", Info{Device: DeviceOther, OS: Other, Player: Other}},
+	}
+	for _, c := range cases {
+		assert.Equal(c.expected, Classify(c.ua), c.ua)
+	}
+}
@@ -2,7 +2,10 @@ package utils
 
 import (
 	"errors"
+	"fmt"
+	neturl "net/url"
 	"path"
+	"strconv"
 	"strings"
 
 	"github.com/golang/glog"
@@ -10,17 +13,50 @@ import (
 
 type (
 	IDType string
+
+	// SegmentKind tells what kind of file is requested
+	SegmentKind string
+
+	// CacheStatus tells if the response was served from the edge cache
+	CacheStatus string
+
+	// PlaybackURL is the parsed path of the playback request
+	PlaybackURL struct {
+		ID     string
+		IDType IDType
+		// Rendition is the path between stream ID and file name, usually the
+		// index of the rendition or track (5 in /hls/ID/5/chunk_1.ts). Empty
+		// for the files of the stream as a whole, like master playlist.
+		Rendition string
+		Kind      SegmentKind
+	}
 )
 
 const (
 	IDTypeManifestID IDType = "manifest_id"
 	IDTypeStreamID   IDType = "stream_id"
 	// IDTypeStreamName IDType = "stream_name"
+
+	SegmentKindManifest SegmentKind = "manifest"
+	SegmentKindSegment  SegmentKind = "segment"
+	SegmentKindInit     SegmentKind = "init"
+	// SegmentKindVOD is the whole recording downloaded as mp4
+	SegmentKindVOD SegmentKind = "vod"
+
+	CacheHit  CacheStatus = "hit"
+	CacheMiss CacheStatus = "miss"
+	// CacheUnknown is for lines without cache status
+	CacheUnknown CacheStatus = ""
 )
 
 var (
-	errNotPlaybackURL = errors.New("invalid URL format: first token should be one of hls, recording or live")
-	errWrongExtension = errors.New("invalid URL format - url not ending with index.m3u8 or ts or .mp4")
+	// ErrNotPlaybackURL is returned by ParseURL for valid request paths that are
+	// not playback of a stream, like /favicon.ico or /crossdomain.xml
+	ErrNotPlaybackURL = errors.New("not a playback URL")
+	errBadURL         = errors.New("invalid URL format")
+	errNotPlaybackURL = fmt.Errorf("%w: first token should be one of hls, recording or live", ErrNotPlaybackURL)
+	errWrongExtension = fmt.Errorf("%w: url not ending with index.m3u8 or ts or .mp4", ErrNotPlaybackURL)
+	errShortPath      = fmt.Errorf("%w: too few path elements", ErrNotPlaybackURL)
 )
 
 func Includes(slice []string, val string) bool {
@@ -41,16 +77,30 @@ func IsEmptyLine(line string) bool {
 }
 
 func GetStreamId(url string) (string, IDType, error) {
+	pu, err := ParseURL(url)
+	if err != nil {
+		return "", "", err
+	}
+	return pu.ID, pu.IDType, nil
+}
+
+// ParseURL extracts stream ID, rendition and segment kind from the request path.
+// Error wraps ErrNotPlaybackURL if the path is valid, but not of a playback.
+func ParseURL(url string) (*PlaybackURL, error) {
+	if !strings.HasPrefix(url, "/") || strings.Contains(url, " ") {
+		return nil, errBadURL
+	}
 	toks := strings.Split(url, "/")
 	lenght := len(toks)
 	var idType IDType
 	if lenght < 4 {
-		return "", "", errors.New("invalid URL format")
+		return nil, errShortPath
 	}
-	ext := path.Ext(toks[lenght-1])
+	fileName := toks[lenght-1]
+	ext := path.Ext(fileName)
 
 	if !Includes(allowedExts, ext) {
-		return "", "", errWrongExtension
+		return nil, errWrongExtension
 	}
 
 	id := toks[2]
@@ -64,14 +114,13 @@ func GetStreamId(url string) (string, IDType, error) {
 		idType = IDTypeManifestID
 		panic(url)
 	default:
-		return "", "", errNotPlaybackURL
+		return nil, errNotPlaybackURL
 	}
 
 	if strings.HasPrefix(id, "video+") {
 		if toks[3] == "hls" {
 			glog.Infof("==> strange url: %q", url)
 			panic("strange url ")
-			return id[6:], IDTypeManifestID, nil
 		}
 		// glog.Infof("####> stream name url=%q", url)
 		// return toks[2][6:], IDTypeStreamName, nil
@@ -81,7 +130,99 @@ func GetStreamId(url string) (string, IDType, error) {
 	id = strings.TrimPrefix(id, "video+")
 	id = strings.TrimPrefix(id, "videorec+")
 
-	return id, idType, nil
+	kind := SegmentKindSegment
+	switch {
+	case ext == ".m3u8":
+		kind = SegmentKindManifest
+	case strings.HasPrefix(fileName, "init"):
+		kind = SegmentKindInit
+	case ext == ".mp4" && idType == IDTypeStreamID:
+		kind = SegmentKindVOD
+	}
+	return &PlaybackURL{
+		ID:        id,
+		IDType:    idType,
+		Rendition: strings.Join(toks[3:lenght-1], "/"),
+		Kind:      kind,
+	}, nil
+}
+
+// SegmentDuration returns duration of the segment in milliseconds taken from
+// `dur` parameter of the query string (msn=516&mTrack=1&dur=2000). If there is
+// none, the file name of the segment is tried, with start and end times in
+// milliseconds (chunk_1030000_1032000.ts, chunk_1030000_1032000.2.m4s for
+// the parts). 0 if not found.
+func SegmentDuration(query, url string) int64 {
+	if dur, err := strconv.ParseInt(queryParam(query, "dur"), 10, 64); err == nil && dur >= 0 {
+		return dur
+	}
+	name := path.Base(url)
+	if i := strings.IndexByte(name, '.'); i >= 0 {
+		name = name[:i]
+	}
+	toks := strings.Split(name, "_")
+	if len(toks) < 3 {
+		return 0
+	}
+	start, err := strconv.ParseInt(toks[len(toks)-2], 10, 64)
+	if err != nil {
+		return 0
+	}
+	end, err := strconv.ParseInt(toks[len(toks)-1], 10, 64)
+	if err != nil || end < start {
+		return 0
+	}
+	return end - start
+}
+
+// SessionID returns `sessId` parameter of the query string, set by some players
+// to identify playback session, empty if not found
+func SessionID(query string) string {
+	return queryParam(query, "sessId")
+}
+
+// RefererHost returns lowercase host of the referer without port and "www.",
+// empty if referer is not logged or is not an URL
+func RefererHost(referer string) string {
+	if referer == "" || referer == "-" {
+		return ""
+	}
+	u, err := neturl.Parse(referer)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimPrefix(strings.ToLower(u.Hostname()), "www.")
+}
+
+// ParseCacheStatus classifies cache status logged by the edge (HIT, TCP_MEM_HIT,
+// STALE, MISS, EXPIRED, BYPASS...). First of the fields that is set is used.
+func ParseCacheStatus(fields ...string) CacheStatus {
+	for _, field := range fields {
+		status := strings.ToUpper(strings.TrimSpace(field))
+		if status == "" || status == "-" {
+			continue
+		}
+		switch {
+		case strings.Contains(status, "HIT"), status == "STALE", status == "UPDATING", status == "REVALIDATED":
+			return CacheHit
+		case strings.Contains(status, "MISS"), status == "EXPIRED", status == "BYPASS", status == "PASS",
+			status == "DYNAMIC", strings.Contains(status, "REFRESH"):
+			return CacheMiss
+		}
+		return CacheUnknown
+	}
+	return CacheUnknown
+}
+
+// queryParam returns raw value of the first name parameter of the query string
+func queryParam(query, name string) string {
+	prefix := name + "="
+	for _, param := range strings.Split(query, "&") {
+		if strings.HasPrefix(param, prefix) {
+			return param[len(prefix):]
+		}
+	}
+	return ""
 }
 
 var allowedExts = []string{".m3u8", ".ts", ".mp4", ".m4s"}
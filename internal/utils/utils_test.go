@@ -1,6 +1,7 @@
 package utils
 
 import (
+	"errors"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -54,3 +55,78 @@ func TestFind(t *testing.T) {
 		t.Errorf("Invalid result. the string 'nottest' isn't included in the slice ")
 	}
 }
+
+func TestParseURL(t *testing.T) {
+	assert := assert.New(t)
+	cases := []struct {
+		url       string
+		rendition string
+		kind      SegmentKind
+	}{
+		{"/hls/fiolz5txbwy3smsr/index.m3u8", "", SegmentKindManifest},
+		{"/hls/fiolz5txbwy3smsr/0_1/index.m3u8", "0_1", SegmentKindManifest},
+		{"/hls/video+9e70xehvtu637q6p/5/chunk_1031999.ts", "5", SegmentKindSegment},
+		{"/cmaf/9e70xehvtu637q6p/0/chunk_689999.0.m4s", "0", SegmentKindSegment},
+		{"/cmaf/9e70xehvtu637q6p/0/init.mp4", "0", SegmentKindInit},
+		{"/recordings/db90372d-655f-4118-8dcc-7e02b1557bed/source.mp4", "", SegmentKindVOD},
+		{"/recordings/db90372d-655f-4118-8dcc-7e02b1557bed/0/index.m3u8", "0", SegmentKindManifest},
+	}
+	for _, c := range cases {
+		pu, err := ParseURL(c.url)
+		if !assert.NoError(err, c.url) {
+			continue
+		}
+		assert.Equal(c.rendition, pu.Rendition, c.url)
+		assert.Equal(c.kind, pu.Kind, c.url)
+	}
+	for _, url := range []string{"/wp-admin/index.php", "/favicon.ico", "/crossdomain.xml", "/", "/hls/x.ts"} {
+		_, err := ParseURL(url)
+		assert.True(errors.Is(err, ErrNotPlaybackURL), url)
+	}
+	for _, url := range []string{"-", "hls/9e70xehvtu637q6p/0/chunk_1.ts", "/hls/9e70 xehvtu637q6p/0/chunk_1.ts"} {
+		_, err := ParseURL(url)
+		if assert.Error(err, url) {
+			assert.False(errors.Is(err, ErrNotPlaybackURL), url)
+		}
+	}
+}
+
+func TestSegmentDuration(t *testing.T) {
+	assert := assert.New(t)
+	assert.Equal(int64(2000), SegmentDuration("msn=516&mTrack=1&dur=2000", "/hls/video+9e70xehvtu637q6p/5/chunk_1031999.ts"))
+	assert.Equal(int64(500), SegmentDuration("dur=500&sessId=3405774711", "/hls/9e70xehvtu637q6p/0/chunk_1000_3000.ts"))
+	assert.Equal(int64(0), SegmentDuration("-", "/hls/9e70xehvtu637q6p/0/chunk_1031999.ts"))
+	assert.Equal(int64(0), SegmentDuration("msn=1&dur=x", "/hls/9e70xehvtu637q6p/0/chunk_1.ts"))
+	// duration from the file name
+	assert.Equal(int64(2000), SegmentDuration("-", "/hls/9e70xehvtu637q6p/0/chunk_1030000_1032000.ts"))
+	assert.Equal(int64(1500), SegmentDuration("msn=1&dur=x", "/hls/video+9e70xehvtu637q6p/5/chunk_11410499_11411999.2.m4s"))
+	assert.Equal(int64(0), SegmentDuration("-", "/hls/9e70xehvtu637q6p/0/chunk_3000_1000.ts"))
+	assert.Equal(int64(0), SegmentDuration("-", "/hls/9e70xehvtu637q6p/0/chunk_x_1000.ts"))
+}
+
+func TestSessionID(t *testing.T) {
+	assert := assert.New(t)
+	assert.Equal("3405774711", SessionID("dur=500&sessId=3405774711"))
+	assert.Equal("", SessionID("msn=516&dur=2000"))
+	assert.Equal("", SessionID("-"))
+}
+
+func TestRefererHost(t *testing.T) {
+	assert := assert.New(t)
+	assert.Equal("cdn.livepeer.monster", RefererHost("https://cdn.livepeer.monster/"))
+	assert.Equal("example.com", RefererHost("https://WWW.Example.com:8443/watch?v=1"))
+	assert.Equal("", RefererHost("-"))
+	assert.Equal("", RefererHost("not a url"))
+	assert.Equal("", RefererHost("%zz"))
+}
+
+func TestParseCacheStatus(t *testing.T) {
+	assert := assert.New(t)
+	assert.Equal(CacheHit, ParseCacheStatus("HIT"))
+	assert.Equal(CacheHit, ParseCacheStatus("-", "TCP_MEM_HIT"))
+	assert.Equal(CacheHit, ParseCacheStatus("stale", "MISS"))
+	assert.Equal(CacheMiss, ParseCacheStatus("MISS", "-"))
+	assert.Equal(CacheMiss, ParseCacheStatus("EXPIRED"))
+	assert.Equal(CacheUnknown, ParseCacheStatus("-", "-"))
+	assert.Equal(CacheUnknown, ParseCacheStatus("NONE"))
+}